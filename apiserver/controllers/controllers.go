@@ -17,9 +17,16 @@
 package controllers
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"strconv"
 	"time"
@@ -32,9 +39,34 @@ import (
 	"coriolis-ovm-exporter/apiserver/params"
 	"coriolis-ovm-exporter/config"
 	gErrors "coriolis-ovm-exporter/errors"
+	"coriolis-ovm-exporter/formats/delta"
+	"coriolis-ovm-exporter/formats/qcow2"
+	"coriolis-ovm-exporter/formats/stream"
+	"coriolis-ovm-exporter/formats/vmdk"
 	"coriolis-ovm-exporter/manager"
+	"coriolis-ovm-exporter/metrics"
 )
 
+const (
+	// diskFormatRaw serves disks as they are stored on the repository.
+	diskFormatRaw = "raw"
+	// diskFormatQCOW2 serves disks as qcow2 images.
+	diskFormatQCOW2 = "qcow2"
+	// diskFormatVMDK serves disks as streamOptimized VMDK images.
+	diskFormatVMDK = "vmdk"
+)
+
+// abortResponse closes the connection of a response whose headers were already
+// sent, so the client can tell it is incomplete. Simply returning from the handler
+// would end the response as if it were complete.
+func abortResponse() {
+	panic(http.ErrAbortHandler)
+}
+
+// maxChunkJSONSize is the maximum size we allow for one JSON encoded chunk
+// in the body of batched read requests.
+const maxChunkJSONSize = 256
+
 // NewAPIController returns a new instance of APIController
 func NewAPIController(cfg *config.Config) (*APIController, error) {
 	if err := cfg.Validate(); err != nil {
@@ -71,6 +103,9 @@ func handleError(w http.ResponseWriter, err error) {
 	case *gErrors.ConflictError:
 		w.WriteHeader(http.StatusConflict)
 		apiErr.Error = "Conflict"
+	case *gErrors.UnavailableError:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		apiErr.Error = "Service Unavailable"
 	default:
 		log.Printf("Unhandled error: %+v", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -87,6 +122,18 @@ type APIController struct {
 	mgr *manager.SnapshotManager
 }
 
+// StopAccepting makes the API controller refuse new snapshot operations, and
+// stops background workers. Running operations and requests are not affected.
+func (a *APIController) StopAccepting() {
+	a.mgr.StopAccepting()
+}
+
+// Shutdown stops the API controller. Running snapshot operations are given
+// until ctx expires to finish, after which they are rolled back.
+func (a *APIController) Shutdown(ctx context.Context) error {
+	return a.mgr.Shutdown(ctx)
+}
+
 // LoginHandler attempts to authenticate against the OVM endpoint with the supplied credentials,
 // and returns a JWT token.
 func (a *APIController) LoginHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,9 +146,11 @@ func (a *APIController) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	cli := auth.NewOVMClient(loginInfo.Username, loginInfo.Password, a.cfg.OVMEndpoint)
 
 	if err := cli.AttemptRequest(); err != nil {
+		metrics.Logins.WithLabelValues(metrics.LoginFailure).Inc()
 		handleError(w, err)
 		return
 	}
+	metrics.Logins.WithLabelValues(metrics.LoginSuccess).Inc()
 
 	expireToken := time.Now().Add(a.cfg.JWTAuth.TimeToLive.Duration).Unix()
 	claims := auth.JWTClaims{
@@ -149,7 +198,8 @@ func (a *APIController) GetVMHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(vmInfo)
 }
 
-// ListSnapshotsHandler lists all snapshots for a VM.
+// ListSnapshotsHandler lists all snapshots for a VM. It takes an optional query
+// arg labelSelector, which limits the list to snapshots with matching labels.
 func (a *APIController) ListSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, ok := vars["vmID"]
@@ -158,7 +208,8 @@ func (a *APIController) ListSnapshotsHandler(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	snaps, err := a.mgr.ListSnapshots(vmID)
+	labelSelector := r.URL.Query().Get("labelSelector")
+	snaps, err := a.mgr.ListSnapshots(vmID, labelSelector)
 	if err != nil {
 		log.Printf("failed to list snapshots: %q", err)
 		handleError(w, err)
@@ -170,6 +221,8 @@ func (a *APIController) ListSnapshotsHandler(w http.ResponseWriter, r *http.Requ
 // GetSnapshotHandler gets information about a single snapshot for a VM. It takes an optional
 // query arg diff, which allows comparison of current snapshot, with a previous snapshot.
 // The snapshot we are comparing to must exist and must be older than the current one.
+// The optional diffMode query arg selects how the two snapshots are compared.
+// If the checksums query arg is true, the checksum of every chunk is included.
 func (a *APIController) GetSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, ok := vars["vmID"]
@@ -193,16 +246,63 @@ func (a *APIController) GetSnapshotHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	compareTo := r.URL.Query().Get("compareTo")
-	snapshot, err := a.mgr.GetSnapshot(vmID, snapID, compareTo, squashChunks)
+	diffMode := r.URL.Query().Get("diffMode")
+	unlock, err := a.mgr.RLockSnapshots(snapID, compareTo)
+	if err != nil {
+		log.Printf("failed to lock snapshot: %q", err)
+		handleError(w, err)
+		return
+	}
+	defer unlock()
+
+	snapshot, err := a.mgr.GetSnapshot(vmID, snapID, compareTo, diffMode, squashChunks)
 	if err != nil {
 		log.Printf("failed to get snapshot: %q", err)
 		handleError(w, err)
 		return
 	}
+
+	if checksums, _ := strconv.ParseBool(r.URL.Query().Get("checksums")); checksums {
+		algorithm := r.URL.Query().Get("checksumAlgorithm")
+		if algorithm == "" {
+			algorithm = manager.ChecksumSHA256
+		}
+		snapshot, err = a.mgr.WithChunkChecksums(snapshot, algorithm)
+		if err != nil {
+			log.Printf("failed to get chunk checksums: %q", err)
+			handleError(w, err)
+			return
+		}
+	}
 	json.NewEncoder(w).Encode(snapshot)
 }
 
-// DeleteSnapshotHandler removes one snapshot associated with a VM.
+// SnapshotSpaceHandler returns the space used by a snapshot and its disks,
+// split between exclusive and shared bytes.
+func (a *APIController) SnapshotSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	usage, err := a.mgr.GetSnapshotSpaceUsage(vmID, snapID)
+	if err != nil {
+		log.Printf("failed to get snapshot space usage: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(usage)
+}
+
+// DeleteSnapshotHandler removes one snapshot associated with a VM. Snapshots
+// with active leases are only removed if the force query arg is true.
 func (a *APIController) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, ok := vars["vmID"]
@@ -216,7 +316,8 @@ func (a *APIController) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	err := a.mgr.DeleteSnapshot(vmID, snapID)
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	err := a.mgr.DeleteSnapshot(vmID, snapID, force)
 	if err != nil {
 		log.Printf("failed to delete snapshot: %q", err)
 		handleError(w, err)
@@ -225,7 +326,9 @@ func (a *APIController) DeleteSnapshotHandler(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusOK)
 }
 
-// PurgeSnapshotsHandler deletes all snapshots associated with a VM.
+// PurgeSnapshotsHandler deletes all snapshots associated with a VM. If any
+// snapshot has an active lease, nothing is deleted unless the force query arg
+// is true.
 func (a *APIController) PurgeSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, ok := vars["vmID"]
@@ -233,14 +336,17 @@ func (a *APIController) PurgeSnapshotsHandler(w http.ResponseWriter, r *http.Req
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := a.mgr.PurgeSnapshots(vmID); err != nil {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if err := a.mgr.PurgeSnapshots(vmID, force); err != nil {
 		log.Printf("failed to purge snapshots: %q", err)
 		handleError(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
-// CreateSnapshotHandler creates a snapshots for a VM.
+// CreateSnapshotHandler creates a snapshots for a VM. If the async query arg is
+// true, the snapshot is created in the background and a task is returned instead.
 func (a *APIController) CreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	// CreateSnapshot
 	vars := mux.Vars(r)
@@ -250,7 +356,27 @@ func (a *APIController) CreateSnapshotHandler(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	snapData, err := a.mgr.CreateSnapshot(vmID)
+	var snapReq params.CreateSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&snapReq); err != nil && err != io.EOF {
+		// The request body is optional.
+		handleError(w, gErrors.ErrBadRequest)
+		return
+	}
+
+	async, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	if async {
+		task, err := a.mgr.CreateSnapshotTask(vmID, snapReq)
+		if err != nil {
+			log.Printf("failed to create snapshot task: %q", err)
+			handleError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(task)
+		return
+	}
+
+	snapData, err := a.mgr.CreateSnapshot(vmID, snapReq)
 	if err != nil {
 		log.Printf("failed to create snapshot: %q", err)
 		handleError(w, err)
@@ -259,8 +385,118 @@ func (a *APIController) CreateSnapshotHandler(w http.ResponseWriter, r *http.Req
 	json.NewEncoder(w).Encode(snapData)
 }
 
+// CreateLeaseHandler acquires a lease on a snapshot, which protects it from
+// being deleted until the lease expires or is released.
+func (a *APIController) CreateLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var leaseReq params.LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&leaseReq); err != nil {
+		handleError(w, gErrors.ErrBadRequest)
+		return
+	}
+
+	lease, err := a.mgr.CreateLease(vmID, snapID, leaseReq)
+	if err != nil {
+		log.Printf("failed to create lease: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(lease)
+}
+
+// RenewLeaseHandler extends an active lease on a snapshot.
+func (a *APIController) RenewLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	leaseID, ok := vars["leaseID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var leaseReq params.LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&leaseReq); err != nil {
+		handleError(w, gErrors.ErrBadRequest)
+		return
+	}
+
+	lease, err := a.mgr.RenewLease(vmID, snapID, leaseID, leaseReq)
+	if err != nil {
+		log.Printf("failed to renew lease: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(lease)
+}
+
+// ReleaseLeaseHandler removes a lease on a snapshot.
+func (a *APIController) ReleaseLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	leaseID, ok := vars["leaseID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := a.mgr.ReleaseLease(vmID, snapID, leaseID); err != nil {
+		log.Printf("failed to release lease: %q", err)
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GetTaskHandler gets information about an asynchronous task.
+func (a *APIController) GetTaskHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID, ok := vars["taskID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	task, err := a.mgr.GetTask(taskID)
+	if err != nil {
+		log.Printf("failed to get task: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(task)
+}
+
 // ConsumeSnapshotHandler allows the caller to download arbitrary ranges of disk data from a
-// disk snapshot.
+// disk snapshot. It takes an optional query arg format, which selects the image format the
+// disk is served as. Valid values are "raw" (default), "qcow2" and "vmdk".
 func (a *APIController) ConsumeSnapshotHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	vmID, ok := vars["vmID"]
@@ -280,7 +516,23 @@ func (a *APIController) ConsumeSnapshotHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	snapshot, err := a.mgr.GetSnapshot(vmID, snapID, "", false)
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", diskFormatRaw, diskFormatQCOW2, diskFormatVMDK:
+	default:
+		handleError(w, gErrors.NewBadRequestError("invalid format %q", format))
+		return
+	}
+
+	unlock, err := a.mgr.RLockSnapshots(snapID)
+	if err != nil {
+		log.Printf("failed to lock snapshot: %q", err)
+		handleError(w, err)
+		return
+	}
+	defer unlock()
+
+	snapshot, err := a.mgr.GetSnapshot(vmID, snapID, "", "", false)
 	if err != nil {
 		log.Printf("failed to get snapshot: %q", err)
 		handleError(w, err)
@@ -306,7 +558,552 @@ func (a *APIController) ConsumeSnapshotHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 	defer fp.Close()
-	http.ServeContent(w, r, disk.Path, time.Time{}, fp)
+
+	if format == diskFormatVMDK {
+		a.serveVMDK(w, r, vmID, fp, disk)
+		return
+	}
+
+	// ServeContent uses the ETag to handle If-Range and If-None-Match.
+	// Ranges always refer to the uncompressed disk, so an If-Range holding
+	// the ETag of a compressed response matches as well.
+	w.Header().Set("ETag", diskETag(snapID, disk.Name, format))
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+		r.Header.Set("If-Range", identityETag(ifRange))
+	}
+
+	var content io.ReadSeeker = fp
+	if format != diskFormatQCOW2 && r.Method == http.MethodGet {
+		if err := a.setRangeDigest(w, r, snapID, disk, fp); err != nil {
+			log.Printf("failed to compute range digest: %q", err)
+			handleError(w, err)
+			return
+		}
+	}
+
+	if format == diskFormatQCOW2 {
+		info, err := fp.Stat()
+		if err != nil {
+			log.Printf("failed to stat snapshot file: %q", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		img, err := qcow2.NewImage(fp, uint64(info.Size()), disk.Chunks)
+		if err != nil {
+			log.Printf("failed to create qcow2 image: %q", err)
+			handleError(w, err)
+			return
+		}
+		content = io.NewSectionReader(img, 0, img.Size())
+		// Don't let ServeContent guess the type from the raw file name.
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	metrics.ActiveDownloads.Inc()
+	defer metrics.ActiveDownloads.Dec()
+
+	cw := &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.VMDownloadBytes(vmID),
+	}
+	out, done := a.compressResponse(cw, r)
+	defer done()
+	http.ServeContent(out, r, disk.Path, time.Time{}, content)
+}
+
+// diskETag returns a strong ETag for a disk of a snapshot, served in the given
+// format. Snapshots never change once they are created, so the ETag does not
+// need to depend on the contents of the disk.
+func diskETag(snapID, diskName, format string) string {
+	if format == "" {
+		format = diskFormatRaw
+	}
+	return fmt.Sprintf(`"%s/%s/%s"`, snapID, diskName, format)
+}
+
+// setRangeDigest sets the Digest header of a response to a request for a single
+// range of a disk, if the client asked for one using the Want-Digest header. The
+// digest covers the requested range of the disk, before any content encoding is
+// applied. Supported algorithms are "sha-256" and "xxhash".
+//
+// The ETag of the response is not derived from the digest. An ETag identifies
+// the whole disk, not the requested range, and clients send it back in If-Range
+// to make sure all ranges they download come from the same disk. The ETag must
+// be set before calling setRangeDigest.
+func (a *APIController) setRangeDigest(w http.ResponseWriter, r *http.Request, snapID string, disk params.DiskSnapshot, fp *os.File) error {
+	wantDigest := r.Header.Get("Want-Digest")
+	rangeHeader := r.Header.Get("Range")
+	if wantDigest == "" || rangeHeader == "" {
+		return nil
+	}
+	// ServeContent ignores the Range header when If-Range does not match
+	// the ETag, in which case the digest would not match the response.
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != w.Header().Get("ETag") {
+		return nil
+	}
+
+	name, algorithm := negotiateDigest(wantDigest)
+	if algorithm == "" {
+		return nil
+	}
+
+	info, err := fp.Stat()
+	if err != nil {
+		return errors.Wrap(err, "fetching disk info")
+	}
+	chunk, ok := parseSingleRange(rangeHeader, uint64(info.Size()))
+	if !ok {
+		// Let ServeContent deal with multiple or invalid ranges.
+		return nil
+	}
+
+	// The range is read once to compute its digest, and once more to
+	// serve it. Skip the digest of large ranges, which are better fetched
+	// as chunks returned by the snapshot API, with checksums=true.
+	if chunk.Length > uint64(a.cfg.APIServer.MaxRangeBytesPerRequest) {
+		return nil
+	}
+
+	sumHex, err := a.mgr.RangeChecksum(snapID, disk, algorithm, chunk)
+	if err != nil {
+		return errors.Wrap(err, "computing checksum")
+	}
+	sum, err := hex.DecodeString(sumHex)
+	if err != nil {
+		return errors.Wrap(err, "decoding checksum")
+	}
+	w.Header().Set("Digest", fmt.Sprintf("%s=%s", name, base64.StdEncoding.EncodeToString(sum)))
+	return nil
+}
+
+// serveVMDK writes a disk as a streamOptimized VMDK image. The size of the image
+// is not known before it is generated, so HEAD requests only return headers,
+// Range requests are not supported and the response has no Content-Length.
+// Grains are already compressed, so the response itself is never compressed.
+func (a *APIController) serveVMDK(w http.ResponseWriter, r *http.Request, vmID string, fp *os.File, disk params.DiskSnapshot) {
+	info, err := fp.Stat()
+	if err != nil {
+		log.Printf("failed to stat snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Accept-Ranges", "none")
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	metrics.ActiveDownloads.Inc()
+	defer metrics.ActiveDownloads.Dec()
+
+	cw := &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.VMDownloadBytes(vmID),
+	}
+	cw.WriteHeader(http.StatusOK)
+
+	if err := vmdk.Write(cw, fp, uint64(info.Size()), disk.Chunks, a.cfg.Compression.GzipLevel); err != nil {
+		log.Printf("failed to write vmdk image: %q", err)
+		abortResponse()
+	}
+}
+
+// DeltaHandler writes a delta artifact holding the chunks of a disk that changed
+// since an older snapshot, along with their checksums. It takes an optional query
+// arg compareTo, which is the ID of the base snapshot. If compareTo is not set,
+// the delta holds all allocated chunks of the disk.
+func (a *APIController) DeltaHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	diskID, ok := vars["diskID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	compareTo := r.URL.Query().Get("compareTo")
+	diffMode := r.URL.Query().Get("diffMode")
+	unlock, err := a.mgr.RLockSnapshots(snapID, compareTo)
+	if err != nil {
+		log.Printf("failed to lock snapshot: %q", err)
+		handleError(w, err)
+		return
+	}
+	defer unlock()
+
+	hdr, diskPath, err := a.mgr.GetDiskDelta(vmID, snapID, diskID, compareTo, diffMode)
+	if err != nil {
+		log.Printf("failed to get disk delta: %q", err)
+		handleError(w, err)
+		return
+	}
+
+	size, err := delta.Size(hdr)
+	if err != nil {
+		log.Printf("failed to get delta size: %q", err)
+		handleError(w, err)
+		return
+	}
+
+	fp, err := os.Open(diskPath)
+	if err != nil {
+		log.Printf("failed open snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	metrics.ActiveDownloads.Inc()
+	defer metrics.ActiveDownloads.Dec()
+
+	cw := &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.VMDownloadBytes(vmID),
+	}
+	out, done := a.compressResponse(cw, r)
+	defer done()
+
+	out.Header().Set("Content-Type", "application/octet-stream")
+	out.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	out.WriteHeader(http.StatusOK)
+
+	if err := delta.Write(out, hdr, fp); err != nil {
+		log.Printf("failed to write delta: %q", err)
+		abortResponse()
+	}
+}
+
+// ReadChunksHandler reads a list of chunks from a snapshotted disk, in a single
+// multipart/byteranges response. The list of chunks is sent as a JSON array in
+// the request body, using the same format as the chunks returned by
+// GetSnapshotHandler. The number of chunks and the total number of bytes that
+// can be requested at once are limited by the config.
+func (a *APIController) ReadChunksHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	diskID, ok := vars["diskID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Don't decode arbitrarily large bodies only to refuse them later.
+	body := http.MaxBytesReader(w, r.Body, int64(a.cfg.APIServer.MaxRangesPerRequest)*maxChunkJSONSize)
+	var chunks []params.Chunk
+	if err := json.NewDecoder(body).Decode(&chunks); err != nil {
+		handleError(w, gErrors.NewBadRequestError("invalid chunk list: %s", err))
+		return
+	}
+
+	if len(chunks) == 0 {
+		handleError(w, gErrors.NewBadRequestError("no chunks requested"))
+		return
+	}
+
+	if len(chunks) > a.cfg.APIServer.MaxRangesPerRequest {
+		handleError(w, gErrors.NewBadRequestError(
+			"too many chunks requested (%d), maximum is %d",
+			len(chunks), a.cfg.APIServer.MaxRangesPerRequest))
+		return
+	}
+
+	unlock, err := a.mgr.RLockSnapshots(snapID)
+	if err != nil {
+		log.Printf("failed to lock snapshot: %q", err)
+		handleError(w, err)
+		return
+	}
+	defer unlock()
+
+	disk, err := a.mgr.GetSnapshotDisk(vmID, snapID, diskID, "", "")
+	if err != nil {
+		log.Printf("failed to get snapshot disk: %q", err)
+		handleError(w, err)
+		return
+	}
+
+	fp, err := os.Open(disk.Path)
+	if err != nil {
+		log.Printf("failed open snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		log.Printf("failed to stat snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size := uint64(info.Size())
+
+	var total uint64
+	for _, chunk := range chunks {
+		if chunk.Length == 0 || chunk.Start+chunk.Length > size || chunk.Start+chunk.Length < chunk.Start {
+			handleError(w, gErrors.NewBadRequestError(
+				"invalid chunk at offset %d with length %d", chunk.Start, chunk.Length))
+			return
+		}
+		total += chunk.Length
+	}
+
+	if total > uint64(a.cfg.APIServer.MaxRangeBytesPerRequest) {
+		handleError(w, gErrors.NewBadRequestError(
+			"too many bytes requested (%d), maximum is %d",
+			total, a.cfg.APIServer.MaxRangeBytesPerRequest))
+		return
+	}
+
+	metrics.ActiveDownloads.Inc()
+	defer metrics.ActiveDownloads.Dec()
+
+	cw := &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.VMDownloadBytes(vmID),
+	}
+	out, done := a.compressResponse(cw, r)
+	defer done()
+
+	mw := multipart.NewWriter(out)
+	out.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	out.WriteHeader(http.StatusOK)
+
+	// Once the header was sent, errors can only be signaled by closing the
+	// connection before the closing boundary is written.
+	for _, chunk := range chunks {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/octet-stream"},
+			"Content-Range": {
+				fmt.Sprintf("bytes %d-%d/%d", chunk.Start, chunk.Start+chunk.Length-1, size),
+			},
+		})
+		if err != nil {
+			log.Printf("failed to write chunk: %q", err)
+			abortResponse()
+		}
+
+		section := io.NewSectionReader(fp, int64(chunk.Start), int64(chunk.Length))
+		if _, err := io.Copy(part, section); err != nil {
+			log.Printf("failed to write chunk: %q", err)
+			abortResponse()
+		}
+	}
+	if err := mw.Close(); err != nil {
+		log.Printf("failed to write chunk: %q", err)
+		abortResponse()
+	}
+}
+
+// compressResponse wraps w in a compressing writer, if the client accepts
+// a supported content encoding. The returned function must be called once
+// the response was written. HEAD requests are never compressed, so clients
+// can still use them to fetch the size of a disk. Range responses are
+// compressed as well. Their Content-Range header refers to the uncompressed
+// bytes of the disk, and the body is the compressed form of those bytes.
+func (a *APIController) compressResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	var encoding string
+	if a.cfg.Compression.Enabled && r.Method != http.MethodHead {
+		encoding = negotiateEncoding(r.Header.Get("Accept-Encoding"))
+	}
+
+	var level int
+	switch encoding {
+	case encodingZstd:
+		level = a.cfg.Compression.ZstdLevel
+	case encodingGzip:
+		level = a.cfg.Compression.GzipLevel
+	default:
+		return w, func() {}
+	}
+
+	compressor := &compressingResponseWriter{
+		ResponseWriter: w,
+		encoding:       encoding,
+		level:          level,
+	}
+	return compressor, func() {
+		if err := compressor.Close(); err != nil {
+			log.Printf("failed to flush compressed stream: %q", err)
+		}
+	}
+}
+
+// StreamSnapshotHandler writes all allocated chunks of a snapshotted disk
+// as a framed stream. It takes an optional query arg compareTo, which limits
+// the stream to the chunks that changed since an older snapshot.
+func (a *APIController) StreamSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	vmID, ok := vars["vmID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	snapID, ok := vars["snapshotID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	diskID, ok := vars["diskID"]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	compareTo := r.URL.Query().Get("compareTo")
+	diffMode := r.URL.Query().Get("diffMode")
+	unlock, err := a.mgr.RLockSnapshots(snapID, compareTo)
+	if err != nil {
+		log.Printf("failed to lock snapshot: %q", err)
+		handleError(w, err)
+		return
+	}
+	defer unlock()
+
+	disk, err := a.mgr.GetSnapshotDisk(vmID, snapID, diskID, compareTo, diffMode)
+	if err != nil {
+		log.Printf("failed to get snapshot disk: %q", err)
+		handleError(w, err)
+		return
+	}
+
+	fp, err := os.Open(disk.Path)
+	if err != nil {
+		log.Printf("failed open snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer fp.Close()
+
+	info, err := fp.Stat()
+	if err != nil {
+		log.Printf("failed to stat snapshot file: %q", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	size := uint64(info.Size())
+
+	metrics.ActiveDownloads.Inc()
+	defer metrics.ActiveDownloads.Dec()
+
+	cw := &countingResponseWriter{
+		ResponseWriter: w,
+		counter:        metrics.VMDownloadBytes(vmID),
+	}
+	out, done := a.compressResponse(cw, r)
+	defer done()
+
+	out.Header().Set("Content-Type", "application/octet-stream")
+	out.WriteHeader(http.StatusOK)
+
+	// Once the header was sent, errors can only be signaled by closing the
+	// connection before the end record is written.
+	sw, err := stream.NewWriter(out, size)
+	if err != nil {
+		log.Printf("failed to write stream: %q", err)
+		abortResponse()
+	}
+	for _, chunk := range disk.Chunks {
+		// Extents may extend past the end of the file.
+		if chunk.Start >= size {
+			continue
+		}
+		length := chunk.Length
+		if chunk.Start+length > size {
+			length = size - chunk.Start
+		}
+
+		// Unwritten extents read as zeros. A full stream is applied onto
+		// an empty file, so they can be skipped altogether.
+		if chunk.Unwritten {
+			if compareTo == "" {
+				continue
+			}
+			if err := sw.WriteZero(chunk.Start, length); err != nil {
+				log.Printf("failed to write stream: %q", err)
+				abortResponse()
+			}
+			continue
+		}
+
+		section := io.NewSectionReader(fp, int64(chunk.Start), int64(length))
+		if err := sw.WriteChunk(chunk.Start, length, section); err != nil {
+			log.Printf("failed to write stream: %q", err)
+			abortResponse()
+		}
+	}
+	if err := sw.Close(); err != nil {
+		log.Printf("failed to write stream: %q", err)
+		abortResponse()
+	}
+}
+
+// ReconcileHandler compares the snapshots recorded in the database with the
+// snapshot files present on all repositories. It takes an optional query arg
+// dryRun, which defaults to true. If dryRun is false, orphans are removed.
+func (a *APIController) ReconcileHandler(w http.ResponseWriter, r *http.Request) {
+	dryRun := true
+	if dryRunParam := r.URL.Query().Get("dryRun"); dryRunParam != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(dryRunParam)
+		if err != nil {
+			handleError(w, gErrors.NewBadRequestError("invalid dryRun value %q", dryRunParam))
+			return
+		}
+	}
+
+	report, err := a.mgr.ReconcileSnapshots(dryRun)
+	if err != nil {
+		log.Printf("failed to reconcile snapshots: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// SpaceReportHandler returns the space used by all snapshots, per disk,
+// per snapshot and per repository.
+func (a *APIController) SpaceReportHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := a.mgr.SpaceReport()
+	if err != nil {
+		log.Printf("failed to get space report: %q", err)
+		handleError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// RefreshInventoryHandler reloads the cached list of repositories and VMs.
+func (a *APIController) RefreshInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if err := a.mgr.RefreshInventory(); err != nil {
+		log.Printf("failed to refresh inventory: %q", err)
+		handleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 // NotFoundHandler is returned when an invalid URL is acccessed
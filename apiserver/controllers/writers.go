@@ -0,0 +1,267 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package controllers
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/manager"
+)
+
+// countingResponseWriter adds the number of body bytes written through
+// it to a prometheus counter.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	counter prometheus.Counter
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(b)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// ReadFrom allows the underlying writer to use sendfile when serving
+// files, if it supports it.
+func (c *countingResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := c.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(c.ResponseWriter, r)
+	}
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+// negotiateEncoding returns the content encoding we should use for a
+// response, given the Accept-Encoding header sent by the client. zstd is
+// preferred over gzip when the client accepts both with the same weight.
+// An empty string is returned if the response should not be compressed.
+func negotiateEncoding(acceptEncoding string) string {
+	var weights = map[string]float64{}
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				weight = q
+			}
+		}
+		weights[name] = weight
+	}
+
+	var ret string
+	var best float64
+	for _, encoding := range []string{encodingZstd, encodingGzip} {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > best {
+			ret = encoding
+			best = weight
+		}
+	}
+	return ret
+}
+
+// digestAlgorithms maps the digest names used in Want-Digest and Digest
+// headers to checksum algorithms.
+var digestAlgorithms = map[string]string{
+	"sha-256": manager.ChecksumSHA256,
+	"xxhash":  manager.ChecksumXXHash,
+}
+
+// negotiateDigest returns the first digest in a Want-Digest header that we
+// support, along with the matching checksum algorithm. Digests with a weight
+// of 0 are skipped.
+func negotiateDigest(wantDigest string) (string, string) {
+	for _, item := range strings.Split(wantDigest, ",") {
+		fields := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		algorithm, ok := digestAlgorithms[name]
+		if !ok {
+			continue
+		}
+		skip := false
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err != nil || q <= 0 {
+					skip = true
+				}
+			}
+		}
+		if !skip {
+			return name, algorithm
+		}
+	}
+	return "", ""
+}
+
+// parseSingleRange parses a Range header holding exactly one byte range, and
+// returns it as a chunk, clipped to size. false is returned for any other
+// Range header.
+func parseSingleRange(header string, size uint64) (params.Chunk, bool) {
+	const prefix = "bytes="
+	if size == 0 || !strings.HasPrefix(header, prefix) || strings.Contains(header, ",") {
+		return params.Chunk{}, false
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return params.Chunk{}, false
+	}
+	startStr := strings.TrimSpace(spec[:dash])
+	endStr := strings.TrimSpace(spec[dash+1:])
+
+	var start, end uint64
+	if startStr == "" {
+		// A suffix range holds the last N bytes.
+		suffix, err := strconv.ParseUint(endStr, 10, 64)
+		if err != nil || suffix == 0 {
+			return params.Chunk{}, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		start = size - suffix
+		end = size - 1
+	} else {
+		var err error
+		start, err = strconv.ParseUint(startStr, 10, 64)
+		if err != nil || start >= size {
+			return params.Chunk{}, false
+		}
+		end = size - 1
+		if endStr != "" {
+			end, err = strconv.ParseUint(endStr, 10, 64)
+			if err != nil || end < start {
+				return params.Chunk{}, false
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+	}
+	return params.Chunk{
+		Start:  start,
+		Length: end - start + 1,
+	}, true
+}
+
+// encodedETag returns etag with the content encoding added to it. Compressed
+// bodies differ from uncompressed ones, so they need a different strong ETag.
+func encodedETag(etag, encoding string) string {
+	if strings.HasSuffix(etag, `"`) == false {
+		return etag
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// identityETag returns etag without any content encoding added to it by
+// encodedETag.
+func identityETag(etag string) string {
+	for _, encoding := range []string{encodingZstd, encodingGzip} {
+		suffix := "-" + encoding + `"`
+		if strings.HasSuffix(etag, suffix) {
+			return strings.TrimSuffix(etag, suffix) + `"`
+		}
+	}
+	return etag
+}
+
+// compressingResponseWriter compresses the body of 200 OK and 206 Partial
+// Content responses using the given content encoding. Content-Length is
+// dropped, as the size of the compressed body is not known in advance, and
+// the encoding is added to the ETag, if any, as the compressed body differs
+// from the uncompressed one. Content-Range headers are left untouched, and
+// keep referring to the uncompressed bytes. Close must be called after the
+// response was written, to flush the compressor.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+
+	encoding string
+	level    int
+
+	wroteHeader bool
+	compressor  io.WriteCloser
+}
+
+func (c *compressingResponseWriter) WriteHeader(code int) {
+	if c.wroteHeader {
+		return
+	}
+	c.wroteHeader = true
+
+	header := c.Header()
+	header.Add("Vary", "Accept-Encoding")
+	if code == http.StatusOK || code == http.StatusPartialContent {
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", c.encoding)
+		if etag := header.Get("ETag"); etag != "" {
+			header.Set("ETag", encodedETag(etag, c.encoding))
+		}
+		switch c.encoding {
+		case encodingZstd:
+			c.compressor = zstd.NewWriterLevel(c.ResponseWriter, c.level)
+		case encodingGzip:
+			// The level is validated when loading the config.
+			c.compressor, _ = gzip.NewWriterLevel(c.ResponseWriter, c.level)
+		}
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *compressingResponseWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.compressor == nil {
+		return c.ResponseWriter.Write(b)
+	}
+	return c.compressor.Write(b)
+}
+
+// Close flushes any data buffered by the compressor.
+func (c *compressingResponseWriter) Close() error {
+	if c.compressor == nil {
+		return nil
+	}
+	return c.compressor.Close()
+}
@@ -16,8 +16,44 @@
 
 package params
 
+import "time"
+
 // LoginRequest represents username/password request
 type LoginRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 }
+
+// CreateSnapshotRequest holds the optional parameters that can be
+// sent when creating a snapshot.
+type CreateSnapshotRequest struct {
+	// FullCopy allows disks residing on repositories that do not
+	// support reflinks to be snapshotted by creating a full copy
+	// of the disk.
+	FullCopy bool `json:"allow_full_copy"`
+	// TTL is the duration (for example "24h") after which the snapshot
+	// is automatically deleted. Mutually exclusive with ExpiresAt.
+	TTL string `json:"ttl"`
+	// ExpiresAt is the time after which the snapshot is automatically
+	// deleted. Mutually exclusive with TTL.
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Consistency is the consistency mode of the snapshot. Valid values
+	// are "crash" (default), "pause" and "shutdown".
+	Consistency string `json:"consistency"`
+	// Name is an optional human readable name of the snapshot. It does
+	// not need to be unique.
+	Name string `json:"name"`
+	// Description is an optional description of the snapshot.
+	Description string `json:"description"`
+	// Labels are arbitrary key/value pairs attached to the snapshot,
+	// which can be used to filter snapshots when listing them.
+	Labels map[string]string `json:"labels"`
+}
+
+// LeaseRequest holds the parameters used to acquire or renew a lease
+// on a snapshot.
+type LeaseRequest struct {
+	// Duration is how long (for example "2h") the lease is valid for,
+	// starting now.
+	Duration string `json:"duration"`
+}
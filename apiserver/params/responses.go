@@ -16,6 +16,51 @@
 
 package params
 
+import "time"
+
+const (
+	// TaskStatePending is the state of a task that has not started yet.
+	TaskStatePending = "pending"
+	// TaskStateRunning is the state of a task that is in progress.
+	TaskStateRunning = "running"
+	// TaskStateCompleted is the state of a task that finished successfully.
+	TaskStateCompleted = "completed"
+	// TaskStateFailed is the state of a task that finished with an error.
+	TaskStateFailed = "failed"
+
+	// DiskStagePending means the disk was not processed yet.
+	DiskStagePending = "pending"
+	// DiskStageCloning means the disk is being reflinked or copied.
+	DiskStageCloning = "cloning"
+	// DiskStageMapping means the extents of the disk snapshot are
+	// being fetched.
+	DiskStageMapping = "mapping_extents"
+	// DiskStageCompleted means the disk snapshot was created.
+	DiskStageCompleted = "completed"
+
+	// DiffModeExtents compares snapshots using the physical offsets of
+	// their extents. This is fast, as no data needs to be read.
+	DiffModeExtents = "extents"
+	// DiffModeContent compares snapshots by hashing their contents.
+	DiffModeContent = "content"
+
+	// ConsistencyCrash snapshots the disks of a running VM as they are,
+	// which is equivalent to a power loss.
+	ConsistencyCrash = "crash"
+	// ConsistencyPause pauses the VM while its disks are cloned.
+	ConsistencyPause = "pause"
+	// ConsistencyShutdown shuts down the VM before cloning its disks.
+	// The VM is left stopped.
+	ConsistencyShutdown = "shutdown"
+
+	// AllocationMapFiemap means the chunks of a disk snapshot were fetched
+	// using FIEMAP, and hold the physical offsets of the extents.
+	AllocationMapFiemap = "fiemap"
+	// AllocationMapSeek means the chunks of a disk snapshot were fetched
+	// using SEEK_DATA and SEEK_HOLE. Only their logical ranges are known.
+	AllocationMapSeek = "seek"
+)
+
 var (
 	// NotFoundResponse is returned when a resource is not found
 	NotFoundResponse = APIErrorResponse{
@@ -58,6 +103,27 @@ type Chunk struct {
 	// copy of the extent. When comparing differences between two copies
 	// we'll be looking at the physical locations of the extents.
 	Physical uint64 `json:"physical_start"`
+	// Unwritten is true if the extent is allocated, but was never written
+	// to. Unwritten extents read as zeroes, and need not be downloaded.
+	Unwritten bool `json:"unwritten,omitempty"`
+	// Shared is true if the extent is shared with other files, like the
+	// parent disk or other snapshots.
+	Shared bool `json:"shared,omitempty"`
+	// Inline is true if the data is stored along with filesystem metadata.
+	// The physical offset of inline extents is not block aligned.
+	Inline bool `json:"inline,omitempty"`
+	// Delalloc is true if the physical location of the extent was not
+	// yet decided by the filesystem. Physical is not valid.
+	Delalloc bool `json:"delalloc,omitempty"`
+	// Checksum is the hex encoded checksum of the chunk data. It is
+	// only set when checksums are requested.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// SameFlags returns true if c and other have the same extent flags.
+func (c Chunk) SameFlags(other Chunk) bool {
+	return c.Unwritten == other.Unwritten && c.Shared == other.Shared &&
+		c.Inline == other.Inline && c.Delalloc == other.Delalloc
 }
 
 // DiskSnapshot is a point in time snapshot of a disk.
@@ -68,16 +134,54 @@ type DiskSnapshot struct {
 	Chunks     []Chunk `json:"chunks"`
 	Name       string  `json:"name"`
 	Repo       string  `json:"repo_mountpoint"`
+	// FullCopy indicates that this disk snapshot is a full copy of
+	// the parent disk, rather than a reflink. The physical offsets of
+	// the chunks of a full copy can not be used to determine which
+	// extents changed between snapshots.
+	FullCopy bool `json:"full_copy"`
+	// AllocationMap is the method used to find the allocated chunks of the
+	// disk. The physical offsets of chunks are only known when FIEMAP was
+	// used. Disk snapshots recorded before this field was added are reported
+	// as mapped using FIEMAP, unless they are full copies.
+	AllocationMap string `json:"allocation_map"`
+	// ChecksumAlgorithm is the algorithm used to compute the checksums
+	// of the chunks, if they were requested.
+	ChecksumAlgorithm string `json:"checksum_algorithm,omitempty"`
+	// DiffMode is the method used to find the chunks that changed since
+	// another snapshot. Only set when comparing snapshots.
+	DiffMode string `json:"diff_mode,omitempty"`
+	// DiffBytesRead is the number of bytes read from both snapshots to
+	// compare their contents. Only set when contents were compared.
+	DiffBytesRead uint64 `json:"diff_bytes_read,omitempty"`
 }
 
 // VMSnapshot holds information about a single snapshot.
 type VMSnapshot struct {
-	ID   string `json:"id"`
-	VMID string `json:"vm_id"`
+	ID          string            `json:"id"`
+	VMID        string            `json:"vm_id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+	CreatedAt   time.Time         `json:"created_at"`
+	// ExpiresAt is the time after which the snapshot will be
+	// automatically deleted, if set.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Consistency is the consistency mode the snapshot was created with.
+	Consistency string `json:"consistency,omitempty"`
 
 	Disks []DiskSnapshot `json:"disks"`
 }
 
+// Lease protects a snapshot from being deleted until it expires.
+type Lease struct {
+	ID         string    `json:"id"`
+	SnapshotID string    `json:"snapshot_id"`
+	VMID       string    `json:"vm_id"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
 // Disk holds information of a single disk attached to a VM.
 type Disk struct {
 	Name               string `json:"name"`
@@ -98,3 +202,99 @@ type VirtualMachine struct {
 	// from the database
 	Snapshots []string `json:"snapshots"`
 }
+
+// DiskProgress holds the progress of a single disk, within a task.
+type DiskProgress struct {
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+}
+
+// Task holds information about an asynchronous operation.
+type Task struct {
+	ID         string         `json:"id"`
+	VMID       string         `json:"vm_id"`
+	State      string         `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	Disks      []DiskProgress `json:"disks"`
+	SnapshotID string         `json:"snapshot_id"`
+	// Snapshot holds the resulting snapshot, once the task
+	// has completed.
+	Snapshot  *VMSnapshot `json:"snapshot,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// OrphanedPath is a file or folder found in the snapshot folder of a
+// repository, which does not belong to any snapshot in the database.
+type OrphanedPath struct {
+	SnapshotID string `json:"snapshot_id"`
+	Path       string `json:"path"`
+	Removed    bool   `json:"removed"`
+}
+
+// OrphanedSnapshot is a snapshot recorded in the database, for which
+// some disk snapshot files are missing.
+type OrphanedSnapshot struct {
+	SnapshotID   string   `json:"snapshot_id"`
+	VMID         string   `json:"vm_id"`
+	MissingFiles []string `json:"missing_files"`
+	Removed      bool     `json:"removed"`
+}
+
+// ReconcileReport holds the result of comparing the snapshots recorded
+// in the database with the snapshot files present on repositories.
+type ReconcileReport struct {
+	DryRun bool `json:"dry_run"`
+	// OrphanedPaths are files and folders found on repositories that
+	// are not tracked in the database.
+	OrphanedPaths []OrphanedPath `json:"orphaned_paths"`
+	// OrphanedSnapshots are database records that point to missing
+	// disk snapshot files.
+	OrphanedSnapshots []OrphanedSnapshot `json:"orphaned_snapshots"`
+	// Errors holds any errors encountered while removing orphans.
+	Errors []string `json:"errors"`
+}
+
+// SpaceUsage holds the space used on a repository by one or more
+// disk snapshots.
+type SpaceUsage struct {
+	// AllocatedBytes is the number of bytes referenced.
+	AllocatedBytes uint64 `json:"allocated_bytes"`
+	// ExclusiveBytes is the number of bytes that are not referenced by
+	// anything else, and would be freed by deleting the snapshots.
+	ExclusiveBytes uint64 `json:"exclusive_bytes"`
+	// SharedBytes is the number of bytes that are also referenced by the
+	// parent disk, or by other snapshots.
+	SharedBytes uint64 `json:"shared_bytes"`
+	// Exact is false if the physical location of some extents is unknown.
+	// Those extents are counted as shared.
+	Exact bool `json:"exact"`
+}
+
+// DiskSpaceUsage holds the space used by a single disk snapshot.
+type DiskSpaceUsage struct {
+	Name string `json:"name"`
+	Repo string `json:"repo_mountpoint"`
+	SpaceUsage
+}
+
+// SnapshotSpaceUsage holds the space used by a snapshot and its disks.
+type SnapshotSpaceUsage struct {
+	SnapshotID string           `json:"snapshot_id"`
+	VMID       string           `json:"vm_id"`
+	Disks      []DiskSpaceUsage `json:"disks"`
+	SpaceUsage
+}
+
+// RepoSpaceUsage holds the space used by all snapshots on a repository.
+// Bytes are exclusive if they are only referenced by snapshots.
+type RepoSpaceUsage struct {
+	Repo string `json:"repo_mountpoint"`
+	SpaceUsage
+}
+
+// SpaceReport holds the space used by all snapshots.
+type SpaceReport struct {
+	Repositories []RepoSpaceUsage     `json:"repositories"`
+	Snapshots    []SnapshotSpaceUsage `json:"snapshots"`
+}
@@ -25,6 +25,7 @@ import (
 
 	gorillaHandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // NewAPIRouter returns a new gorilla mux router.
@@ -32,6 +33,10 @@ func NewAPIRouter(han *controllers.APIController, authMiddleware auth.Middleware
 	router := mux.NewRouter()
 	log := gorillaHandlers.CombinedLoggingHandler
 
+	// Prometheus metrics. Metrics hold VM IDs and repository paths, so
+	// they require authentication as well.
+	router.Handle("/metrics", authMiddleware.Middleware(promhttp.Handler())).Methods("GET")
+
 	apiSubRouter := router.PathPrefix("/api/v1").Subrouter()
 
 	// Login
@@ -65,12 +70,54 @@ func NewAPIRouter(han *controllers.APIController, authMiddleware auth.Middleware
 	// delete VM snapshot
 	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
 	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/", log(logWriter, http.HandlerFunc(han.DeleteSnapshotHandler))).Methods("DELETE")
+	// acquire lease on VM snapshot
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease", log(logWriter, http.HandlerFunc(han.CreateLeaseHandler))).Methods("POST")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease/", log(logWriter, http.HandlerFunc(han.CreateLeaseHandler))).Methods("POST")
+	// renew lease on VM snapshot
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease/{leaseID}", log(logWriter, http.HandlerFunc(han.RenewLeaseHandler))).Methods("POST")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease/{leaseID}/", log(logWriter, http.HandlerFunc(han.RenewLeaseHandler))).Methods("POST")
+	// release lease on VM snapshot
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease/{leaseID}", log(logWriter, http.HandlerFunc(han.ReleaseLeaseHandler))).Methods("DELETE")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/lease/{leaseID}/", log(logWriter, http.HandlerFunc(han.ReleaseLeaseHandler))).Methods("DELETE")
+	// get VM snapshot space usage
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/space", log(logWriter, http.HandlerFunc(han.SnapshotSpaceHandler))).Methods("GET")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/space/", log(logWriter, http.HandlerFunc(han.SnapshotSpaceHandler))).Methods("GET")
 	// Read snapshotted disk
 	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}", log(logWriter, http.HandlerFunc(han.ConsumeSnapshotHandler))).Methods("GET", "HEAD")
 	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/", log(logWriter, http.HandlerFunc(han.ConsumeSnapshotHandler))).Methods("GET", "HEAD")
+	// Read multiple chunks of snapshotted disk
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}", log(logWriter, http.HandlerFunc(han.ReadChunksHandler))).Methods("POST")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/", log(logWriter, http.HandlerFunc(han.ReadChunksHandler))).Methods("POST")
+	// Delta artifact of snapshotted disk
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/delta", log(logWriter, http.HandlerFunc(han.DeltaHandler))).Methods("GET")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/delta/", log(logWriter, http.HandlerFunc(han.DeltaHandler))).Methods("GET")
+	// Stream allocated chunks of snapshotted disk
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/stream", log(logWriter, http.HandlerFunc(han.StreamSnapshotHandler))).Methods("GET")
+	apiRouter.Handle("/vms/{vmID}/snapshots/{snapshotID}/disks/{diskID}/stream/", log(logWriter, http.HandlerFunc(han.StreamSnapshotHandler))).Methods("GET")
+
+	// get task
+	apiRouter.Handle("/tasks/{taskID}", log(logWriter, http.HandlerFunc(han.GetTaskHandler))).Methods("GET")
+	apiRouter.Handle("/tasks/{taskID}/", log(logWriter, http.HandlerFunc(han.GetTaskHandler))).Methods("GET")
+	// reconcile snapshots
+	apiRouter.Handle("/admin/reconcile", log(logWriter, http.HandlerFunc(han.ReconcileHandler))).Methods("POST")
+	apiRouter.Handle("/admin/reconcile/", log(logWriter, http.HandlerFunc(han.ReconcileHandler))).Methods("POST")
+	// space used by snapshots
+	apiRouter.Handle("/admin/space", log(logWriter, http.HandlerFunc(han.SpaceReportHandler))).Methods("GET")
+	apiRouter.Handle("/admin/space/", log(logWriter, http.HandlerFunc(han.SpaceReportHandler))).Methods("GET")
+	// refresh VM inventory
+	apiRouter.Handle("/admin/inventory/refresh", log(logWriter, http.HandlerFunc(han.RefreshInventoryHandler))).Methods("POST")
+	apiRouter.Handle("/admin/inventory/refresh/", log(logWriter, http.HandlerFunc(han.RefreshInventoryHandler))).Methods("POST")
 
 	// Not found handler
 	apiRouter.PathPrefix("/").Handler(log(logWriter, http.HandlerFunc(han.NotFoundHandler)))
 
 	return router
 }
+
+// NewMetricsRouter returns a router that only serves Prometheus metrics,
+// without authentication.
+func NewMetricsRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	return router
+}
@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -29,6 +30,7 @@ import (
 	"coriolis-ovm-exporter/apiserver/controllers"
 	"coriolis-ovm-exporter/apiserver/routers"
 	"coriolis-ovm-exporter/config"
+	"coriolis-ovm-exporter/metrics"
 	"coriolis-ovm-exporter/util"
 )
 
@@ -45,9 +47,8 @@ func main() {
 		fmt.Println(Version)
 		return
 	}
-	stop := make(chan os.Signal)
-	signal.Notify(stop, syscall.SIGTERM)
-	signal.Notify(stop, syscall.SIGINT)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
 
 	cfg, err := config.ParseConfig(*conf)
 	if err != nil {
@@ -61,6 +62,8 @@ func main() {
 
 	log.SetOutput(logWriter)
 
+	metrics.SetMaxVMLabels(cfg.Metrics.MaxVMLabels)
+
 	controller, err := controllers.NewAPIController(cfg)
 	if err != nil {
 		log.Fatalf("failed to create controller: %q", err)
@@ -83,14 +86,53 @@ func main() {
 		// Pass our instance of gorilla/mux in.
 		Handler: router,
 	}
+	var metricsSrv *http.Server
+	if cfg.Metrics.ListenAddress != "" {
+		metricsSrv = &http.Server{
+			Addr:    cfg.Metrics.ListenAddress,
+			Handler: routers.NewMetricsRouter(),
+		}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	go func() {
 		if err := srv.ListenAndServeTLS(
 			cfg.APIServer.TLSConfig.Cert,
-			cfg.APIServer.TLSConfig.Key); err != nil {
+			cfg.APIServer.TLSConfig.Key); err != nil && err != http.ErrServerClosed {
 
 			log.Fatal(err)
 		}
 	}()
 
 	<-stop
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	log.Printf("shutting down, waiting up to %s for in-flight operations", cfg.APIServer.DrainTimeout)
+
+	// Refuse new snapshot operations, including the ones started by the
+	// retention loop, while requests are drained.
+	controller.StopAccepting()
+
+	// Drain in-flight requests (including disk downloads) first, as they
+	// may read from the database, which is closed when the controller
+	// stops. Snapshot operations keep running meanwhile.
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), cfg.APIServer.DrainTimeout.Duration)
+	defer httpCancel()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		log.Printf("failed to gracefully stop API server: %q", err)
+		srv.Close()
+	}
+
+	// Snapshot operations get their own deadline, so slow downloads do
+	// not cause them to be rolled back.
+	opsCtx, opsCancel := context.WithTimeout(context.Background(), cfg.APIServer.DrainTimeout.Duration)
+	defer opsCancel()
+	if err := controller.Shutdown(opsCtx); err != nil {
+		log.Printf("failed to stop controller: %q", err)
+	}
 }
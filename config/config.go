@@ -46,6 +46,62 @@ const (
 
 	// DefaultManagerPort is the port of the OVM manager node.
 	DefaultManagerPort = 7002
+
+	// DefaultDrainTimeout is the default amount of time we wait for
+	// in-flight requests and snapshot operations to finish, when
+	// shutting down.
+	DefaultDrainTimeout time.Duration = 5 * time.Minute
+
+	// DefaultRetentionInterval is the default interval at which
+	// snapshot retention policies are enforced.
+	DefaultRetentionInterval time.Duration = 5 * time.Minute
+
+	// DefaultXLPath is the default path to the xl toolstack binary.
+	DefaultXLPath = "/usr/sbin/xl"
+
+	// DefaultShutdownTimeout is the default time we wait for a VM to
+	// shut down, when creating a snapshot with the shutdown consistency
+	// mode.
+	DefaultShutdownTimeout time.Duration = 10 * time.Minute
+
+	// DefaultLockTimeout is the default time we wait for a snapshot
+	// that is in use, before giving up.
+	DefaultLockTimeout time.Duration = 30 * time.Second
+
+	// DefaultMaxLeaseDuration is the default maximum duration of a
+	// snapshot lease.
+	DefaultMaxLeaseDuration time.Duration = 24 * time.Hour
+
+	// DefaultContentDiffWorkers is the default number of blocks that
+	// are compared in parallel when comparing snapshot contents.
+	DefaultContentDiffWorkers = 4
+
+	// DefaultZstdLevel is the default zstd compression level used
+	// for disk downloads.
+	DefaultZstdLevel = 5
+
+	// DefaultGzipLevel is the default gzip compression level used
+	// for disk downloads.
+	DefaultGzipLevel = 6
+
+	// DefaultMaxVMLabels is the default maximum number of VMs that
+	// get their own vm_id label value in download metrics.
+	DefaultMaxVMLabels = 1000
+
+	// DefaultMaxRangesPerRequest is the default maximum number of
+	// chunks that can be requested in a single batched read.
+	DefaultMaxRangesPerRequest = 1024
+
+	// DefaultMaxRangeBytesPerRequest is the default maximum number of
+	// bytes that can be requested in a single batched read. Default 1 GB.
+	DefaultMaxRangeBytesPerRequest int64 = 1024 * 1024 * 1024
+
+	// ReconcileReport only reports orphaned snapshots.
+	ReconcileReport = "report"
+	// ReconcileRemove reports and removes orphaned snapshots.
+	ReconcileRemove = "remove"
+	// ReconcileDisabled disables reconciliation.
+	ReconcileDisabled = "disabled"
 )
 
 // ParseConfig parses the file passed in as cfgFile and returns
@@ -60,6 +116,58 @@ func ParseConfig(cfgFile string) (*Config, error) {
 		config.DBFile = DefaultDBFile
 	}
 
+	if config.Snapshots.StartupReconcile == "" {
+		config.Snapshots.StartupReconcile = ReconcileReport
+	}
+
+	if config.Metrics.MaxVMLabels == 0 {
+		config.Metrics.MaxVMLabels = DefaultMaxVMLabels
+	}
+
+	if config.Snapshots.ContentDiffWorkers == 0 {
+		config.Snapshots.ContentDiffWorkers = DefaultContentDiffWorkers
+	}
+
+	if config.Snapshots.RetentionInterval.Duration == 0 {
+		config.Snapshots.RetentionInterval.Duration = DefaultRetentionInterval
+	}
+
+	if config.Snapshots.XLPath == "" {
+		config.Snapshots.XLPath = DefaultXLPath
+	}
+
+	if config.Snapshots.ShutdownTimeout.Duration == 0 {
+		config.Snapshots.ShutdownTimeout.Duration = DefaultShutdownTimeout
+	}
+
+	if config.Snapshots.LockTimeout.Duration == 0 {
+		config.Snapshots.LockTimeout.Duration = DefaultLockTimeout
+	}
+
+	if config.Snapshots.MaxLeaseDuration.Duration == 0 {
+		config.Snapshots.MaxLeaseDuration.Duration = DefaultMaxLeaseDuration
+	}
+
+	if config.APIServer.MaxRangesPerRequest == 0 {
+		config.APIServer.MaxRangesPerRequest = DefaultMaxRangesPerRequest
+	}
+
+	if config.APIServer.MaxRangeBytesPerRequest == 0 {
+		config.APIServer.MaxRangeBytesPerRequest = DefaultMaxRangeBytesPerRequest
+	}
+
+	if config.APIServer.DrainTimeout.Duration == 0 {
+		config.APIServer.DrainTimeout.Duration = DefaultDrainTimeout
+	}
+
+	if config.Compression.ZstdLevel == 0 {
+		config.Compression.ZstdLevel = DefaultZstdLevel
+	}
+
+	if config.Compression.GzipLevel == 0 {
+		config.Compression.GzipLevel = DefaultGzipLevel
+	}
+
 	if config.JWTAuth.TimeToLive.Duration == 0 {
 		config.JWTAuth.TimeToLive.Duration = DefaultJWTTTL
 	}
@@ -94,6 +202,15 @@ type Config struct {
 
 	// LogFile is the location of the log file
 	LogFile string `toml:"log_file"`
+
+	// Snapshots holds snapshot related settings.
+	Snapshots Snapshots `toml:"snapshots"`
+
+	// Compression holds settings for compressed disk downloads.
+	Compression Compression `toml:"compression"`
+
+	// Metrics holds settings for the Prometheus metrics endpoint.
+	Metrics Metrics `toml:"metrics"`
 }
 
 // Validate validates the config options
@@ -114,6 +231,157 @@ func (c *Config) Validate() error {
 		return errors.Wrap(err, "validating jwt section")
 	}
 
+	if err := c.Snapshots.Validate(); err != nil {
+		return errors.Wrap(err, "validating snapshots section")
+	}
+
+	if err := c.Compression.Validate(); err != nil {
+		return errors.Wrap(err, "validating compression section")
+	}
+
+	if err := c.Metrics.Validate(); err != nil {
+		return errors.Wrap(err, "validating metrics section")
+	}
+
+	return nil
+}
+
+// Metrics holds settings for the Prometheus metrics endpoint. The
+// endpoint is always served on the API listener, where it requires
+// authentication.
+type Metrics struct {
+	// ListenAddress is an optional host:port on which metrics are also
+	// served over plain HTTP, without authentication. This is meant for
+	// scrapers that can not authenticate, and should be bound to a
+	// trusted network.
+	ListenAddress string `toml:"listen_address"`
+
+	// MaxVMLabels is the maximum number of VMs that get their own vm_id
+	// label value in download metrics. Bytes served for any other VM
+	// are counted under the "other" label value. Set to -1 to disable
+	// the limit.
+	MaxVMLabels int `toml:"max_vm_labels"`
+}
+
+// Validate validates the metrics config.
+func (m *Metrics) Validate() error {
+	if m.MaxVMLabels < -1 {
+		return fmt.Errorf("invalid max_vm_labels value %d", m.MaxVMLabels)
+	}
+	if m.ListenAddress == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(m.ListenAddress); err != nil {
+		return fmt.Errorf("invalid listen_address value %q", m.ListenAddress)
+	}
+	return nil
+}
+
+// Snapshots holds snapshot related settings.
+type Snapshots struct {
+	// FullCopyRepos is a list of repository IDs on which disks that
+	// can not be reflinked will be snapshotted by creating a full
+	// sparse copy of the disk. This is considerably slower and uses
+	// more space than a reflink.
+	FullCopyRepos []string `toml:"full_copy_repositories"`
+
+	// StartupReconcile controls how snapshots that exist only in the
+	// database, or only on disk, are handled when the exporter starts.
+	// Valid values are "report", "remove" and "disabled".
+	StartupReconcile string `toml:"startup_reconcile"`
+
+	// MaxSnapshotsPerVM is the maximum number of snapshots kept for
+	// each VM. When exceeded, the oldest snapshots are deleted. A value
+	// of 0 disables this policy.
+	MaxSnapshotsPerVM int `toml:"max_snapshots_per_vm"`
+
+	// MaxAge is the maximum age of a snapshot. Older snapshots are
+	// deleted. A value of 0 disables this policy.
+	MaxAge duration `toml:"max_age"`
+
+	// RetentionInterval is the interval at which retention policies
+	// and snapshot expiration are enforced.
+	RetentionInterval duration `toml:"retention_interval"`
+
+	// ContentDiffWorkers is the number of blocks that are compared in
+	// parallel when comparing the contents of two snapshots.
+	ContentDiffWorkers int `toml:"content_diff_workers"`
+
+	// XLPath is the path to the xl toolstack binary, used to pause or
+	// shut down VMs when creating snapshots.
+	XLPath string `toml:"xl_path"`
+
+	// ShutdownTimeout is the maximum time we wait for a VM to shut
+	// down, when creating a snapshot with the shutdown consistency mode.
+	ShutdownTimeout duration `toml:"shutdown_timeout"`
+
+	// LockTimeout is the maximum time we wait for a snapshot or VM
+	// that is in use by another operation. Deleting a snapshot that is
+	// being read fails with a conflict once this timeout expires.
+	LockTimeout duration `toml:"lock_timeout"`
+
+	// MaxLeaseDuration is the maximum duration a snapshot lease can be
+	// acquired or renewed for.
+	MaxLeaseDuration duration `toml:"max_lease_duration"`
+}
+
+// Validate validates the snapshots config.
+func (s *Snapshots) Validate() error {
+	switch s.StartupReconcile {
+	case "", ReconcileReport, ReconcileRemove, ReconcileDisabled:
+	default:
+		return fmt.Errorf("invalid startup_reconcile value %q", s.StartupReconcile)
+	}
+
+	if s.MaxSnapshotsPerVM < 0 {
+		return fmt.Errorf("invalid max_snapshots_per_vm value %d", s.MaxSnapshotsPerVM)
+	}
+
+	if s.MaxAge.Duration < 0 {
+		return fmt.Errorf("invalid max_age value %s", s.MaxAge)
+	}
+
+	if s.ContentDiffWorkers < 0 {
+		return fmt.Errorf("invalid content_diff_workers value %d", s.ContentDiffWorkers)
+	}
+
+	if s.ShutdownTimeout.Duration < 0 {
+		return fmt.Errorf("invalid shutdown_timeout value %s", s.ShutdownTimeout)
+	}
+
+	if s.LockTimeout.Duration < 0 {
+		return fmt.Errorf("invalid lock_timeout value %s", s.LockTimeout)
+	}
+
+	if s.MaxLeaseDuration.Duration < 0 {
+		return fmt.Errorf("invalid max_lease_duration value %s", s.MaxLeaseDuration)
+	}
+	return nil
+}
+
+// Compression holds settings for compressed disk downloads. When enabled,
+// downloads are compressed if the client sends an Accept-Encoding header
+// that includes zstd or gzip.
+type Compression struct {
+	// Enabled enables compression of disk downloads. Compression is off
+	// by default, as it is CPU intensive, and prevents the kernel from
+	// sending disk data directly from the page cache.
+	Enabled bool `toml:"enabled"`
+	// ZstdLevel is the zstd compression level, between 1 and 20.
+	ZstdLevel int `toml:"zstd_level"`
+	// GzipLevel is the gzip compression level, between 1 and 9.
+	GzipLevel int `toml:"gzip_level"`
+}
+
+// Validate validates the compression config.
+func (c *Compression) Validate() error {
+	if c.ZstdLevel < 1 || c.ZstdLevel > 20 {
+		return fmt.Errorf("invalid zstd_level value %d", c.ZstdLevel)
+	}
+
+	if c.GzipLevel < 1 || c.GzipLevel > 9 {
+		return fmt.Errorf("invalid gzip_level value %d", c.GzipLevel)
+	}
 	return nil
 }
 
@@ -125,7 +393,7 @@ func (d *duration) UnmarshalText(text []byte) error {
 	var err error
 	d.Duration, err = time.ParseDuration(string(text))
 	if err != nil {
-		return errors.Wrap(err, "parsing time_to_live")
+		return errors.Wrap(err, "parsing duration")
 	}
 	return nil
 }
@@ -150,6 +418,16 @@ type APIServer struct {
 	Bind      string    `toml:"bind"`
 	Port      int       `toml:"port"`
 	TLSConfig TLSConfig `toml:"tls"`
+	// DrainTimeout is the amount of time we wait for in-flight
+	// requests to finish when shutting down, and then for running
+	// snapshot operations to finish.
+	DrainTimeout duration `toml:"drain_timeout"`
+	// MaxRangesPerRequest is the maximum number of chunks that can be
+	// requested in a single batched read.
+	MaxRangesPerRequest int `toml:"max_ranges_per_request"`
+	// MaxRangeBytesPerRequest is the maximum total number of bytes that
+	// can be requested in a single batched read.
+	MaxRangeBytesPerRequest int64 `toml:"max_range_bytes_per_request"`
 }
 
 // BindAddress returns a host:port string.
@@ -170,6 +448,15 @@ func (a *APIServer) Validate() error {
 		// when we try to bind to it.
 		return fmt.Errorf("invalid IP address")
 	}
+	if a.DrainTimeout.Duration < 0 {
+		return fmt.Errorf("invalid drain_timeout value %s", a.DrainTimeout)
+	}
+	if a.MaxRangesPerRequest < 0 {
+		return fmt.Errorf("invalid max_ranges_per_request value %d", a.MaxRangesPerRequest)
+	}
+	if a.MaxRangeBytesPerRequest < 0 {
+		return fmt.Errorf("invalid max_range_bytes_per_request value %d", a.MaxRangeBytesPerRequest)
+	}
 	if err := a.TLSConfig.Validate(); err != nil {
 		return errors.Wrap(err, "validating TLS config")
 	}
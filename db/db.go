@@ -18,6 +18,7 @@ package db
 
 import (
 	"coriolis-ovm-exporter/apiserver/params"
+	"fmt"
 	"time"
 
 	"github.com/asdine/storm"
@@ -60,14 +61,18 @@ func (d *Database) DBConnection() *storm.DB {
 	return d.con
 }
 
-// CreateSnapshot creates a new snapshot object in the database.
-func (d *Database) CreateSnapshot(snapID, vmID string, disks []params.DiskSnapshot) (Snapshot, error) {
-	snap := Snapshot{
-		ID:        snapID,
-		VMID:      vmID,
-		Disks:     disks,
-		CreatedAt: time.Now().UTC(),
+// Close closes the database.
+func (d *Database) Close() error {
+	if err := d.con.Close(); err != nil {
+		return errors.Wrap(err, "closing database")
 	}
+	return nil
+}
+
+// CreateSnapshot creates a new snapshot object in the database.
+// The creation time of the snapshot is set to the current time.
+func (d *Database) CreateSnapshot(snap Snapshot) (Snapshot, error) {
+	snap.CreatedAt = time.Now().UTC()
 	if err := d.con.Save(&snap); err != nil {
 		return Snapshot{}, errors.Wrap(err, "adding sync folder")
 	}
@@ -89,6 +94,16 @@ func (d *Database) DeleteSnapshot(snapID string) error {
 		return errors.Wrap(err, "deleting snapshot")
 	}
 
+	err := d.con.Select(q.Eq("SnapshotID", snapID)).Delete(&ChunkChecksum{})
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "deleting chunk checksums")
+	}
+
+	err = d.con.Select(q.Eq("SnapshotID", snapID)).Delete(&Lease{})
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "deleting leases")
+	}
+
 	return nil
 }
 
@@ -113,6 +128,19 @@ func (d *Database) ListSnapshots(vmID string) ([]Snapshot, error) {
 	return snaps, nil
 }
 
+// ListAllSnapshots lists all snapshots of all VMs.
+func (d *Database) ListAllSnapshots() ([]Snapshot, error) {
+	var snaps []Snapshot
+	if err := d.con.All(&snaps); err != nil {
+		if err == storm.ErrNotFound {
+			return snaps, nil
+		}
+		return snaps, errors.Wrap(err, "fetching snapshots")
+	}
+
+	return snaps, nil
+}
+
 // GetSnapshot gets one snapshot by ID.
 func (d *Database) GetSnapshot(snapID string) (Snapshot, error) {
 	var snap Snapshot
@@ -122,3 +150,277 @@ func (d *Database) GetSnapshot(snapID string) (Snapshot, error) {
 
 	return snap, nil
 }
+
+// CreateTask creates a new task object in the database.
+func (d *Database) CreateTask(taskID, vmID, snapID string, disks []params.DiskProgress) (Task, error) {
+	now := time.Now().UTC()
+	task := Task{
+		ID:         taskID,
+		VMID:       vmID,
+		State:      params.TaskStatePending,
+		SnapshotID: snapID,
+		Disks:      disks,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := d.con.Save(&task); err != nil {
+		return Task{}, errors.Wrap(err, "adding task")
+	}
+
+	return task, nil
+}
+
+// UpdateTask saves the supplied task object to the database.
+func (d *Database) UpdateTask(task Task) (Task, error) {
+	task.UpdatedAt = time.Now().UTC()
+	if err := d.con.Save(&task); err != nil {
+		return Task{}, errors.Wrap(err, "updating task")
+	}
+
+	return task, nil
+}
+
+// GetTask gets one task by ID.
+func (d *Database) GetTask(taskID string) (Task, error) {
+	var task Task
+	if err := d.con.One("ID", taskID, &task); err != nil {
+		return Task{}, errors.Wrap(err, "fetching task")
+	}
+
+	return task, nil
+}
+
+// ListTasksByState lists all tasks in any of the supplied states.
+func (d *Database) ListTasksByState(states ...string) ([]Task, error) {
+	matchers := make([]q.Matcher, len(states))
+	for idx, state := range states {
+		matchers[idx] = q.Eq("State", state)
+	}
+
+	var tasks []Task
+	if err := d.con.Select(q.Or(matchers...)).Find(&tasks); err != nil {
+		if err == storm.ErrNotFound {
+			return tasks, nil
+		}
+		return tasks, errors.Wrap(err, "fetching tasks")
+	}
+
+	return tasks, nil
+}
+
+func chunkChecksumID(snapID, disk, algorithm string, start, length uint64) string {
+	return fmt.Sprintf("%s/%s/%s/%d:%d", snapID, disk, algorithm, start, length)
+}
+
+// GetChunkChecksum fetches the cached checksum of a range of a snapshotted
+// disk. If it was not cached yet, an empty string is returned.
+func (d *Database) GetChunkChecksum(snapID, disk, algorithm string, start, length uint64) (string, error) {
+	var checksum ChunkChecksum
+	id := chunkChecksumID(snapID, disk, algorithm, start, length)
+	if err := d.con.One("ID", id, &checksum); err != nil {
+		if err != storm.ErrNotFound {
+			return "", errors.Wrap(err, "fetching chunk checksum")
+		}
+		return "", nil
+	}
+	return checksum.Checksum, nil
+}
+
+// SaveChunkChecksums saves the checksums of ranges of snapshotted disks, in a
+// single transaction.
+func (d *Database) SaveChunkChecksums(checksums []ChunkChecksum) error {
+	tx, err := d.con.Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	for _, checksum := range checksums {
+		checksum.ID = chunkChecksumID(
+			checksum.SnapshotID, checksum.Disk, checksum.Algorithm, checksum.Start, checksum.Length)
+		if err := tx.Save(&checksum); err != nil {
+			return errors.Wrap(err, "saving chunk checksum")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+	return nil
+}
+
+// CreateJournal creates a new snapshot journal, in the pending state.
+func (d *Database) CreateJournal(snap Snapshot) (SnapshotJournal, error) {
+	now := time.Now().UTC()
+	journal := SnapshotJournal{
+		ID:        snap.ID,
+		State:     JournalPending,
+		Snapshot:  snap,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := d.con.Save(&journal); err != nil {
+		return SnapshotJournal{}, errors.Wrap(err, "adding snapshot journal")
+	}
+
+	return journal, nil
+}
+
+// UpdateJournal saves the supplied snapshot journal to the database.
+func (d *Database) UpdateJournal(journal SnapshotJournal) (SnapshotJournal, error) {
+	journal.UpdatedAt = time.Now().UTC()
+	if err := d.con.Save(&journal); err != nil {
+		return SnapshotJournal{}, errors.Wrap(err, "updating snapshot journal")
+	}
+
+	return journal, nil
+}
+
+// CommitJournal saves the snapshot held by the journal, and marks the
+// journal as committed, in a single transaction. The creation time of
+// the snapshot is set to the current time, if not already set.
+func (d *Database) CommitJournal(journal SnapshotJournal) (Snapshot, error) {
+	tx, err := d.con.Begin(true)
+	if err != nil {
+		return Snapshot{}, errors.Wrap(err, "starting transaction")
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	snap := journal.Snapshot
+	if snap.CreatedAt.IsZero() {
+		snap.CreatedAt = now
+	}
+	if err := tx.Save(&snap); err != nil {
+		return Snapshot{}, errors.Wrap(err, "adding snapshot")
+	}
+
+	journal.Snapshot = snap
+	journal.State = JournalCommitted
+	journal.UpdatedAt = now
+	if err := tx.Save(&journal); err != nil {
+		return Snapshot{}, errors.Wrap(err, "updating snapshot journal")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Snapshot{}, errors.Wrap(err, "committing transaction")
+	}
+	return snap, nil
+}
+
+// DeleteJournal removes a snapshot journal from the database.
+func (d *Database) DeleteJournal(snapID string) error {
+	var journal SnapshotJournal
+	if err := d.con.One("ID", snapID, &journal); err != nil {
+		if err != storm.ErrNotFound {
+			return errors.Wrap(err, "fetching snapshot journal")
+		}
+		return nil
+	}
+
+	if err := d.con.DeleteStruct(&journal); err != nil {
+		return errors.Wrap(err, "deleting snapshot journal")
+	}
+	return nil
+}
+
+// ListJournals lists all snapshot journals.
+func (d *Database) ListJournals() ([]SnapshotJournal, error) {
+	var journals []SnapshotJournal
+	if err := d.con.All(&journals); err != nil {
+		if err == storm.ErrNotFound {
+			return journals, nil
+		}
+		return journals, errors.Wrap(err, "fetching snapshot journals")
+	}
+
+	return journals, nil
+}
+
+// CreateLease creates a new lease on a snapshot, which expires at expiresAt.
+func (d *Database) CreateLease(leaseID, vmID, snapID string, expiresAt time.Time) (Lease, error) {
+	now := time.Now().UTC()
+	lease := Lease{
+		ID:         leaseID,
+		SnapshotID: snapID,
+		VMID:       vmID,
+		ExpiresAt:  expiresAt,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if err := d.con.Save(&lease); err != nil {
+		return Lease{}, errors.Wrap(err, "adding lease")
+	}
+
+	return lease, nil
+}
+
+// UpdateLease saves the supplied lease to the database.
+func (d *Database) UpdateLease(lease Lease) (Lease, error) {
+	lease.UpdatedAt = time.Now().UTC()
+	if err := d.con.Save(&lease); err != nil {
+		return Lease{}, errors.Wrap(err, "updating lease")
+	}
+
+	return lease, nil
+}
+
+// GetLease gets one lease by ID.
+func (d *Database) GetLease(leaseID string) (Lease, error) {
+	var lease Lease
+	if err := d.con.One("ID", leaseID, &lease); err != nil {
+		return Lease{}, errors.Wrap(err, "fetching lease")
+	}
+
+	return lease, nil
+}
+
+// DeleteLease removes a lease from the database.
+func (d *Database) DeleteLease(leaseID string) error {
+	var lease Lease
+	if err := d.con.One("ID", leaseID, &lease); err != nil {
+		if err != storm.ErrNotFound {
+			return errors.Wrap(err, "fetching lease")
+		}
+		return nil
+	}
+
+	if err := d.con.DeleteStruct(&lease); err != nil {
+		return errors.Wrap(err, "deleting lease")
+	}
+	return nil
+}
+
+// ListSnapshotLeases lists all leases of a snapshot, including expired ones.
+func (d *Database) ListSnapshotLeases(snapID string) ([]Lease, error) {
+	var leases []Lease
+	if err := d.con.Find("SnapshotID", snapID, &leases); err != nil {
+		if err == storm.ErrNotFound {
+			return leases, nil
+		}
+		return leases, errors.Wrap(err, "fetching leases")
+	}
+
+	return leases, nil
+}
+
+// DeleteExpiredLeases removes all leases that expired before now.
+func (d *Database) DeleteExpiredLeases(now time.Time) error {
+	var leases []Lease
+	if err := d.con.All(&leases); err != nil {
+		if err == storm.ErrNotFound {
+			return nil
+		}
+		return errors.Wrap(err, "fetching leases")
+	}
+
+	for _, lease := range leases {
+		if lease.Active(now) {
+			continue
+		}
+		if err := d.con.DeleteStruct(&lease); err != nil {
+			return errors.Wrap(err, "deleting lease")
+		}
+	}
+	return nil
+}
@@ -26,5 +26,80 @@ type Snapshot struct {
 	ID        string `storm:"id,unique,index"`
 	VMID      string `storm:"index"`
 	CreatedAt time.Time
-	Disks     []params.DiskSnapshot
+	// ExpiresAt is the time after which the snapshot is automatically
+	// deleted. A zero value means the snapshot never expires.
+	ExpiresAt time.Time
+	// Consistency is the consistency mode the snapshot was created with.
+	Consistency string
+	Name        string
+	Description string
+	Labels      map[string]string
+	Disks       []params.DiskSnapshot
+}
+
+const (
+	// JournalPending means the disks of the snapshot are being created.
+	JournalPending = "pending"
+	// JournalDisksCreated means all disks of the snapshot were created,
+	// but the snapshot was not saved yet.
+	JournalDisksCreated = "disks_created"
+	// JournalCommitted means the snapshot was saved.
+	JournalCommitted = "committed"
+	// JournalRollingBack means the disks of the snapshot are being
+	// removed, after a failure.
+	JournalRollingBack = "rolling_back"
+)
+
+// SnapshotJournal is a write-ahead record of a snapshot being created. It
+// is used to complete or roll back snapshots interrupted by a crash.
+type SnapshotJournal struct {
+	// ID is the ID of the snapshot.
+	ID    string `storm:"id,unique,index"`
+	State string `storm:"index"`
+	// Snapshot is the snapshot record that is saved on commit. Before
+	// the disks are created, its disks only hold their paths.
+	Snapshot  Snapshot
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Task holds information about an asynchronous snapshot operation.
+type Task struct {
+	ID         string `storm:"id,unique,index"`
+	VMID       string `storm:"index"`
+	State      string `storm:"index"`
+	SnapshotID string
+	Error      string
+	Disks      []params.DiskProgress
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Lease protects a snapshot from being deleted until it expires.
+type Lease struct {
+	ID         string `storm:"id,unique,index"`
+	SnapshotID string `storm:"index"`
+	VMID       string
+	ExpiresAt  time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// Active returns true if the lease has not expired at the given time.
+func (l Lease) Active(now time.Time) bool {
+	return l.ExpiresAt.After(now)
+}
+
+// ChunkChecksum caches the checksum of a range of a snapshotted disk,
+// computed with one algorithm.
+type ChunkChecksum struct {
+	// ID is made up of the snapshot ID, disk name, algorithm and range.
+	ID         string `storm:"id,unique,index"`
+	SnapshotID string `storm:"index"`
+	Disk       string
+	Algorithm  string
+	Start      uint64
+	Length     uint64
+	// Checksum is the hex encoded checksum of the range.
+	Checksum string
 }
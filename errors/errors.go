@@ -191,3 +191,18 @@ func NewConflictError(msg string, a ...interface{}) error {
 type ConflictError struct {
 	baseError
 }
+
+// NewUnavailableError returns a new UnavailableError
+func NewUnavailableError(msg string, a ...interface{}) error {
+	return &UnavailableError{
+		baseError{
+			msg: fmt.Sprintf(msg, a...),
+		},
+	}
+}
+
+// UnavailableError is returned when the service can not handle
+// a request, for example while shutting down
+type UnavailableError struct {
+	baseError
+}
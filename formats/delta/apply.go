@@ -0,0 +1,137 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// File is the destination of Apply. *os.File implements it.
+type File interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// offsetWriter writes to an io.WriterAt, starting at offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (z zeroReader) Read(p []byte) (int, error) {
+	for idx := range p {
+		p[idx] = 0
+	}
+	return len(p), nil
+}
+
+// readChunks reads the data of all chunks in hdr from r, checking their
+// checksums. The data of each chunk is written to the writer returned by
+// dst, which may be nil. Zeros are written for zero chunks.
+func readChunks(r io.Reader, hdr Header, dst func(chunk Chunk) io.Writer) error {
+	buf := make([]byte, copyBufferSize)
+	sum := make([]byte, sha256.Size)
+	for _, chunk := range hdr.Chunks {
+		if chunk.Zero {
+			if dst == nil {
+				continue
+			}
+			if _, err := io.CopyBuffer(dst(chunk), io.LimitReader(zeroReader{}, int64(chunk.Length)), buf); err != nil {
+				return errors.Wrapf(err, "writing zeros at offset %d", chunk.Start)
+			}
+			continue
+		}
+
+		hash := sha256.New()
+		var w io.Writer = hash
+		if dst != nil {
+			w = io.MultiWriter(dst(chunk), hash)
+		}
+
+		if _, err := io.CopyBuffer(w, io.LimitReader(r, int64(chunk.Length)), buf); err != nil {
+			return errors.Wrapf(err, "reading chunk at offset %d", chunk.Start)
+		}
+		// A truncated delta is caught when reading the checksum, or
+		// by the checksum itself.
+		if _, err := io.ReadFull(r, sum); err != nil {
+			return errors.Wrapf(err, "reading checksum of chunk at offset %d", chunk.Start)
+		}
+		if bytes.Equal(hash.Sum(nil), sum) == false {
+			return fmt.Errorf("checksum mismatch for chunk at offset %d", chunk.Start)
+		}
+	}
+
+	// Anything past the last chunk means the delta is corrupt.
+	if n, _ := io.CopyN(ioutil.Discard, r, 1); n != 0 {
+		return fmt.Errorf("unexpected data after the last chunk")
+	}
+	return nil
+}
+
+// Verify reads a delta from r and checks the checksums of all chunks,
+// without writing them anywhere. It returns the header of the delta.
+func Verify(r io.Reader) (Header, error) {
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		return Header{}, err
+	}
+	if err := readChunks(r, hdr, nil); err != nil {
+		return Header{}, err
+	}
+	return hdr, nil
+}
+
+// Apply reads a delta from r and writes its chunks onto dst, which should
+// be a raw image of the base snapshot of the delta, or an empty file if the
+// delta has no base snapshot. The size of dst is set to the disk size in the
+// delta. Checksums are verified as chunks are written. If a checksum does
+// not match, an error is returned and dst is left partially updated, so
+// deltas should be checked with Verify first when dst can not be recreated.
+// It returns the header of the delta.
+func Apply(r io.Reader, dst File) (Header, error) {
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		return Header{}, err
+	}
+
+	err = readChunks(r, hdr, func(chunk Chunk) io.Writer {
+		return &offsetWriter{w: dst, offset: int64(chunk.Start)}
+	})
+	if err != nil {
+		return Header{}, err
+	}
+
+	if err := dst.Truncate(int64(hdr.DiskSize)); err != nil {
+		return Header{}, errors.Wrap(err, "setting disk size")
+	}
+	return hdr, nil
+}
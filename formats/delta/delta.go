@@ -0,0 +1,227 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package delta implements a self describing file format holding the
+// chunks of a disk that changed between two snapshots.
+//
+// A delta starts with a magic value, the format version and the length of
+// a JSON encoded Header. The header is followed by the data of every chunk
+// listed in the header, in the same order, with no padding. The data of each
+// chunk is followed by its binary SHA-256 checksum, so a delta can be written
+// while the disk is read, in a single pass. Zero chunks have no data and no
+// checksum, and must read as zeros once the delta is applied. All integers
+// are big endian. A delta without a base snapshot holds all allocated
+// chunks of a disk, and can be applied onto an empty file.
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+const (
+	// Magic is the value every delta starts with.
+	Magic = "COVMDLTA"
+	// Version is the version of the delta format.
+	Version uint32 = 1
+
+	// maxHeaderSize is the maximum size of the JSON header we accept.
+	maxHeaderSize = 256 * 1024 * 1024
+
+	copyBufferSize = 1024 * 1024
+)
+
+// Chunk is a range of the disk held by a delta.
+type Chunk struct {
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+	// Zero is true if the chunk has no data in the delta, and must be
+	// set to zeros.
+	Zero bool `json:"zero,omitempty"`
+}
+
+// Header describes the contents of a delta.
+type Header struct {
+	VMID       string `json:"vm_id"`
+	SnapshotID string `json:"snapshot_id"`
+	// BaseSnapshotID is the snapshot this delta must be applied on.
+	// An empty value means the delta holds all allocated chunks.
+	BaseSnapshotID string `json:"base_snapshot_id"`
+	DiskName       string `json:"disk_name"`
+	DiskSize       uint64 `json:"disk_size"`
+	// SnapshotCreatedAt is the time the snapshot was taken. It can be
+	// used to order deltas in a chain.
+	SnapshotCreatedAt time.Time `json:"snapshot_created_at"`
+	Chunks            []Chunk   `json:"chunks"`
+}
+
+// DataSize returns the size of the data that follows the header, including
+// chunk checksums.
+func (h Header) DataSize() uint64 {
+	var ret uint64
+	for _, chunk := range h.Chunks {
+		if chunk.Zero {
+			continue
+		}
+		ret += chunk.Length + sha256.Size
+	}
+	return ret
+}
+
+// preamble precedes the JSON header.
+type preamble struct {
+	Magic        [8]byte
+	Version      uint32
+	HeaderLength uint32
+}
+
+func encodeHeader(hdr Header) ([]byte, error) {
+	encoded, err := json.Marshal(hdr)
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding header")
+	}
+	if len(encoded) > maxHeaderSize {
+		return nil, fmt.Errorf("header too large")
+	}
+	return encoded, nil
+}
+
+// Size returns the total size of the delta described by hdr.
+func Size(hdr Header) (uint64, error) {
+	encoded, err := encodeHeader(hdr)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(binary.Size(preamble{})) + uint64(len(encoded)) + hdr.DataSize(), nil
+}
+
+// Chunks returns the list of chunks that should be included in a delta of a
+// disk of size diskSize. Chunks are clipped to diskSize, as extents may extend
+// past the end of a file. Unwritten chunks are returned as zero chunks, unless
+// skipUnwritten is true.
+func Chunks(diskSize uint64, chunks []params.Chunk, skipUnwritten bool) []Chunk {
+	ret := []Chunk{}
+	for _, chunk := range chunks {
+		if chunk.Start >= diskSize || chunk.Length == 0 {
+			continue
+		}
+		length := chunk.Length
+		if chunk.Start+length > diskSize {
+			length = diskSize - chunk.Start
+		}
+
+		if chunk.Unwritten {
+			if skipUnwritten == false {
+				ret = append(ret, Chunk{
+					Start:  chunk.Start,
+					Length: length,
+					Zero:   true,
+				})
+			}
+			continue
+		}
+		ret = append(ret, Chunk{
+			Start:  chunk.Start,
+			Length: length,
+		})
+	}
+	return ret
+}
+
+// Write writes a delta described by hdr to w, reading chunk data from src.
+// The checksum of each chunk is computed as it is read, and written after
+// the chunk data.
+func Write(w io.Writer, hdr Header, src io.ReaderAt) error {
+	encoded, err := encodeHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	pre := preamble{
+		Version:      Version,
+		HeaderLength: uint32(len(encoded)),
+	}
+	copy(pre.Magic[:], Magic)
+	if err := binary.Write(w, binary.BigEndian, pre); err != nil {
+		return errors.Wrap(err, "writing preamble")
+	}
+	if _, err := w.Write(encoded); err != nil {
+		return errors.Wrap(err, "writing header")
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for _, chunk := range hdr.Chunks {
+		if chunk.Zero {
+			continue
+		}
+		hash := sha256.New()
+		section := io.NewSectionReader(src, int64(chunk.Start), int64(chunk.Length))
+		n, err := io.CopyBuffer(io.MultiWriter(w, hash), section, buf)
+		if err != nil {
+			return errors.Wrapf(err, "writing chunk at offset %d", chunk.Start)
+		}
+		if uint64(n) != chunk.Length {
+			return fmt.Errorf("short read for chunk at offset %d", chunk.Start)
+		}
+		if _, err := w.Write(hash.Sum(nil)); err != nil {
+			return errors.Wrapf(err, "writing checksum of chunk at offset %d", chunk.Start)
+		}
+	}
+	return nil
+}
+
+// ReadHeader reads and validates the header of a delta from r. After it
+// returns, r is positioned at the start of the chunk data.
+func ReadHeader(r io.Reader) (Header, error) {
+	var pre preamble
+	if err := binary.Read(r, binary.BigEndian, &pre); err != nil {
+		return Header{}, errors.Wrap(err, "reading preamble")
+	}
+	if string(pre.Magic[:]) != Magic {
+		return Header{}, fmt.Errorf("invalid delta magic")
+	}
+	if pre.Version != Version {
+		return Header{}, fmt.Errorf("unsupported delta version %d", pre.Version)
+	}
+	if pre.HeaderLength > maxHeaderSize {
+		return Header{}, fmt.Errorf("header too large")
+	}
+
+	encoded := make([]byte, pre.HeaderLength)
+	if _, err := io.ReadFull(r, encoded); err != nil {
+		return Header{}, errors.Wrap(err, "reading header")
+	}
+
+	var hdr Header
+	if err := json.Unmarshal(encoded, &hdr); err != nil {
+		return Header{}, errors.Wrap(err, "decoding header")
+	}
+	for _, chunk := range hdr.Chunks {
+		if chunk.Start+chunk.Length > hdr.DiskSize || chunk.Start+chunk.Length < chunk.Start {
+			return Header{}, fmt.Errorf(
+				"chunk at offset %d with length %d exceeds disk size", chunk.Start, chunk.Length)
+		}
+	}
+	return hdr, nil
+}
@@ -0,0 +1,230 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/formats/internal/testutil"
+)
+
+func TestChunks(t *testing.T) {
+	chunks := []params.Chunk{
+		{Start: 0, Length: 4096},
+		{Start: 4096, Length: 0},
+		{Start: 8192, Length: 4096, Unwritten: true},
+		{Start: 16384, Length: 8192},
+		{Start: 32768, Length: 4096},
+	}
+	tests := []struct {
+		name          string
+		skipUnwritten bool
+		want          []Chunk
+	}{
+		{
+			name: "zero chunks",
+			want: []Chunk{
+				{Start: 0, Length: 4096},
+				{Start: 8192, Length: 4096, Zero: true},
+				{Start: 16384, Length: 4096},
+			},
+		},
+		{
+			name:          "skip unwritten",
+			skipUnwritten: true,
+			want: []Chunk{
+				{Start: 0, Length: 4096},
+				{Start: 16384, Length: 4096},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Chunks(20480, chunks, tt.skipUnwritten)
+			if reflect.DeepEqual(got, tt.want) == false {
+				t.Fatalf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+// newDelta returns a delta of a 64 KB disk, along with its header, the
+// base the delta applies onto, and the disk it produces.
+func newDelta(t *testing.T) ([]byte, Header, []byte, []byte) {
+	const diskSize = 65536
+	disk := make([]byte, diskSize)
+	copy(disk[4096:], testutil.Pattern(1, 8192))
+	copy(disk[diskSize-1000:], testutil.Pattern(2, 1000))
+
+	chunks := []params.Chunk{
+		{Start: 4096, Length: 8192},
+		{Start: 16384, Length: 4096, Unwritten: true},
+		// Extents may extend past the end of the disk.
+		{Start: diskSize - 4096, Length: 8192},
+	}
+	hdr := Header{
+		VMID:              "vm",
+		SnapshotID:        "snap2",
+		BaseSnapshotID:    "snap1",
+		DiskName:          "disk.img",
+		DiskSize:          diskSize,
+		SnapshotCreatedAt: time.Date(2021, 3, 4, 10, 21, 40, 0, time.UTC),
+		Chunks:            Chunks(diskSize, chunks, false),
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, hdr, bytes.NewReader(disk)); err != nil {
+		t.Fatal(err)
+	}
+	size, err := Size(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(buf.Len()) != size {
+		t.Fatalf("expected a delta of %d bytes, got %d", size, buf.Len())
+	}
+
+	// The base is larger than the disk, and holds data everywhere, so
+	// we can check that zero chunks are written, and that the result
+	// is truncated.
+	base := testutil.Pattern(3, diskSize+4096)
+	want := append([]byte{}, base[:diskSize]...)
+	copy(want[4096:], disk[4096:4096+8192])
+	copy(want[16384:], make([]byte, 4096))
+	copy(want[diskSize-4096:], disk[diskSize-4096:])
+	return buf.Bytes(), hdr, base, want
+}
+
+func TestRoundTrip(t *testing.T) {
+	data, hdr, base, want := newDelta(t)
+
+	got, err := Verify(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(got, hdr) == false {
+		t.Fatalf("expected header %+v, got %+v", hdr, got)
+	}
+
+	dst := &testutil.MemFile{Data: base}
+	got, err = Apply(bytes.NewReader(data), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.DeepEqual(got, hdr) == false {
+		t.Fatalf("expected header %+v, got %+v", hdr, got)
+	}
+	if bytes.Equal(dst.Data, want) == false {
+		t.Fatal("applied delta does not match the disk")
+	}
+}
+
+func TestCorruptDelta(t *testing.T) {
+	_, hdr, _, _ := newDelta(t)
+	encoded, err := encodeHeader(hdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offset of the data of the first chunk.
+	dataStart := binary.Size(preamble{}) + len(encoded)
+	checksumStart := dataStart + int(hdr.Chunks[0].Length)
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		wantErr string
+	}{
+		{
+			name: "corrupted data",
+			corrupt: func(data []byte) []byte {
+				data[dataStart+100] ^= 0xff
+				return data
+			},
+			wantErr: "checksum mismatch for chunk at offset 4096",
+		},
+		{
+			name: "corrupted checksum",
+			corrupt: func(data []byte) []byte {
+				data[checksumStart] ^= 0xff
+				return data
+			},
+			wantErr: "checksum mismatch for chunk at offset 4096",
+		},
+		{
+			name: "truncated",
+			corrupt: func(data []byte) []byte {
+				return data[:len(data)-10]
+			},
+			wantErr: "reading checksum of chunk",
+		},
+		{
+			name: "trailing data",
+			corrupt: func(data []byte) []byte {
+				return append(data, 0)
+			},
+			wantErr: "unexpected data after the last chunk",
+		},
+		{
+			name: "invalid magic",
+			corrupt: func(data []byte) []byte {
+				data[0] = 'X'
+				return data
+			},
+			wantErr: "invalid delta magic",
+		},
+		{
+			name: "unsupported version",
+			corrupt: func(data []byte) []byte {
+				binary.BigEndian.PutUint32(data[8:], Version+1)
+				return data
+			},
+			wantErr: "unsupported delta version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _, base, _ := newDelta(t)
+			data = tt.corrupt(data)
+
+			if _, err := Verify(bytes.NewReader(data)); err == nil || strings.Contains(err.Error(), tt.wantErr) == false {
+				t.Fatalf("expected verify error %q, got %v", tt.wantErr, err)
+			}
+			if _, err := Apply(bytes.NewReader(data), &testutil.MemFile{Data: base}); err == nil || strings.Contains(err.Error(), tt.wantErr) == false {
+				t.Fatalf("expected apply error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWriteShortRead(t *testing.T) {
+	hdr := Header{
+		DiskSize: 8192,
+		Chunks:   []Chunk{{Start: 0, Length: 8192}},
+	}
+	var buf bytes.Buffer
+	err := Write(&buf, hdr, bytes.NewReader(make([]byte, 4096)))
+	if err == nil || strings.Contains(err.Error(), "short read") == false {
+		t.Fatalf("expected a short read error, got %v", err)
+	}
+}
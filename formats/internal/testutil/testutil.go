@@ -0,0 +1,102 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+// Package testutil holds helpers shared by the tests of the disk formats.
+package testutil
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Write is data written to a disk at an offset.
+type Write struct {
+	Off  uint64
+	Data []byte
+}
+
+// Pattern returns n non zero bytes that depend on seed.
+func Pattern(seed byte, n int) []byte {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(i%251) + seed | 1
+	}
+	return buf
+}
+
+// NewSparseDisk creates a sparse file of the given size, and writes the
+// given data to it. The file is closed when the test ends.
+func NewSparseDisk(t *testing.T, size uint64, writes ...Write) *os.File {
+	t.Helper()
+	f, err := ioutil.TempFile(t.TempDir(), "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	if err := f.Truncate(int64(size)); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.Data, int64(w.Off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f
+}
+
+// Contents returns length bytes of a disk starting at offset, built from the
+// writes to the disk. Everything else reads as zeros.
+func Contents(writes []Write, offset, length uint64) []byte {
+	data := make([]byte, length)
+	lo, hi := offset, offset+length
+	for _, w := range writes {
+		start, end := w.Off, w.Off+uint64(len(w.Data))
+		if end <= lo || start >= hi {
+			continue
+		}
+		if start < lo {
+			start = lo
+		}
+		if end > hi {
+			end = hi
+		}
+		copy(data[start-lo:end-lo], w.Data[start-w.Off:end-w.Off])
+	}
+	return data
+}
+
+// MemFile is an in memory file, that grows as data is written past its end.
+type MemFile struct {
+	Data []byte
+}
+
+// WriteAt implements io.WriterAt.
+func (m *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(m.Data) {
+		m.Data = append(m.Data, make([]byte, end-len(m.Data))...)
+	}
+	return copy(m.Data[off:], p), nil
+}
+
+// Truncate sets the size of the file.
+func (m *MemFile) Truncate(size int64) error {
+	if int(size) > len(m.Data) {
+		m.Data = append(m.Data, make([]byte, int(size)-len(m.Data))...)
+	}
+	m.Data = m.Data[:size]
+	return nil
+}
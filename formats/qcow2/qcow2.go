@@ -0,0 +1,424 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package qcow2 synthesizes qcow2 images from raw disks on the fly.
+//
+// The image is never written to disk. All metadata is computed from the
+// list of allocated chunks of the raw disk, so any part of the image can be
+// read at any time, without generating the parts that precede it. The
+// images use version 2 of the format, 64 KB clusters and 16 bit refcounts.
+// Only clusters that hold allocated chunks of the raw disk are stored.
+//
+// The layout of an image is:
+//
+//	header | L1 table | refcount table | refcount blocks | L2 tables | data
+//
+// Every section starts on a cluster boundary.
+package qcow2
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+const (
+	// Magic is the qcow2 magic value.
+	Magic uint32 = 0x514649fb
+	// Version is the version of the qcow2 format we generate.
+	Version uint32 = 2
+
+	// ClusterBits is log2 of the cluster size.
+	ClusterBits = 16
+	// ClusterSize is the size of a cluster.
+	ClusterSize uint64 = 1 << ClusterBits
+
+	// l2Entries is the number of entries in an L2 table.
+	l2Entries = ClusterSize / 8
+	// refcountEntries is the number of entries in a refcount block.
+	refcountEntries = ClusterSize / 2
+
+	// oflagCopied marks L1 and L2 entries pointing to clusters
+	// with a refcount of exactly one.
+	oflagCopied uint64 = 1 << 63
+)
+
+// header is the qcow2 version 2 header.
+type header struct {
+	Magic                 uint32
+	Version               uint32
+	BackingFileOffset     uint64
+	BackingFileSize       uint32
+	ClusterBits           uint32
+	Size                  uint64
+	CryptMethod           uint32
+	L1Size                uint32
+	L1TableOffset         uint64
+	RefcountTableOffset   uint64
+	RefcountTableClusters uint32
+	NbSnapshots           uint32
+	SnapshotsOffset       uint64
+}
+
+// run is a range of allocated guest clusters, [start, end). index is the
+// number of allocated clusters that precede this run, which is also the
+// position of its first cluster in the data section.
+type run struct {
+	start uint64
+	end   uint64
+	index uint64
+}
+
+// Image is a qcow2 image synthesized from a raw disk. It implements
+// io.ReaderAt. Use io.NewSectionReader(img, 0, img.Size()) to get an
+// io.ReadSeeker.
+type Image struct {
+	src      io.ReaderAt
+	diskSize uint64
+
+	runs []run
+	// l2Tables holds the L1 indexes that have an L2 table, in order.
+	l2Tables []uint64
+	// l2Pos maps L1 indexes to their position in l2Tables.
+	l2Pos map[uint64]uint64
+
+	l1Size uint64
+
+	// Start cluster of each section, and the total number of clusters.
+	l1Start       uint64
+	refTableStart uint64
+	refBlockStart uint64
+	l2Start       uint64
+	dataStart     uint64
+	clusters      uint64
+
+	// The last rendered metadata cluster is cached, as reads are not
+	// aligned to clusters.
+	mux           sync.Mutex
+	cached        []byte
+	cachedCluster uint64
+}
+
+func divRoundUp(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
+
+// NewImage returns a new qcow2 image of the raw disk src. The disk size
+// is diskSize, and chunks holds the allocated ranges of the disk. Only
+// the clusters that overlap chunks are read from src. Unwritten chunks
+// read as zeros, and are left out of the image.
+func NewImage(src io.ReaderAt, diskSize uint64, chunks []params.Chunk) (*Image, error) {
+	if diskSize == 0 {
+		return nil, errors.New("invalid disk size")
+	}
+
+	img := &Image{
+		src:      src,
+		diskSize: diskSize,
+		l2Pos:    map[uint64]uint64{},
+		cached:   make([]byte, ClusterSize),
+	}
+	img.setRuns(chunks)
+
+	var lastL1 uint64
+	for _, r := range img.runs {
+		for l1Idx := r.start / l2Entries; l1Idx <= (r.end-1)/l2Entries; l1Idx++ {
+			if len(img.l2Tables) > 0 && l1Idx == lastL1 {
+				continue
+			}
+			img.l2Pos[l1Idx] = uint64(len(img.l2Tables))
+			img.l2Tables = append(img.l2Tables, l1Idx)
+			lastL1 = l1Idx
+		}
+	}
+
+	var dataClusters uint64
+	if len(img.runs) > 0 {
+		last := img.runs[len(img.runs)-1]
+		dataClusters = last.index + last.end - last.start
+	}
+
+	img.l1Size = divRoundUp(divRoundUp(diskSize, ClusterSize), l2Entries)
+	l1Clusters := divRoundUp(img.l1Size*8, ClusterSize)
+	l2Clusters := uint64(len(img.l2Tables))
+
+	// The refcount blocks need to cover themselves and the refcount
+	// table, so we grow them until the layout is stable.
+	var refBlocks, refTableClusters uint64
+	for {
+		total := 1 + l1Clusters + refTableClusters + refBlocks + l2Clusters + dataClusters
+		neededBlocks := divRoundUp(total, refcountEntries)
+		neededTable := divRoundUp(neededBlocks*8, ClusterSize)
+		if neededBlocks == refBlocks && neededTable == refTableClusters {
+			break
+		}
+		refBlocks = neededBlocks
+		refTableClusters = neededTable
+	}
+
+	img.l1Start = 1
+	img.refTableStart = img.l1Start + l1Clusters
+	img.refBlockStart = img.refTableStart + refTableClusters
+	img.l2Start = img.refBlockStart + refBlocks
+	img.dataStart = img.l2Start + l2Clusters
+	img.clusters = img.dataStart + dataClusters
+	// Nothing is cached yet.
+	img.cachedCluster = img.clusters
+	return img, nil
+}
+
+// setRuns converts chunks into sorted, non overlapping runs of clusters.
+func (i *Image) setRuns(chunks []params.Chunk) {
+	sorted := make([]params.Chunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].Start < sorted[b].Start
+	})
+
+	var index uint64
+	for _, chunk := range sorted {
+		if chunk.Length == 0 || chunk.Start >= i.diskSize || chunk.Unwritten {
+			continue
+		}
+		end := chunk.Start + chunk.Length
+		if end > i.diskSize {
+			end = i.diskSize
+		}
+
+		start := chunk.Start / ClusterSize
+		endCluster := divRoundUp(end, ClusterSize)
+		if len(i.runs) > 0 {
+			last := &i.runs[len(i.runs)-1]
+			if start <= last.end {
+				if endCluster > last.end {
+					index += endCluster - last.end
+					last.end = endCluster
+				}
+				continue
+			}
+		}
+		i.runs = append(i.runs, run{
+			start: start,
+			end:   endCluster,
+			index: index,
+		})
+		index += endCluster - start
+	}
+}
+
+// Size returns the size of the qcow2 image, in bytes.
+func (i *Image) Size() int64 {
+	return int64(i.clusters * ClusterSize)
+}
+
+// ReadAt implements io.ReaderAt.
+func (i *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	var n int
+	for n < len(p) {
+		pos := uint64(off) + uint64(n)
+		cluster := pos / ClusterSize
+		if cluster >= i.clusters {
+			return n, io.EOF
+		}
+		within := pos % ClusterSize
+		toRead := ClusterSize - within
+		if remaining := uint64(len(p) - n); remaining < toRead {
+			toRead = remaining
+		}
+
+		buf := p[n : uint64(n)+toRead]
+		var err error
+		if cluster >= i.dataStart {
+			err = i.readData(buf, cluster-i.dataStart, within)
+		} else {
+			err = i.readMetadata(buf, cluster, within)
+		}
+		if err != nil {
+			return n, err
+		}
+		n += int(toRead)
+	}
+	return n, nil
+}
+
+// readData reads from the data cluster at position idx in the data section.
+func (i *Image) readData(p []byte, idx, within uint64) error {
+	runIdx := sort.Search(len(i.runs), func(j int) bool {
+		r := i.runs[j]
+		return r.index+r.end-r.start > idx
+	})
+	r := i.runs[runIdx]
+	guestCluster := r.start + idx - r.index
+	offset := guestCluster*ClusterSize + within
+
+	// The last cluster may extend past the end of the disk.
+	var toRead uint64
+	if offset < i.diskSize {
+		toRead = uint64(len(p))
+		if offset+toRead > i.diskSize {
+			toRead = i.diskSize - offset
+		}
+	}
+
+	var n int
+	if toRead > 0 {
+		var err error
+		n, err = i.src.ReadAt(p[:toRead], int64(offset))
+		if err != nil && err != io.EOF {
+			return errors.Wrap(err, "reading disk")
+		}
+	}
+	// Anything past the end of the source is read as zeros.
+	for idx := n; idx < len(p); idx++ {
+		p[idx] = 0
+	}
+	return nil
+}
+
+func (i *Image) readMetadata(p []byte, cluster, within uint64) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if i.cachedCluster != cluster {
+		for idx := range i.cached {
+			i.cached[idx] = 0
+		}
+		if err := i.renderMetadata(i.cached, cluster); err != nil {
+			i.cachedCluster = i.clusters
+			return err
+		}
+		i.cachedCluster = cluster
+	}
+	copy(p, i.cached[within:])
+	return nil
+}
+
+// renderMetadata writes the contents of a metadata cluster to buf. buf
+// must be zeroed.
+func (i *Image) renderMetadata(buf []byte, cluster uint64) error {
+	switch {
+	case cluster == 0:
+		return i.renderHeader(buf)
+	case cluster < i.refTableStart:
+		i.renderL1(buf, cluster-i.l1Start)
+	case cluster < i.refBlockStart:
+		i.renderRefTable(buf, cluster-i.refTableStart)
+	case cluster < i.l2Start:
+		i.renderRefBlock(buf, cluster-i.refBlockStart)
+	default:
+		i.renderL2(buf, i.l2Tables[cluster-i.l2Start])
+	}
+	return nil
+}
+
+func (i *Image) renderHeader(buf []byte) error {
+	hdr := header{
+		Magic:                 Magic,
+		Version:               Version,
+		ClusterBits:           ClusterBits,
+		Size:                  i.diskSize,
+		L1Size:                uint32(i.l1Size),
+		L1TableOffset:         i.l1Start * ClusterSize,
+		RefcountTableOffset:   i.refTableStart * ClusterSize,
+		RefcountTableClusters: uint32(i.refBlockStart - i.refTableStart),
+	}
+	w := &sliceWriter{buf: buf}
+	if err := binary.Write(w, binary.BigEndian, hdr); err != nil {
+		return errors.Wrap(err, "writing header")
+	}
+	return nil
+}
+
+// renderL1 renders the idx-th cluster of the L1 table.
+func (i *Image) renderL1(buf []byte, idx uint64) {
+	first := idx * l2Entries
+	for entry := uint64(0); entry < l2Entries && first+entry < i.l1Size; entry++ {
+		pos, ok := i.l2Pos[first+entry]
+		if !ok {
+			continue
+		}
+		offset := (i.l2Start + pos) * ClusterSize
+		binary.BigEndian.PutUint64(buf[entry*8:], offset|oflagCopied)
+	}
+}
+
+// renderRefTable renders the idx-th cluster of the refcount table.
+func (i *Image) renderRefTable(buf []byte, idx uint64) {
+	blocks := i.l2Start - i.refBlockStart
+	first := idx * (ClusterSize / 8)
+	for entry := uint64(0); entry < ClusterSize/8 && first+entry < blocks; entry++ {
+		offset := (i.refBlockStart + first + entry) * ClusterSize
+		binary.BigEndian.PutUint64(buf[entry*8:], offset)
+	}
+}
+
+// renderRefBlock renders the idx-th refcount block. Every cluster in the
+// image is used exactly once.
+func (i *Image) renderRefBlock(buf []byte, idx uint64) {
+	first := idx * refcountEntries
+	for entry := uint64(0); entry < refcountEntries && first+entry < i.clusters; entry++ {
+		binary.BigEndian.PutUint16(buf[entry*2:], 1)
+	}
+}
+
+// renderL2 renders the L2 table of L1 entry l1Idx.
+func (i *Image) renderL2(buf []byte, l1Idx uint64) {
+	lo := l1Idx * l2Entries
+	hi := lo + l2Entries
+
+	runIdx := sort.Search(len(i.runs), func(j int) bool {
+		return i.runs[j].end > lo
+	})
+	for ; runIdx < len(i.runs) && i.runs[runIdx].start < hi; runIdx++ {
+		r := i.runs[runIdx]
+		start := r.start
+		if start < lo {
+			start = lo
+		}
+		end := r.end
+		if end > hi {
+			end = hi
+		}
+		for guest := start; guest < end; guest++ {
+			host := i.dataStart + r.index + guest - r.start
+			binary.BigEndian.PutUint64(buf[(guest-lo)*8:], host*ClusterSize|oflagCopied)
+		}
+	}
+}
+
+// sliceWriter writes to a fixed size byte slice.
+type sliceWriter struct {
+	buf []byte
+	pos int
+}
+
+func (s *sliceWriter) Write(p []byte) (int, error) {
+	if len(p) > len(s.buf)-s.pos {
+		return 0, io.ErrShortBuffer
+	}
+	n := copy(s.buf[s.pos:], p)
+	s.pos += n
+	return n, nil
+}
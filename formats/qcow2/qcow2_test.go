@@ -0,0 +1,260 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package qcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/formats/internal/testutil"
+)
+
+const mb = 1 << 20
+
+// readImage reads the whole image, using reads that are not aligned to
+// clusters.
+func readImage(t *testing.T, img *Image) []byte {
+	buf := make([]byte, img.Size())
+	const step = 100003
+	for off := 0; off < len(buf); off += step {
+		end := off + step
+		if end > len(buf) {
+			end = len(buf)
+		}
+		n, err := img.ReadAt(buf[off:end], int64(off))
+		if err != nil {
+			t.Fatalf("reading image at %d: %v", off, err)
+		}
+		if n != end-off {
+			t.Fatalf("short read at %d: %d", off, n)
+		}
+	}
+
+	if n, err := img.ReadAt(make([]byte, 10), img.Size()-5); err != io.EOF || n != 5 {
+		t.Fatalf("reading past the end of the image: got %d, %v", n, err)
+	}
+	return buf
+}
+
+func checkHeader(t *testing.T, buf []byte, diskSize uint64) header {
+	var hdr header
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Magic != Magic || hdr.Version != Version || hdr.ClusterBits != ClusterBits {
+		t.Fatalf("invalid header: %+v", hdr)
+	}
+	if hdr.Size != diskSize {
+		t.Fatalf("expected disk size %d, got %d", diskSize, hdr.Size)
+	}
+	if hdr.BackingFileOffset != 0 || hdr.CryptMethod != 0 || hdr.NbSnapshots != 0 {
+		t.Fatalf("unexpected header fields: %+v", hdr)
+	}
+	if want := divRoundUp(divRoundUp(diskSize, ClusterSize), l2Entries); uint64(hdr.L1Size) != want {
+		t.Fatalf("expected %d L1 entries, got %d", want, hdr.L1Size)
+	}
+	for _, offset := range []uint64{hdr.L1TableOffset, hdr.RefcountTableOffset} {
+		if offset%ClusterSize != 0 || offset >= uint64(len(buf)) {
+			t.Fatalf("invalid table offset %d", offset)
+		}
+	}
+	return hdr
+}
+
+// checkRefcounts checks that every cluster of the image has a refcount
+// of one, and that nothing past the end of the image is referenced.
+func checkRefcounts(t *testing.T, buf []byte, hdr header) {
+	clusters := uint64(len(buf)) / ClusterSize
+	table := buf[hdr.RefcountTableOffset : hdr.RefcountTableOffset+uint64(hdr.RefcountTableClusters)*ClusterSize]
+	blocks := divRoundUp(clusters, refcountEntries)
+
+	for idx := uint64(0); idx < uint64(len(table))/8; idx++ {
+		offset := binary.BigEndian.Uint64(table[idx*8:])
+		if idx >= blocks {
+			if offset != 0 {
+				t.Fatalf("unexpected refcount block %d at %d", idx, offset)
+			}
+			continue
+		}
+		if offset == 0 || offset%ClusterSize != 0 || offset >= uint64(len(buf)) {
+			t.Fatalf("invalid offset %d of refcount block %d", offset, idx)
+		}
+
+		block := buf[offset : offset+ClusterSize]
+		for entry := uint64(0); entry < refcountEntries; entry++ {
+			want := uint16(1)
+			if idx*refcountEntries+entry >= clusters {
+				want = 0
+			}
+			if got := binary.BigEndian.Uint16(block[entry*2:]); got != want {
+				t.Fatalf("expected refcount %d for cluster %d, got %d", want, idx*refcountEntries+entry, got)
+			}
+		}
+	}
+}
+
+// lookup returns the offset in the image of the given guest cluster, or
+// zero if the cluster is not allocated.
+func lookup(t *testing.T, buf []byte, hdr header, guest uint64) uint64 {
+	l1Entry := binary.BigEndian.Uint64(buf[hdr.L1TableOffset+guest/l2Entries*8:])
+	if l1Entry == 0 {
+		return 0
+	}
+	l2Offset := l1Entry &^ oflagCopied
+	if l1Entry&oflagCopied == 0 || l2Offset%ClusterSize != 0 || l2Offset >= uint64(len(buf)) {
+		t.Fatalf("invalid L1 entry %x for guest cluster %d", l1Entry, guest)
+	}
+
+	l2Entry := binary.BigEndian.Uint64(buf[l2Offset+guest%l2Entries*8:])
+	if l2Entry == 0 {
+		return 0
+	}
+	host := l2Entry &^ oflagCopied
+	if l2Entry&oflagCopied == 0 || host%ClusterSize != 0 || host >= uint64(len(buf)) {
+		t.Fatalf("invalid L2 entry %x for guest cluster %d", l2Entry, guest)
+	}
+	return host
+}
+
+func TestImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		diskSize uint64
+		writes   []testutil.Write
+		chunks   []params.Chunk
+		// wantData is the number of data clusters in the image.
+		wantData uint64
+	}{
+		{
+			name:     "empty disk",
+			diskSize: 4 * mb,
+			wantData: 0,
+		},
+		{
+			name:     "single chunk",
+			diskSize: 4 * mb,
+			writes:   []testutil.Write{{Off: 65536, Data: testutil.Pattern(1, 100000)}},
+			chunks:   []params.Chunk{{Start: 65536, Length: 131072}},
+			wantData: 2,
+		},
+		{
+			name:     "unaligned chunks and disk size",
+			diskSize: 10*mb + 1000,
+			writes: []testutil.Write{
+				{Off: 3000, Data: testutil.Pattern(2, 5000)},
+				{Off: 10*mb + 100, Data: testutil.Pattern(3, 900)},
+			},
+			chunks: []params.Chunk{
+				{Start: 3000, Length: 5000},
+				{Start: 10 * mb, Length: 1000},
+			},
+			wantData: 2,
+		},
+		{
+			name:     "unwritten chunks are left out",
+			diskSize: 4 * mb,
+			writes:   []testutil.Write{{Off: 0, Data: testutil.Pattern(4, 65536)}},
+			chunks: []params.Chunk{
+				{Start: 0, Length: 65536},
+				{Start: mb, Length: mb, Unwritten: true},
+			},
+			wantData: 1,
+		},
+		{
+			name:     "overlapping and unsorted chunks",
+			diskSize: 4 * mb,
+			writes: []testutil.Write{
+				{Off: 0, Data: testutil.Pattern(5, 1000)},
+				{Off: 256 * 1024, Data: testutil.Pattern(6, 244*1024)},
+			},
+			chunks: []params.Chunk{
+				{Start: 256 * 1024, Length: 128 * 1024},
+				{Start: 0, Length: 65536},
+				{Start: 300 * 1024, Length: 200 * 1024},
+			},
+			wantData: 5,
+		},
+		{
+			name:     "chunks spanning L2 tables",
+			diskSize: 1024 * mb,
+			writes: []testutil.Write{
+				{Off: 512*mb - 4096, Data: testutil.Pattern(7, 8192)},
+				{Off: 900 * mb, Data: testutil.Pattern(8, 65536)},
+			},
+			chunks: []params.Chunk{
+				{Start: 512*mb - 65536, Length: 131072},
+				{Start: 900 * mb, Length: 65536},
+			},
+			wantData: 3,
+		},
+		{
+			name:     "chunks past the end of the disk",
+			diskSize: mb,
+			writes:   []testutil.Write{{Off: mb - 10, Data: testutil.Pattern(9, 10)}},
+			chunks: []params.Chunk{
+				{Start: mb - 65536, Length: 2 * 65536},
+				{Start: 2 * mb, Length: 65536},
+			},
+			wantData: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := testutil.NewSparseDisk(t, tt.diskSize, tt.writes...)
+			img, err := NewImage(disk, tt.diskSize, tt.chunks)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := readImage(t, img)
+			hdr := checkHeader(t, buf, tt.diskSize)
+			checkRefcounts(t, buf, hdr)
+
+			seen := map[uint64]bool{}
+			for guest := uint64(0); guest < divRoundUp(tt.diskSize, ClusterSize); guest++ {
+				want := testutil.Contents(tt.writes, guest*ClusterSize, ClusterSize)
+				host := lookup(t, buf, hdr, guest)
+				if host == 0 {
+					if bytes.Count(want, []byte{0}) != len(want) {
+						t.Fatalf("guest cluster %d holds data, but is not in the image", guest)
+					}
+					continue
+				}
+				if seen[host] {
+					t.Fatalf("host cluster %d is mapped more than once", host/ClusterSize)
+				}
+				seen[host] = true
+				if bytes.Equal(buf[host:host+ClusterSize], want) == false {
+					t.Fatalf("guest cluster %d has unexpected contents", guest)
+				}
+			}
+			if uint64(len(seen)) != tt.wantData {
+				t.Fatalf("expected %d data clusters, got %d", tt.wantData, len(seen))
+			}
+		})
+	}
+}
+
+func TestNewImageInvalidSize(t *testing.T) {
+	if _, err := NewImage(bytes.NewReader(nil), 0, nil); err == nil {
+		t.Fatal("expected an error for an empty disk")
+	}
+}
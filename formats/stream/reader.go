@@ -0,0 +1,195 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Reader reads a framed stream.
+type Reader struct {
+	r      io.Reader
+	header Header
+
+	// remaining is the number of bytes of the current record that
+	// were not yet read.
+	remaining uint64
+	done      bool
+}
+
+// NewReader reads and validates the stream header from r, and returns
+// a new *Reader.
+func NewReader(r io.Reader) (*Reader, error) {
+	var hdr Header
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, errors.Wrap(err, "reading stream header")
+	}
+	if string(hdr.Magic[:]) != Magic {
+		return nil, fmt.Errorf("invalid stream magic")
+	}
+	if hdr.Version != Version {
+		return nil, fmt.Errorf("unsupported stream version %d", hdr.Version)
+	}
+	return &Reader{
+		r:      r,
+		header: hdr,
+	}, nil
+}
+
+// DiskSize returns the size of the disk, as recorded in the stream header.
+func (s *Reader) DiskSize() uint64 {
+	return s.header.DiskSize
+}
+
+// Next advances to the next data or zero record and returns its header. Any
+// data not read from the previous record is discarded. Zero records carry no
+// data. io.EOF is returned once the end record is reached. If the underlying
+// reader ends before the end record, io.ErrUnexpectedEOF is returned.
+func (s *Reader) Next() (RecordHeader, error) {
+	if s.done {
+		return RecordHeader{}, io.EOF
+	}
+
+	if s.remaining > 0 {
+		if _, err := io.CopyN(ioutil.Discard, s.r, int64(s.remaining)); err != nil {
+			return RecordHeader{}, errors.Wrap(unexpectedEOF(err), "skipping record data")
+		}
+		s.remaining = 0
+	}
+
+	var hdr RecordHeader
+	if err := binary.Read(s.r, binary.BigEndian, &hdr); err != nil {
+		return RecordHeader{}, errors.Wrap(unexpectedEOF(err), "reading record header")
+	}
+
+	switch hdr.Type {
+	case RecordData, RecordZero:
+		if hdr.Offset+hdr.Length > s.header.DiskSize || hdr.Offset+hdr.Length < hdr.Offset {
+			return RecordHeader{}, fmt.Errorf(
+				"record at offset %d with length %d exceeds disk size", hdr.Offset, hdr.Length)
+		}
+		if hdr.Type == RecordData {
+			s.remaining = hdr.Length
+		}
+		return hdr, nil
+	case RecordEnd:
+		s.done = true
+		return RecordHeader{}, io.EOF
+	default:
+		return RecordHeader{}, fmt.Errorf("invalid record type %d", hdr.Type)
+	}
+}
+
+// Read reads data from the current record. It returns io.EOF once all
+// the data of the current record was read, or right away for zero records.
+func (s *Reader) Read(p []byte) (int, error) {
+	if s.remaining == 0 {
+		return 0, io.EOF
+	}
+	if uint64(len(p)) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.r.Read(p)
+	s.remaining -= uint64(n)
+	if err == io.EOF && s.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Apply writes the data of all remaining records to dst, at the offsets
+// recorded in the stream, writes zeros over the ranges of zero records, and
+// sets the size of dst to the size of the disk. This can be used to
+// reconstruct a sparse copy of the disk, or to apply an incremental stream
+// to a previous copy.
+func (s *Reader) Apply(dst File) error {
+	buf := make([]byte, 1024*1024)
+	zeros := make([]byte, len(buf))
+	for {
+		hdr, err := s.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if hdr.Type == RecordZero {
+			if err := writeZeros(dst, hdr.Offset, hdr.Length, zeros); err != nil {
+				return err
+			}
+			continue
+		}
+
+		offset := int64(hdr.Offset)
+		for {
+			n, err := s.Read(buf)
+			if n > 0 {
+				if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+					return errors.Wrap(err, "writing data")
+				}
+				offset += int64(n)
+			}
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return errors.Wrap(err, "reading record data")
+			}
+		}
+	}
+
+	if err := dst.Truncate(int64(s.header.DiskSize)); err != nil {
+		return errors.Wrap(err, "setting disk size")
+	}
+	return nil
+}
+
+// writeZeros writes length zero bytes to dst at offset, using zeros, which
+// must only hold zero bytes.
+func writeZeros(dst io.WriterAt, offset, length uint64, zeros []byte) error {
+	for length > 0 {
+		n := uint64(len(zeros))
+		if n > length {
+			n = length
+		}
+		if _, err := dst.WriteAt(zeros[:n], int64(offset)); err != nil {
+			return errors.Wrap(err, "writing zeros")
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// File is the destination of Reader.Apply. *os.File implements it.
+type File interface {
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package stream implements a simple framed format used to transfer the
+// allocated chunks of a disk over a single connection.
+//
+// A stream starts with a header holding a magic value, the format version
+// and the size of the disk. The header is followed by any number of data
+// and zero records, and a single end record. Each record starts with its
+// type, the offset on the disk and the length of the range it covers. Only
+// data records are followed by data. Zero records mark ranges that must read
+// as zeros on the destination disk, and are used for incremental streams.
+// All integers are big endian.
+package stream
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Magic is the value every stream starts with.
+	Magic = "COVMSTRM"
+	// Version is the version of the stream format.
+	Version uint32 = 1
+
+	// RecordData is a record holding Length bytes of data, that
+	// should be written at Offset.
+	RecordData uint32 = 1
+	// RecordEnd marks the end of the stream.
+	RecordEnd uint32 = 2
+	// RecordZero is a record with no data. Length bytes at Offset
+	// should be set to zero.
+	RecordZero uint32 = 3
+)
+
+// Header is the header of a stream.
+type Header struct {
+	Magic    [8]byte
+	Version  uint32
+	DiskSize uint64
+}
+
+// RecordHeader precedes the data of every record.
+type RecordHeader struct {
+	Type   uint32
+	Offset uint64
+	Length uint64
+}
+
+// Writer writes a framed stream.
+type Writer struct {
+	w      io.Writer
+	closed bool
+}
+
+// NewWriter writes the stream header to w and returns a new *Writer.
+func NewWriter(w io.Writer, diskSize uint64) (*Writer, error) {
+	hdr := Header{
+		Version:  Version,
+		DiskSize: diskSize,
+	}
+	copy(hdr.Magic[:], Magic)
+	if err := binary.Write(w, binary.BigEndian, hdr); err != nil {
+		return nil, errors.Wrap(err, "writing stream header")
+	}
+	return &Writer{w: w}, nil
+}
+
+// WriteChunk writes a data record with length bytes read from r, that
+// should be written at offset on the destination disk.
+func (s *Writer) WriteChunk(offset, length uint64, r io.Reader) error {
+	if s.closed {
+		return fmt.Errorf("stream is closed")
+	}
+
+	hdr := RecordHeader{
+		Type:   RecordData,
+		Offset: offset,
+		Length: length,
+	}
+	if err := binary.Write(s.w, binary.BigEndian, hdr); err != nil {
+		return errors.Wrap(err, "writing record header")
+	}
+
+	n, err := io.CopyN(s.w, r, int64(length))
+	if err != nil {
+		return errors.Wrapf(err, "writing record data (%d of %d bytes written)", n, length)
+	}
+	return nil
+}
+
+// WriteZero writes a zero record, covering length bytes at offset.
+func (s *Writer) WriteZero(offset, length uint64) error {
+	if s.closed {
+		return fmt.Errorf("stream is closed")
+	}
+
+	hdr := RecordHeader{
+		Type:   RecordZero,
+		Offset: offset,
+		Length: length,
+	}
+	if err := binary.Write(s.w, binary.BigEndian, hdr); err != nil {
+		return errors.Wrap(err, "writing record header")
+	}
+	return nil
+}
+
+// Close writes the end record. It does not close the underlying writer.
+func (s *Writer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	hdr := RecordHeader{
+		Type: RecordEnd,
+	}
+	if err := binary.Write(s.w, binary.BigEndian, hdr); err != nil {
+		return errors.Wrap(err, "writing end record")
+	}
+	return nil
+}
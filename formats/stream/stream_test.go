@@ -0,0 +1,263 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/formats/internal/testutil"
+)
+
+const diskSize = 65536
+
+// headerSize and recordSize are the encoded sizes of Header and
+// RecordHeader.
+var (
+	headerSize = binary.Size(Header{})
+	recordSize = binary.Size(RecordHeader{})
+)
+
+// newStream returns an incremental stream of a 64 KB disk, along with the
+// base it applies onto and the disk it produces.
+func newStream(t *testing.T) ([]byte, []byte, []byte) {
+	disk := make([]byte, diskSize)
+	copy(disk[4096:], testutil.Pattern(1, 8192))
+	copy(disk[diskSize-1000:], testutil.Pattern(2, 1000))
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, diskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunk(4096, 8192, bytes.NewReader(disk[4096:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteZero(16384, 4096); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunk(diskSize-1000, 1000, bytes.NewReader(disk[diskSize-1000:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := headerSize + 4*recordSize + 8192 + 1000; buf.Len() != want {
+		t.Fatalf("expected a stream of %d bytes, got %d", want, buf.Len())
+	}
+
+	// The base is larger than the disk, and holds data everywhere, so
+	// we can check that zero records are written, and that the result
+	// is truncated.
+	base := testutil.Pattern(3, diskSize+4096)
+	want := append([]byte{}, base[:diskSize]...)
+	copy(want[4096:], disk[4096:4096+8192])
+	copy(want[16384:], make([]byte, 4096))
+	copy(want[diskSize-1000:], disk[diskSize-1000:])
+	return buf.Bytes(), base, want
+}
+
+func TestRoundTrip(t *testing.T) {
+	data, base, want := newStream(t)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.DiskSize() != diskSize {
+		t.Fatalf("expected disk size %d, got %d", diskSize, r.DiskSize())
+	}
+	dst := &testutil.MemFile{Data: base}
+	if err := r.Apply(dst); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(dst.Data, want) == false {
+		t.Fatal("applied stream does not match the disk")
+	}
+}
+
+func TestNext(t *testing.T) {
+	data, _, _ := newStream(t)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data that is not read is skipped by the next call to Next.
+	want := []RecordHeader{
+		{Type: RecordData, Offset: 4096, Length: 8192},
+		{Type: RecordZero, Offset: 16384, Length: 4096},
+		{Type: RecordData, Offset: diskSize - 1000, Length: 1000},
+	}
+	for idx, wantHdr := range want {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatalf("reading record %d: %v", idx, err)
+		}
+		if hdr != wantHdr {
+			t.Fatalf("expected record %+v, got %+v", wantHdr, hdr)
+		}
+		if idx == 1 {
+			if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+				t.Fatalf("expected zero records to have no data, got %d bytes, %v", n, err)
+			}
+		}
+	}
+
+	last, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(last, testutil.Pattern(2, 1000)) == false {
+		t.Fatal("last record does not match the disk")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("expected io.EOF after the end record, got %v", err)
+		}
+	}
+}
+
+func TestWriterClosed(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, diskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected a second Close to do nothing, got %v", err)
+	}
+	if buf.Len() != headerSize+recordSize {
+		t.Fatalf("expected a single end record, got %d bytes", buf.Len())
+	}
+	if err := w.WriteChunk(0, 1, bytes.NewReader([]byte{1})); err == nil {
+		t.Fatal("expected WriteChunk to fail on a closed stream")
+	}
+	if err := w.WriteZero(0, 1); err == nil {
+		t.Fatal("expected WriteZero to fail on a closed stream")
+	}
+}
+
+func TestWriteShortRead(t *testing.T) {
+	w, err := NewWriter(ioutil.Discard, diskSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteChunk(0, 8192, bytes.NewReader(make([]byte, 4096))); err == nil {
+		t.Fatal("expected a short read error")
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	data, base, _ := newStream(t)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"in record header", headerSize + 10},
+		{"in record data", headerSize + recordSize + 100},
+		{"before record data", headerSize + 3*recordSize + 8192},
+		{"in last record data", len(data) - recordSize - 1},
+		{"without end record", len(data) - recordSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader(data[:tt.size]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.Apply(&testutil.MemFile{Data: base})
+			if errors.Cause(err) != io.ErrUnexpectedEOF {
+				t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+			}
+		})
+	}
+
+	if _, err := NewReader(bytes.NewReader(data[:headerSize-1])); err == nil {
+		t.Fatal("expected an error for a truncated header")
+	}
+}
+
+func TestCorruptStream(t *testing.T) {
+	// The offset of the first record header.
+	first := headerSize
+
+	tests := []struct {
+		name    string
+		corrupt func(data []byte)
+		wantErr string
+	}{
+		{
+			name:    "bad magic",
+			corrupt: func(data []byte) { data[0] ^= 0xff },
+			wantErr: "invalid stream magic",
+		},
+		{
+			name: "bad version",
+			corrupt: func(data []byte) {
+				binary.BigEndian.PutUint32(data[8:], Version+1)
+			},
+			wantErr: "unsupported stream version",
+		},
+		{
+			name: "bad record type",
+			corrupt: func(data []byte) {
+				binary.BigEndian.PutUint32(data[first:], 42)
+			},
+			wantErr: "invalid record type 42",
+		},
+		{
+			name: "record past the end of the disk",
+			corrupt: func(data []byte) {
+				binary.BigEndian.PutUint64(data[first+4:], diskSize-100)
+			},
+			wantErr: "exceeds disk size",
+		},
+		{
+			name: "overflowing record",
+			corrupt: func(data []byte) {
+				binary.BigEndian.PutUint64(data[first+4:], 1<<63)
+				binary.BigEndian.PutUint64(data[first+12:], 1<<63)
+			},
+			wantErr: "exceeds disk size",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, base, _ := newStream(t)
+			tt.corrupt(data)
+
+			r, err := NewReader(bytes.NewReader(data))
+			if err == nil {
+				err = r.Apply(&testutil.MemFile{Data: base})
+			}
+			if err == nil || strings.Contains(err.Error(), tt.wantErr) == false {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
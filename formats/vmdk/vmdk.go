@@ -0,0 +1,431 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package vmdk writes streamOptimized VMDK images from raw disks.
+//
+// A streamOptimized image is a single sparse extent, meant to be written
+// and read sequentially. It starts with a header and an embedded
+// descriptor, followed by zlib compressed grains, each preceded by a grain
+// marker. Grain tables are written after the grains they point to, and the
+// grain directory, a footer and an end of stream marker close the image.
+// The size of the compressed grains is not known in advance, so neither
+// is the size of the image.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+const (
+	// Magic is the magic value of sparse extent headers ("KDMV").
+	Magic uint32 = 0x564d444b
+	// Version is the sparse extent version used by streamOptimized images.
+	Version uint32 = 3
+
+	// SectorSize is the size of a sector. All offsets and sizes in the
+	// image are expressed in sectors.
+	SectorSize uint64 = 512
+	// GrainSectors is the size of a grain, in sectors.
+	GrainSectors uint64 = 128
+	// GrainSize is the size of a grain, in bytes.
+	GrainSize = GrainSectors * SectorSize
+	// GTEntries is the number of entries in a grain table.
+	GTEntries uint64 = 512
+
+	// FlagValidNewlineTest means the newline characters in the header
+	// are valid.
+	FlagValidNewlineTest uint32 = 1 << 0
+	// FlagCompressed means grains are compressed.
+	FlagCompressed uint32 = 1 << 16
+	// FlagMarkers means the extent uses markers.
+	FlagMarkers uint32 = 1 << 17
+
+	// CompressionDeflate is the only compression algorithm supported.
+	CompressionDeflate uint16 = 1
+
+	// GDAtEnd is the value of GDOffset in the header at the start of a
+	// stream, where the grain directory is not yet written.
+	GDAtEnd uint64 = math.MaxUint64
+
+	// MarkerEOS marks the end of the stream.
+	MarkerEOS uint32 = 0
+	// MarkerGT precedes a grain table.
+	MarkerGT uint32 = 1
+	// MarkerGD precedes the grain directory.
+	MarkerGD uint32 = 2
+	// MarkerFooter precedes the footer.
+	MarkerFooter uint32 = 3
+)
+
+// Header is the sparse extent header. It is also written, with the
+// offset of the grain directory set, as the footer.
+type Header struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+// Marker precedes metadata in the stream. Grain markers only use the
+// first two fields, followed by the compressed grain.
+type Marker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+	Pad        [496]uint8
+}
+
+// grainMarker precedes each compressed grain.
+type grainMarker struct {
+	LBA  uint64
+	Size uint32
+}
+
+// grainRun is a range of allocated grains, [start, end).
+type grainRun struct {
+	start uint64
+	end   uint64
+}
+
+func divRoundUp(a, b uint64) uint64 {
+	return (a + b - 1) / b
+}
+
+// grainRuns converts chunks into sorted, non overlapping runs of grains.
+func grainRuns(chunks []params.Chunk, diskSize uint64) []grainRun {
+	sorted := make([]params.Chunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(a, b int) bool {
+		return sorted[a].Start < sorted[b].Start
+	})
+
+	var ret []grainRun
+	for _, chunk := range sorted {
+		if chunk.Length == 0 || chunk.Start >= diskSize || chunk.Unwritten {
+			continue
+		}
+		end := chunk.Start + chunk.Length
+		if end > diskSize {
+			end = diskSize
+		}
+
+		start := chunk.Start / GrainSize
+		endGrain := divRoundUp(end, GrainSize)
+		if len(ret) > 0 && start <= ret[len(ret)-1].end {
+			if endGrain > ret[len(ret)-1].end {
+				ret[len(ret)-1].end = endGrain
+			}
+			continue
+		}
+		ret = append(ret, grainRun{start: start, end: endGrain})
+	}
+	return ret
+}
+
+// descriptor returns the embedded descriptor of an image with the given
+// capacity, in sectors.
+func descriptor(capacity uint64) []byte {
+	// Use the usual geometry for SCSI disks.
+	cylinders := capacity / (255 * 63)
+	if cylinders > 65535 {
+		cylinders = 65535
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Disk DescriptorFile\n")
+	fmt.Fprintf(&buf, "version=1\n")
+	fmt.Fprintf(&buf, "CID=fffffffe\n")
+	fmt.Fprintf(&buf, "parentCID=ffffffff\n")
+	fmt.Fprintf(&buf, "createType=\"streamOptimized\"\n\n")
+	fmt.Fprintf(&buf, "# Extent description\n")
+	fmt.Fprintf(&buf, "RW %d SPARSE \"disk.vmdk\"\n\n", capacity)
+	fmt.Fprintf(&buf, "# The Disk Data Base\n")
+	fmt.Fprintf(&buf, "#DDB\n\n")
+	fmt.Fprintf(&buf, "ddb.virtualHWVersion = \"4\"\n")
+	fmt.Fprintf(&buf, "ddb.geometry.cylinders = \"%d\"\n", cylinders)
+	fmt.Fprintf(&buf, "ddb.geometry.heads = \"255\"\n")
+	fmt.Fprintf(&buf, "ddb.geometry.sectors = \"63\"\n")
+	fmt.Fprintf(&buf, "ddb.adapterType = \"lsilogic\"\n")
+	return buf.Bytes()
+}
+
+// streamWriter writes a streamOptimized image to an io.Writer, keeping track of
+// the current offset.
+type streamWriter struct {
+	w      io.Writer
+	offset uint64
+
+	header Header
+	// gd holds the sector offset of each grain table, or 0 if a grain
+	// table has no allocated grains.
+	gd []uint32
+	// gt holds the current grain table.
+	gt      []uint32
+	gtIndex uint64
+	gtDirty bool
+
+	grain      []byte
+	compressed bytes.Buffer
+	compressor *zlib.Writer
+}
+
+// Write writes a streamOptimized image of the raw disk src to w. The disk
+// size is diskSize, and chunks holds the allocated ranges of the disk. Only
+// the grains that overlap chunks, and hold data other than zeros, are read
+// from src and written to the image. Unwritten chunks are skipped. Grains
+// are compressed with the given zlib compression level.
+func Write(w io.Writer, src io.ReaderAt, diskSize uint64, chunks []params.Chunk, level int) error {
+	if diskSize == 0 {
+		return errors.New("invalid disk size")
+	}
+
+	compressor, err := zlib.NewWriterLevel(nil, level)
+	if err != nil {
+		return errors.Wrap(err, "creating compressor")
+	}
+
+	capacity := divRoundUp(diskSize, SectorSize)
+	desc := descriptor(capacity)
+	descSectors := divRoundUp(uint64(len(desc)), SectorSize)
+
+	vw := &streamWriter{
+		w: w,
+		header: Header{
+			MagicNumber:        Magic,
+			Version:            Version,
+			Flags:              FlagValidNewlineTest | FlagCompressed | FlagMarkers,
+			Capacity:           capacity,
+			GrainSize:          GrainSectors,
+			DescriptorOffset:   1,
+			DescriptorSize:     descSectors,
+			NumGTEsPerGT:       uint32(GTEntries),
+			GDOffset:           GDAtEnd,
+			OverHead:           1 + descSectors,
+			SingleEndLineChar:  '\n',
+			NonEndLineChar:     ' ',
+			DoubleEndLineChar1: '\r',
+			DoubleEndLineChar2: '\n',
+			CompressAlgorithm:  CompressionDeflate,
+		},
+		gd:         make([]uint32, divRoundUp(divRoundUp(capacity, GrainSectors), GTEntries)),
+		gt:         make([]uint32, GTEntries),
+		grain:      make([]byte, GrainSize),
+		compressor: compressor,
+	}
+
+	if err := vw.writeStruct(vw.header); err != nil {
+		return errors.Wrap(err, "writing header")
+	}
+	if err := vw.writePadded(desc); err != nil {
+		return errors.Wrap(err, "writing descriptor")
+	}
+
+	for _, run := range grainRuns(chunks, diskSize) {
+		for grain := run.start; grain < run.end; grain++ {
+			if err := vw.writeGrain(src, diskSize, grain); err != nil {
+				return errors.Wrapf(err, "writing grain %d", grain)
+			}
+		}
+	}
+	if err := vw.flushGT(); err != nil {
+		return errors.Wrap(err, "writing grain table")
+	}
+	return vw.finish()
+}
+
+func (v *streamWriter) write(p []byte) error {
+	n, err := v.w.Write(p)
+	v.offset += uint64(n)
+	return err
+}
+
+func (v *streamWriter) writeStruct(data interface{}) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, data); err != nil {
+		return err
+	}
+	return v.writePadded(buf.Bytes())
+}
+
+// writePadded writes p, followed by zeros up to the next sector boundary.
+func (v *streamWriter) writePadded(p []byte) error {
+	if err := v.write(p); err != nil {
+		return err
+	}
+	if pad := v.offset % SectorSize; pad != 0 {
+		return v.write(make([]byte, SectorSize-pad))
+	}
+	return nil
+}
+
+// sector returns the current offset, in sectors. Offsets in grain tables
+// and in the grain directory are 32 bit.
+func (v *streamWriter) sector() (uint32, error) {
+	sector := v.offset / SectorSize
+	if sector > math.MaxUint32 {
+		return 0, errors.New("image exceeds the maximum sparse extent size")
+	}
+	return uint32(sector), nil
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *streamWriter) writeGrain(src io.ReaderAt, diskSize, grain uint64) error {
+	if gtIndex := grain / GTEntries; gtIndex != v.gtIndex {
+		if err := v.flushGT(); err != nil {
+			return errors.Wrap(err, "writing grain table")
+		}
+		v.gtIndex = gtIndex
+	}
+
+	offset := grain * GrainSize
+	toRead := GrainSize
+	if offset+toRead > diskSize {
+		toRead = diskSize - offset
+	}
+	n, err := src.ReadAt(v.grain[:toRead], int64(offset))
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "reading disk")
+	}
+	// Anything past the end of the source is read as zeros.
+	for idx := n; idx < len(v.grain); idx++ {
+		v.grain[idx] = 0
+	}
+
+	// Grains that only hold zeros don't need to be stored.
+	if isZero(v.grain) {
+		return nil
+	}
+
+	v.compressed.Reset()
+	v.compressor.Reset(&v.compressed)
+	if _, err := v.compressor.Write(v.grain); err != nil {
+		return errors.Wrap(err, "compressing grain")
+	}
+	if err := v.compressor.Close(); err != nil {
+		return errors.Wrap(err, "compressing grain")
+	}
+
+	sector, err := v.sector()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	marker := grainMarker{
+		LBA:  grain * GrainSectors,
+		Size: uint32(v.compressed.Len()),
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, marker); err != nil {
+		return errors.Wrap(err, "writing grain marker")
+	}
+	buf.Write(v.compressed.Bytes())
+	if err := v.writePadded(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "writing grain")
+	}
+
+	v.gt[grain%GTEntries] = sector
+	v.gtDirty = true
+	return nil
+}
+
+// flushGT writes the current grain table, if it holds any grains, and
+// records its offset in the grain directory.
+func (v *streamWriter) flushGT() error {
+	if v.gtDirty == false {
+		return nil
+	}
+
+	tableSectors := GTEntries * 4 / SectorSize
+	if err := v.writeStruct(Marker{NumSectors: tableSectors, Type: MarkerGT}); err != nil {
+		return err
+	}
+	sector, err := v.sector()
+	if err != nil {
+		return err
+	}
+	if err := v.writeStruct(v.gt); err != nil {
+		return err
+	}
+
+	v.gd[v.gtIndex] = sector
+	for idx := range v.gt {
+		v.gt[idx] = 0
+	}
+	v.gtDirty = false
+	return nil
+}
+
+// finish writes the grain directory, the footer and the end of stream
+// marker.
+func (v *streamWriter) finish() error {
+	gdSectors := divRoundUp(uint64(len(v.gd))*4, SectorSize)
+	if err := v.writeStruct(Marker{NumSectors: gdSectors, Type: MarkerGD}); err != nil {
+		return errors.Wrap(err, "writing grain directory marker")
+	}
+	gdSector, err := v.sector()
+	if err != nil {
+		return err
+	}
+	if err := v.writeStruct(v.gd); err != nil {
+		return errors.Wrap(err, "writing grain directory")
+	}
+
+	if err := v.writeStruct(Marker{NumSectors: 1, Type: MarkerFooter}); err != nil {
+		return errors.Wrap(err, "writing footer marker")
+	}
+	footer := v.header
+	footer.GDOffset = uint64(gdSector)
+	if err := v.writeStruct(footer); err != nil {
+		return errors.Wrap(err, "writing footer")
+	}
+
+	if err := v.writeStruct(Marker{Type: MarkerEOS}); err != nil {
+		return errors.Wrap(err, "writing end of stream marker")
+	}
+	return nil
+}
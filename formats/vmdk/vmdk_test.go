@@ -0,0 +1,312 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/formats/internal/testutil"
+)
+
+const mb = 1 << 20
+
+func readStruct(t *testing.T, img []byte, sector uint64, data interface{}) {
+	offset := sector * SectorSize
+	if offset >= uint64(len(img)) {
+		t.Fatalf("sector %d is past the end of the image", sector)
+	}
+	if err := binary.Read(bytes.NewReader(img[offset:]), binary.LittleEndian, data); err != nil {
+		t.Fatalf("reading sector %d: %v", sector, err)
+	}
+}
+
+func checkHeader(t *testing.T, hdr Header, diskSize uint64) {
+	capacity := divRoundUp(diskSize, SectorSize)
+	if hdr.MagicNumber != Magic || hdr.Version != Version {
+		t.Fatalf("invalid magic or version: %x %d", hdr.MagicNumber, hdr.Version)
+	}
+	if hdr.Flags != FlagValidNewlineTest|FlagCompressed|FlagMarkers {
+		t.Fatalf("unexpected flags %x", hdr.Flags)
+	}
+	if hdr.Capacity != capacity || hdr.GrainSize != GrainSectors || uint64(hdr.NumGTEsPerGT) != GTEntries {
+		t.Fatalf("unexpected geometry: %+v", hdr)
+	}
+	if hdr.CompressAlgorithm != CompressionDeflate {
+		t.Fatalf("unexpected compression algorithm %d", hdr.CompressAlgorithm)
+	}
+	if hdr.DescriptorOffset != 1 || hdr.OverHead != 1+hdr.DescriptorSize {
+		t.Fatalf("unexpected descriptor offset or overhead: %+v", hdr)
+	}
+	if hdr.SingleEndLineChar != '\n' || hdr.NonEndLineChar != ' ' ||
+		hdr.DoubleEndLineChar1 != '\r' || hdr.DoubleEndLineChar2 != '\n' {
+		t.Fatalf("invalid newline test characters: %+v", hdr)
+	}
+}
+
+func readGrain(t *testing.T, img []byte, sector uint64) (uint64, []byte) {
+	var marker grainMarker
+	readStruct(t, img, sector, &marker)
+	if marker.Size == 0 {
+		t.Fatalf("expected a grain marker at sector %d", sector)
+	}
+
+	offset := sector*SectorSize + 12
+	zr, err := zlib.NewReader(bytes.NewReader(img[offset : offset+uint64(marker.Size)]))
+	if err != nil {
+		t.Fatalf("decompressing grain at sector %d: %v", sector, err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("decompressing grain at sector %d: %v", sector, err)
+	}
+	return marker.LBA, data
+}
+
+// walkStream reads the image sequentially, the way a streaming reader
+// would, and returns the LBA of every grain, in order.
+func walkStream(t *testing.T, img []byte, hdr Header) []uint64 {
+	var lbas []uint64
+	sector := hdr.OverHead
+	for {
+		var marker Marker
+		readStruct(t, img, sector, &marker)
+		if marker.Size != 0 {
+			lbas = append(lbas, marker.NumSectors)
+			sector += divRoundUp(12+uint64(marker.Size), SectorSize)
+			continue
+		}
+		if marker.Type == MarkerEOS {
+			if (sector+1)*SectorSize != uint64(len(img)) {
+				t.Fatalf("end of stream marker at sector %d, image has %d bytes", sector, len(img))
+			}
+			return lbas
+		}
+		sector += 1 + marker.NumSectors
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		diskSize uint64
+		writes   []testutil.Write
+		// hidden holds data written to the disk that must not end up
+		// in the image.
+		hidden []testutil.Write
+		chunks []params.Chunk
+		// wantGrains is the number of grains in the image.
+		wantGrains int
+	}{
+		{
+			name:       "empty disk",
+			diskSize:   4 * mb,
+			wantGrains: 0,
+		},
+		{
+			name:       "single chunk",
+			diskSize:   4 * mb,
+			writes:     []testutil.Write{{Off: 65536, Data: testutil.Pattern(1, 100000)}},
+			chunks:     []params.Chunk{{Start: 65536, Length: 131072}},
+			wantGrains: 2,
+		},
+		{
+			name:       "zero grains are skipped",
+			diskSize:   4 * mb,
+			writes:     []testutil.Write{{Off: 3 * 65536, Data: testutil.Pattern(2, 1000)}},
+			chunks:     []params.Chunk{{Start: 0, Length: 4 * 65536}},
+			wantGrains: 1,
+		},
+		{
+			name:     "unwritten chunks are skipped",
+			diskSize: 4 * mb,
+			writes:   []testutil.Write{{Off: 0, Data: testutil.Pattern(3, 65536)}},
+			hidden:   []testutil.Write{{Off: mb, Data: testutil.Pattern(4, 65536)}},
+			chunks: []params.Chunk{
+				{Start: 0, Length: 65536},
+				{Start: mb, Length: mb, Unwritten: true},
+			},
+			wantGrains: 1,
+		},
+		{
+			name:     "unaligned chunks and disk size",
+			diskSize: 10*mb + 1000,
+			writes: []testutil.Write{
+				{Off: 3000, Data: testutil.Pattern(5, 5000)},
+				{Off: 10*mb + 100, Data: testutil.Pattern(6, 900)},
+			},
+			chunks: []params.Chunk{
+				{Start: 3000, Length: 5000},
+				{Start: 10 * mb, Length: 1000},
+				{Start: 20 * mb, Length: 65536},
+			},
+			wantGrains: 2,
+		},
+		{
+			name:     "overlapping and unsorted chunks",
+			diskSize: 4 * mb,
+			writes: []testutil.Write{
+				{Off: 0, Data: testutil.Pattern(7, 1000)},
+				{Off: 256 * 1024, Data: testutil.Pattern(8, 244*1024)},
+			},
+			chunks: []params.Chunk{
+				{Start: 256 * 1024, Length: 128 * 1024},
+				{Start: 0, Length: 65536},
+				{Start: 300 * 1024, Length: 200 * 1024},
+			},
+			wantGrains: 5,
+		},
+		{
+			name:     "chunks spanning grain tables",
+			diskSize: 100 * mb,
+			writes: []testutil.Write{
+				{Off: 32*mb - 4096, Data: testutil.Pattern(9, 8192)},
+				{Off: 90 * mb, Data: testutil.Pattern(10, 65536)},
+			},
+			chunks: []params.Chunk{
+				{Start: 32*mb - 65536, Length: 131072},
+				{Start: 90 * mb, Length: 65536},
+			},
+			wantGrains: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			disk := testutil.NewSparseDisk(t, tt.diskSize, append(tt.writes, tt.hidden...)...)
+			var buf bytes.Buffer
+			if err := Write(&buf, disk, tt.diskSize, tt.chunks, zlib.DefaultCompression); err != nil {
+				t.Fatal(err)
+			}
+			img := buf.Bytes()
+			if len(img)%int(SectorSize) != 0 {
+				t.Fatalf("image size %d is not a multiple of the sector size", len(img))
+			}
+
+			var hdr Header
+			readStruct(t, img, 0, &hdr)
+			checkHeader(t, hdr, tt.diskSize)
+			if hdr.GDOffset != GDAtEnd {
+				t.Fatalf("expected the grain directory at the end, got %d", hdr.GDOffset)
+			}
+
+			desc := img[hdr.DescriptorOffset*SectorSize : (hdr.DescriptorOffset+hdr.DescriptorSize)*SectorSize]
+			for _, want := range []string{
+				`createType="streamOptimized"`,
+				fmt.Sprintf("RW %d SPARSE", hdr.Capacity),
+			} {
+				if bytes.Contains(desc, []byte(want)) == false {
+					t.Fatalf("descriptor does not contain %q:\n%s", want, desc)
+				}
+			}
+
+			// The image ends with the footer marker, the footer and the
+			// end of stream marker.
+			sectors := uint64(len(img)) / SectorSize
+			var footerMarker, eos Marker
+			readStruct(t, img, sectors-3, &footerMarker)
+			readStruct(t, img, sectors-1, &eos)
+			if footerMarker.Type != MarkerFooter || footerMarker.NumSectors != 1 || footerMarker.Size != 0 {
+				t.Fatalf("invalid footer marker: %+v", footerMarker)
+			}
+			if eos != (Marker{Type: MarkerEOS}) {
+				t.Fatalf("invalid end of stream marker: %+v", eos)
+			}
+			var footer Header
+			readStruct(t, img, sectors-2, &footer)
+			checkHeader(t, footer, tt.diskSize)
+			if footer.GDOffset == GDAtEnd || footer.GDOffset >= sectors {
+				t.Fatalf("invalid grain directory offset in footer: %d", footer.GDOffset)
+			}
+			withGD := hdr
+			withGD.GDOffset = footer.GDOffset
+			if footer != withGD {
+				t.Fatalf("footer does not match the header:\n%+v\n%+v", footer, hdr)
+			}
+
+			gdEntries := divRoundUp(divRoundUp(hdr.Capacity, GrainSectors), GTEntries)
+			var gdMarker Marker
+			readStruct(t, img, footer.GDOffset-1, &gdMarker)
+			if gdMarker.Type != MarkerGD || gdMarker.NumSectors != divRoundUp(gdEntries*4, SectorSize) {
+				t.Fatalf("invalid grain directory marker: %+v", gdMarker)
+			}
+			gd := make([]uint32, gdEntries)
+			readStruct(t, img, footer.GDOffset, gd)
+
+			var lbas []uint64
+			for gdIdx, gtSector := range gd {
+				if gtSector == 0 {
+					for idx := uint64(0); idx < GTEntries; idx++ {
+						grain := uint64(gdIdx)*GTEntries + idx
+						if bytes.Count(testutil.Contents(tt.writes, grain*GrainSize, GrainSize), []byte{0}) != int(GrainSize) {
+							t.Fatalf("grain %d holds data, but has no grain table", grain)
+						}
+					}
+					continue
+				}
+
+				var gtMarker Marker
+				readStruct(t, img, uint64(gtSector)-1, &gtMarker)
+				if gtMarker.Type != MarkerGT || gtMarker.NumSectors != GTEntries*4/SectorSize {
+					t.Fatalf("invalid grain table marker: %+v", gtMarker)
+				}
+				gt := make([]uint32, GTEntries)
+				readStruct(t, img, uint64(gtSector), gt)
+
+				for idx, grainSector := range gt {
+					grain := uint64(gdIdx)*GTEntries + uint64(idx)
+					want := testutil.Contents(tt.writes, grain*GrainSize, GrainSize)
+					if grainSector == 0 {
+						if bytes.Count(want, []byte{0}) != len(want) {
+							t.Fatalf("grain %d holds data, but is not in the image", grain)
+						}
+						continue
+					}
+
+					lba, data := readGrain(t, img, uint64(grainSector))
+					if lba != grain*GrainSectors {
+						t.Fatalf("expected LBA %d for grain %d, got %d", grain*GrainSectors, grain, lba)
+					}
+					if bytes.Equal(data, want) == false {
+						t.Fatalf("grain %d has unexpected contents", grain)
+					}
+					lbas = append(lbas, lba)
+				}
+			}
+			if len(lbas) != tt.wantGrains {
+				t.Fatalf("expected %d grains, got %d", tt.wantGrains, len(lbas))
+			}
+
+			streamed := walkStream(t, img, hdr)
+			if reflect.DeepEqual(streamed, lbas) == false {
+				t.Fatalf("grains in stream %v do not match grain tables %v", streamed, lbas)
+			}
+		})
+	}
+}
+
+func TestWriteInvalidSize(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, bytes.NewReader(nil), 0, nil, zlib.DefaultCompression); err == nil {
+		t.Fatal("expected an error for an empty disk")
+	}
+}
@@ -4,9 +4,10 @@ go 1.15
 
 require (
 	github.com/BurntSushi/toml v0.3.1
-	github.com/DataDog/zstd v1.4.8 // indirect
+	github.com/DataDog/zstd v1.4.8
 	github.com/Sereal/Sereal v0.0.0-20200820125258-a016b7cda3f3 // indirect
 	github.com/asdine/storm v2.1.2+incompatible
+	github.com/cespare/xxhash/v2 v2.1.1
 	github.com/dbgeek/go-ovm-helper v0.0.0-20180203213650-4a0fa1c4f53c
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/golang/protobuf v1.4.3 // indirect
@@ -17,6 +18,7 @@ require (
 	github.com/hydrogen18/stalecucumber v0.0.0-20180226003526-6de214d141dd
 	github.com/knqyf263/berkeleydb v0.0.0-20190501065933-fafe01fb9662
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.10.0
 	github.com/rancher/go-fibmap v0.0.0-20160418233256-5fc9f8c1ed47
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
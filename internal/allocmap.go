@@ -0,0 +1,133 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	fibmap "github.com/rancher/go-fibmap"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+var (
+	// errAllocationMapUnsupported is returned by an allocation mapper if
+	// the filesystem does not support it.
+	errAllocationMapUnsupported = errors.New("allocation map not supported")
+
+	// allocationMappers are tried in order, until one of them succeeds.
+	allocationMappers = []allocationMapper{
+		fiemapMapper{},
+		seekMapper{},
+	}
+)
+
+// AllocationMap holds the allocated chunks of a file.
+type AllocationMap struct {
+	// Kind is the method used to build the map. One of
+	// params.AllocationMapFiemap or params.AllocationMapSeek.
+	Kind   string
+	Chunks []params.Chunk
+}
+
+// HasPhysicalOffsets returns true if the chunks in the map hold the physical
+// location of the extents on disk.
+func (a AllocationMap) HasPhysicalOffsets() bool {
+	return a.Kind == params.AllocationMapFiemap
+}
+
+// allocationMapper builds the allocation map of a file.
+type allocationMapper interface {
+	// Kind returns the kind of the maps built by this mapper.
+	Kind() string
+	// Map returns the allocated chunks of fd. If the filesystem does not
+	// support this mapper, errAllocationMapUnsupported is returned.
+	Map(fd *os.File) ([]params.Chunk, error)
+}
+
+// fiemapMapper uses the FIEMAP ioctl, which returns both the logical and
+// the physical offsets of every extent.
+type fiemapMapper struct{}
+
+func (f fiemapMapper) Kind() string {
+	return params.AllocationMapFiemap
+}
+
+func (f fiemapMapper) Map(fd *os.File) ([]params.Chunk, error) {
+	extents, err := walkFileExtents(fd)
+	if err != nil {
+		switch errors.Cause(err) {
+		case syscall.EOPNOTSUPP, syscall.ENOTTY:
+			return nil, errAllocationMapUnsupported
+		}
+		return nil, err
+	}
+
+	ret := make([]params.Chunk, len(extents))
+	for idx, ext := range extents {
+		ret[idx] = params.Chunk{
+			Length:    ext.Length,
+			Start:     ext.Logical,
+			Physical:  ext.Physical,
+			Unwritten: ext.Flags&fibmap.FIEMAP_EXTENT_UNWRITTEN != 0,
+			Shared:    ext.Flags&fibmap.FIEMAP_EXTENT_SHARED != 0,
+			Inline:    ext.Flags&fibmap.FIEMAP_EXTENT_DATA_INLINE != 0,
+			Delalloc:  ext.Flags&(fibmap.FIEMAP_EXTENT_DELALLOC|fibmap.FIEMAP_EXTENT_UNKNOWN) != 0,
+		}
+	}
+	return ret, nil
+}
+
+// seekMapper uses SEEK_DATA and SEEK_HOLE. Only the logical ranges
+// that hold data are known.
+type seekMapper struct{}
+
+func (s seekMapper) Kind() string {
+	return params.AllocationMapSeek
+}
+
+func (s seekMapper) Map(fd *os.File) ([]params.Chunk, error) {
+	return dataRanges(fd)
+}
+
+// GetAllocationMap returns the allocation map of filePath. FIEMAP is used if
+// the filesystem supports it. Otherwise, the logical ranges that hold data
+// are fetched using SEEK_DATA and SEEK_HOLE.
+func GetAllocationMap(filePath string) (AllocationMap, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return AllocationMap{}, errors.Wrap(err, "opening file")
+	}
+	defer fd.Close()
+
+	for _, mapper := range allocationMappers {
+		chunks, err := mapper.Map(fd)
+		if err != nil {
+			if err == errAllocationMapUnsupported {
+				continue
+			}
+			return AllocationMap{}, errors.Wrapf(err, "fetching %s allocation map", mapper.Kind())
+		}
+		return AllocationMap{
+			Kind:   mapper.Kind(),
+			Chunks: chunks,
+		}, nil
+	}
+	return AllocationMap{}, errAllocationMapUnsupported
+}
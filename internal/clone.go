@@ -0,0 +1,223 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// CloneBackend creates copy-on-write clones of files residing on
+// a particular filesystem.
+type CloneBackend interface {
+	// Reflink creates a copy-on-write clone of src at dst. The
+	// destination file must not exist.
+	Reflink(src, dst string) error
+}
+
+// CloneBackendFunc is an adapter that allows the use of ordinary
+// functions as a CloneBackend.
+type CloneBackendFunc func(src, dst string) error
+
+// Reflink calls f(src, dst).
+func (f CloneBackendFunc) Reflink(src, dst string) error {
+	return f(src, dst)
+}
+
+// cloneBackends maps a filesystem type, as reported by the ovs-agent
+// repository database, to a clone backend.
+var cloneBackends = map[string]CloneBackend{
+	"ocfs2": CloneBackendFunc(IOctlOCFS2Reflink),
+	"xfs":   CloneBackendFunc(IOctlFIClone),
+	"btrfs": CloneBackendFunc(IOctlFIClone),
+}
+
+// GetCloneBackend returns the clone backend registered for the fsType
+// filesystem.
+func GetCloneBackend(fsType string) (CloneBackend, error) {
+	backend, ok := cloneBackends[strings.ToLower(fsType)]
+	if !ok {
+		return nil, fmt.Errorf("no clone backend for filesystem %q", fsType)
+	}
+	return backend, nil
+}
+
+// reflinkProbe holds the result of probing reflink support of a repository.
+// All fields except mux are protected by reflinkProbesMux.
+type reflinkProbe struct {
+	// mux is held while the repository is probed, so each repository is
+	// probed once at a time, without blocking probes of other ones.
+	mux sync.Mutex
+
+	done      bool
+	supported bool
+	// queued is true while a background probe is pending.
+	queued bool
+}
+
+var (
+	reflinkProbesMux sync.Mutex
+	// reflinkProbes holds the reflink probe of each repository, by
+	// mount point.
+	reflinkProbes = map[string]*reflinkProbe{}
+)
+
+// resetReflinkProbes forgets the reflink support of all repositories, so
+// it is probed again the next time it is needed.
+func resetReflinkProbes() {
+	reflinkProbesMux.Lock()
+	defer reflinkProbesMux.Unlock()
+
+	reflinkProbes = map[string]*reflinkProbe{}
+}
+
+// getReflinkProbe returns the reflink probe of a mount point.
+// reflinkProbesMux must be held.
+func getReflinkProbe(mountPoint string) *reflinkProbe {
+	probe, ok := reflinkProbes[mountPoint]
+	if !ok {
+		probe = &reflinkProbe{}
+		reflinkProbes[mountPoint] = probe
+	}
+	return probe
+}
+
+// probeReflinkInBackground starts probing reflink support of repo, unless
+// it was already probed or a probe is pending. reflinkProbesMux must be held.
+func probeReflinkInBackground(repo Repo, probe *reflinkProbe) {
+	if probe.done || probe.queued {
+		return
+	}
+	probe.queued = true
+	go func() {
+		repo.ProbeReflink()
+
+		reflinkProbesMux.Lock()
+		defer reflinkProbesMux.Unlock()
+		probe.queued = false
+	}()
+}
+
+// probeReposReflink starts probing reflink support of all repos that have
+// a clone backend, in the background.
+func probeReposReflink(repos []Repo) {
+	reflinkProbesMux.Lock()
+	defer reflinkProbesMux.Unlock()
+
+	for _, repo := range repos {
+		if _, err := GetCloneBackend(repo.Filesystem); err != nil {
+			continue
+		}
+		probeReflinkInBackground(repo, getReflinkProbe(repo.MountPoint))
+	}
+}
+
+// SupportsReflink returns true if the repository is known to support reflink
+// copies. It never touches the repository, so it is cheap enough to be used
+// when listing VMs. Repositories that were not probed yet are reported as not
+// supporting reflinks, and are probed in the background.
+func (r *Repo) SupportsReflink() bool {
+	if _, err := GetCloneBackend(r.Filesystem); err != nil {
+		return false
+	}
+
+	reflinkProbesMux.Lock()
+	defer reflinkProbesMux.Unlock()
+
+	probe := getReflinkProbe(r.MountPoint)
+	if probe.done {
+		return probe.supported
+	}
+	probeReflinkInBackground(*r, probe)
+	return false
+}
+
+// ProbeReflink returns true if the repository can hold reflink copies. The
+// filesystem type alone is not enough, as xfs filesystems formatted with
+// reflink=0 do not support them, so support is probed by cloning a small
+// temporary file, if that was not done yet. The result is cached until the
+// inventory is refreshed.
+func (r *Repo) ProbeReflink() bool {
+	backend, err := GetCloneBackend(r.Filesystem)
+	if err != nil {
+		return false
+	}
+	if r.IsMounted() == false {
+		return false
+	}
+
+	reflinkProbesMux.Lock()
+	probe := getReflinkProbe(r.MountPoint)
+	reflinkProbesMux.Unlock()
+
+	probe.mux.Lock()
+	defer probe.mux.Unlock()
+
+	reflinkProbesMux.Lock()
+	done, supported := probe.done, probe.supported
+	reflinkProbesMux.Unlock()
+	if done {
+		return supported
+	}
+
+	supported, err = probeReflink(backend, r.MountPoint)
+	if err != nil {
+		// Probed again next time.
+		log.Printf("failed to probe reflink support of %s: %q", r.MountPoint, err)
+		return false
+	}
+
+	reflinkProbesMux.Lock()
+	probe.done = true
+	probe.supported = supported
+	reflinkProbesMux.Unlock()
+	return supported
+}
+
+// probeReflink clones a temporary file inside dir using backend. An error is
+// returned if the probe could not be made, for example because dir is read
+// only.
+func probeReflink(backend CloneBackend, dir string) (bool, error) {
+	src, err := ioutil.TempFile(dir, ".coriolis-reflink-probe-")
+	if err != nil {
+		return false, errors.Wrap(err, "creating probe file")
+	}
+	defer os.Remove(src.Name())
+
+	// Some filesystems can clone empty files, even without reflink support.
+	_, err = src.Write(make([]byte, 4096))
+	if err == nil {
+		err = src.Sync()
+	}
+	src.Close()
+	if err != nil {
+		return false, errors.Wrap(err, "writing probe file")
+	}
+
+	dst := src.Name() + ".clone"
+	defer os.Remove(dst)
+	if err := backend.Reflink(src.Name(), dst); err != nil {
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,117 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRepo creates a repository inside a temporary folder, using the
+// testfs filesystem.
+func newTestRepo(t *testing.T) Repo {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "repo")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	if err := ioutil.WriteFile(filepath.Join(dir, ".ovsrepo"), nil, 0600); err != nil {
+		t.Fatalf("failed to create repo file: %v", err)
+	}
+	return Repo{MountPoint: dir, Filesystem: "testfs"}
+}
+
+// waitForProbes waits for all background reflink probes to finish.
+func waitForProbes(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var queued bool
+		reflinkProbesMux.Lock()
+		for _, probe := range reflinkProbes {
+			queued = queued || probe.queued
+		}
+		reflinkProbesMux.Unlock()
+		if !queued {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for reflink probes")
+}
+
+func TestReflinkProbes(t *testing.T) {
+	slow := newTestRepo(t)
+	fast := newTestRepo(t)
+
+	var calls int32
+	release := make(chan struct{})
+	cloneBackends["testfs"] = CloneBackendFunc(func(src, dst string) error {
+		atomic.AddInt32(&calls, 1)
+		// The probe of the slow repo blocks until released.
+		if filepath.Dir(src) == slow.MountPoint {
+			<-release
+		}
+		return nil
+	})
+	defer delete(cloneBackends, "testfs")
+	defer resetReflinkProbes()
+
+	// Listings never wait for a probe.
+	if slow.SupportsReflink() {
+		t.Fatalf("expected unprobed repo to not support reflinks")
+	}
+
+	// A slow repo does not block probes of other repos.
+	done := make(chan bool)
+	go func() { done <- fast.ProbeReflink() }()
+	select {
+	case supported := <-done:
+		if !supported {
+			t.Fatalf("expected fast repo to support reflinks")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("probe of fast repo was blocked by slow repo")
+	}
+
+	close(release)
+	if slow.ProbeReflink() == false {
+		t.Fatalf("expected slow repo to support reflinks")
+	}
+	if slow.SupportsReflink() == false || fast.SupportsReflink() == false {
+		t.Fatalf("expected probe results to be cached")
+	}
+	waitForProbes(t)
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("expected each repo to be probed once, got %d probes", got)
+	}
+
+	// Probe files are removed.
+	for _, repo := range []Repo{slow, fast} {
+		files, err := ioutil.ReadDir(repo.MountPoint)
+		if err != nil {
+			t.Fatalf("failed to list repo: %v", err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("expected probe files to be removed from %s, found %d files", repo.MountPoint, len(files))
+		}
+	}
+}
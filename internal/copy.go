@@ -0,0 +1,159 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+const (
+	// SeekData is the lseek whence value that seeks to the next
+	// region of a file holding data.
+	SeekData = 3
+	// SeekHole is the lseek whence value that seeks to the next
+	// hole in a file.
+	SeekHole = 4
+
+	// copyBufferSize is the size of the buffer used when copying
+	// data regions between files.
+	copyBufferSize = 4 * 1024 * 1024
+)
+
+// dataRanges returns the logical ranges of fd that hold data, as reported
+// by SEEK_DATA and SEEK_HOLE. Filesystems that do not track holes report
+// the whole file as data.
+func dataRanges(fd *os.File) ([]params.Chunk, error) {
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching file info")
+	}
+	size := info.Size()
+
+	ret := []params.Chunk{}
+	var offset int64
+	for offset < size {
+		start, err := syscall.Seek(int(fd.Fd()), offset, SeekData)
+		if err != nil {
+			if err == syscall.ENXIO {
+				// No more data past offset.
+				break
+			}
+			return nil, errors.Wrap(err, "seeking data")
+		}
+
+		end, err := syscall.Seek(int(fd.Fd()), start, SeekHole)
+		if err != nil {
+			return nil, errors.Wrap(err, "seeking hole")
+		}
+
+		ret = append(ret, params.Chunk{
+			Start:  uint64(start),
+			Length: uint64(end - start),
+		})
+		offset = end
+	}
+	return ret, nil
+}
+
+func copyRange(ctx context.Context, src, dst *os.File, offset, length int64, buf []byte) error {
+	for length > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		toRead := int64(len(buf))
+		if length < toRead {
+			toRead = length
+		}
+
+		n, err := src.ReadAt(buf[:toRead], offset)
+		if n > 0 {
+			if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+				return errors.Wrap(err, "writing data")
+			}
+			offset += int64(n)
+			length -= int64(n)
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				// The source file was truncated while copying. The
+				// caller expects the whole range to be copied.
+				return errors.Wrapf(io.ErrUnexpectedEOF, "source ends at offset %d", offset)
+			}
+			return errors.Wrap(err, "reading data")
+		}
+	}
+	return nil
+}
+
+// SparseCopy creates a full copy of src at dst, copying only the regions
+// of src that hold data. Holes in src are preserved in dst. The data
+// regions that were copied are returned as a list of chunks. The physical
+// offset of the returned chunks is not set. If ctx is cancelled, the copy
+// is aborted and dst is removed.
+func SparseCopy(ctx context.Context, src, dst string) (chunks []params.Chunk, err error) {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening file")
+	}
+	defer srcFd.Close()
+
+	info, err := srcFd.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching file info")
+	}
+
+	dstFd, err := openCloneDestination(srcFd, dst, os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		dstFd.Close()
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	chunks, err = dataRanges(srcFd)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching data ranges")
+	}
+
+	buf := make([]byte, copyBufferSize)
+	for _, chunk := range chunks {
+		if err := copyRange(ctx, srcFd, dstFd, int64(chunk.Start), int64(chunk.Length), buf); err != nil {
+			return nil, errors.Wrap(err, "copying data")
+		}
+	}
+
+	if err := dstFd.Truncate(info.Size()); err != nil {
+		return nil, errors.Wrap(err, "setting file size")
+	}
+
+	if err := dstFd.Sync(); err != nil {
+		return nil, errors.Wrap(err, "syncing file")
+	}
+	return chunks, nil
+}
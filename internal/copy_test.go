@@ -0,0 +1,89 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package internal
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestCopyRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "copy")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 256)
+	srcPath := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(srcPath, data, 0600); err != nil {
+		t.Fatalf("failed to write source: %v", err)
+	}
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatalf("failed to open source: %v", err)
+	}
+	defer src.Close()
+
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int64
+		wantErr bool
+	}{
+		{name: "whole file", offset: 0, length: int64(len(data))},
+		{name: "inner range", offset: 100, length: 1000},
+		{name: "truncated source", offset: 1024, length: int64(len(data)), wantErr: true},
+		{name: "range past end", offset: int64(len(data)), length: 512, wantErr: true},
+	}
+	// A buffer smaller than the ranges, so they are copied in several reads.
+	buf := make([]byte, 333)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := os.Create(filepath.Join(dir, "dst"))
+			if err != nil {
+				t.Fatalf("failed to create destination: %v", err)
+			}
+			defer dst.Close()
+
+			err = copyRange(context.Background(), src, dst, tt.offset, tt.length, buf)
+			if tt.wantErr {
+				if errors.Cause(err) != io.ErrUnexpectedEOF {
+					t.Fatalf("expected %v, got %v", io.ErrUnexpectedEOF, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make([]byte, tt.length)
+			if _, err := dst.ReadAt(got, tt.offset); err != nil {
+				t.Fatalf("failed to read destination: %v", err)
+			}
+			if bytes.Equal(got, data[tt.offset:tt.offset+tt.length]) == false {
+				t.Fatalf("destination does not match source")
+			}
+		})
+	}
+}
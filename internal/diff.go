@@ -0,0 +1,248 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+const (
+	// ContentDiffBlockSize is the granularity at which the contents
+	// of two files are compared.
+	ContentDiffBlockSize = 1024 * 1024
+)
+
+// mergeRanges returns the sorted union of the logical ranges described
+// by all supplied chunk lists. Overlapping and adjacent ranges are merged.
+// The physical offset of the returned chunks is not set.
+func mergeRanges(chunkLists ...[]params.Chunk) []params.Chunk {
+	var all []params.Chunk
+	for _, chunks := range chunkLists {
+		for _, chunk := range chunks {
+			if chunk.Length == 0 {
+				continue
+			}
+			all = append(all, params.Chunk{
+				Start:  chunk.Start,
+				Length: chunk.Length,
+			})
+		}
+	}
+
+	if len(all) == 0 {
+		return []params.Chunk{}
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Start < all[j].Start
+	})
+
+	ret := []params.Chunk{all[0]}
+	for _, chunk := range all[1:] {
+		last := &ret[len(ret)-1]
+		lastEnd := last.Start + last.Length
+		if chunk.Start > lastEnd {
+			ret = append(ret, chunk)
+			continue
+		}
+		if end := chunk.Start + chunk.Length; end > lastEnd {
+			last.Length = end - last.Start
+		}
+	}
+	return ret
+}
+
+// readBlock reads len(buf) bytes at offset from fd, and returns the number
+// of bytes actually read. Bytes past the end of the file are returned as
+// zeros, which is what a reader of a shorter file would see once it is
+// extended.
+func readBlock(fd *os.File, buf []byte, offset int64) (int, error) {
+	n, err := fd.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return n, err
+	}
+	for i := n; i < len(buf); i++ {
+		buf[i] = 0
+	}
+	return n, nil
+}
+
+// appendRange appends the [start, start+length) logical range to chunks,
+// extending the last chunk if the two are adjacent.
+func appendRange(chunks []params.Chunk, start, length uint64) []params.Chunk {
+	if len(chunks) > 0 {
+		last := &chunks[len(chunks)-1]
+		if last.Start+last.Length == start {
+			last.Length += length
+			return chunks
+		}
+	}
+	return append(chunks, params.Chunk{
+		Start:  start,
+		Length: length,
+	})
+}
+
+// ContentDiff is the result of comparing the contents of two files.
+type ContentDiff struct {
+	// Chunks holds the ranges that differ between the two files.
+	Chunks []params.Chunk
+	// BytesRead is the number of bytes read from both files to
+	// compute the diff.
+	BytesRead uint64
+}
+
+// blockHasher hashes blocks of a file.
+type blockHasher struct {
+	buf  []byte
+	hash hash.Hash
+}
+
+func (b *blockHasher) sum(fd *os.File, offset, length uint64) ([]byte, int, error) {
+	n, err := readBlock(fd, b.buf[:length], int64(offset))
+	if err != nil {
+		return nil, n, err
+	}
+	b.hash.Reset()
+	b.hash.Write(b.buf[:length])
+	return b.hash.Sum(nil), n, nil
+}
+
+// DiffFileContents compares the contents of newPath and oldPath and returns
+// the ranges that differ between them. Only ranges described by newChunks
+// or oldChunks are compared. Everything else is considered to be a hole in
+// both files. Both files are split into blocks of ContentDiffBlockSize, and
+// the SHA-256 checksums of matching blocks are compared, using up to workers
+// blocks in parallel. Returned chunks are clipped to the size of newPath, and
+// do not have a physical offset.
+func DiffFileContents(newPath, oldPath string, newChunks, oldChunks []params.Chunk, workers int) (ContentDiff, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	newFd, err := os.Open(newPath)
+	if err != nil {
+		return ContentDiff{}, errors.Wrap(err, "opening file")
+	}
+	defer newFd.Close()
+
+	oldFd, err := os.Open(oldPath)
+	if err != nil {
+		return ContentDiff{}, errors.Wrap(err, "opening file")
+	}
+	defer oldFd.Close()
+
+	info, err := newFd.Stat()
+	if err != nil {
+		return ContentDiff{}, errors.Wrap(err, "fetching file info")
+	}
+	size := uint64(info.Size())
+
+	var blocks []params.Chunk
+	for _, candidate := range mergeRanges(newChunks, oldChunks) {
+		end := candidate.Start + candidate.Length
+		if end > size {
+			end = size
+		}
+
+		for offset := candidate.Start; offset < end; offset += ContentDiffBlockSize {
+			length := uint64(ContentDiffBlockSize)
+			if offset+length > end {
+				length = end - offset
+			}
+			blocks = append(blocks, params.Chunk{
+				Start:  offset,
+				Length: length,
+			})
+		}
+	}
+
+	var bytesRead uint64
+	var failed int32
+	changed := make([]bool, len(blocks))
+	errs := make(chan error, workers)
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newHasher := &blockHasher{buf: make([]byte, ContentDiffBlockSize), hash: sha256.New()}
+			oldHasher := &blockHasher{buf: make([]byte, ContentDiffBlockSize), hash: sha256.New()}
+			// Workers keep draining indexes after an error, so the
+			// producer never blocks. Each worker sends at most one error.
+			for idx := range indexes {
+				if atomic.LoadInt32(&failed) == 1 {
+					continue
+				}
+				block := blocks[idx]
+				newSum, n, err := newHasher.sum(newFd, block.Start, block.Length)
+				atomic.AddUint64(&bytesRead, uint64(n))
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+					errs <- errors.Wrap(err, "reading file")
+					continue
+				}
+				oldSum, n, err := oldHasher.sum(oldFd, block.Start, block.Length)
+				atomic.AddUint64(&bytesRead, uint64(n))
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+					errs <- errors.Wrap(err, "reading file")
+					continue
+				}
+				changed[idx] = !bytes.Equal(newSum, oldSum)
+			}
+		}()
+	}
+
+	for idx := range blocks {
+		if atomic.LoadInt32(&failed) == 1 {
+			break
+		}
+		indexes <- idx
+	}
+	close(indexes)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return ContentDiff{}, err
+	}
+
+	ret := ContentDiff{
+		Chunks:    []params.Chunk{},
+		BytesRead: bytesRead,
+	}
+	for idx, block := range blocks {
+		if changed[idx] {
+			ret.Chunks = appendRange(ret.Chunks, block.Start, block.Length)
+		}
+	}
+	return ret, nil
+}
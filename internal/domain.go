@@ -0,0 +1,118 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DomainController controls the state of the Xen domain of a VM. On
+// Oracle VM, the name of the domain is the name of the VM.
+type DomainController interface {
+	// IsRunning returns true if the domain exists, and false if it does
+	// not. An error is returned if the state of the domain could not be
+	// determined.
+	IsRunning(ctx context.Context, name string) (bool, error)
+	// Pause pauses all virtual CPUs of the domain.
+	Pause(ctx context.Context, name string) error
+	// Unpause resumes a paused domain.
+	Unpause(ctx context.Context, name string) error
+	// Shutdown asks the guest to shut down cleanly, and waits for
+	// the domain to stop.
+	Shutdown(ctx context.Context, name string) error
+}
+
+// NewXLDomainController returns a DomainController that uses the xl
+// toolstack found at xlPath. Shutdown gives up after shutdownTimeout.
+func NewXLDomainController(xlPath string, shutdownTimeout time.Duration) DomainController {
+	return &xlDomainController{
+		xlPath:          xlPath,
+		shutdownTimeout: shutdownTimeout,
+	}
+}
+
+type xlDomainController struct {
+	xlPath          string
+	shutdownTimeout time.Duration
+}
+
+// output runs xl with the given arguments, and returns its combined
+// stdout and stderr.
+func (x *xlDomainController) output(ctx context.Context, args ...string) (string, error) {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, x.xlPath, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := cmd.Run()
+	out := strings.TrimSpace(output.String())
+	if err != nil {
+		msg := fmt.Sprintf("running xl %s", strings.Join(args, " "))
+		if out != "" {
+			msg = fmt.Sprintf("%s (%s)", msg, out)
+		}
+		return out, errors.Wrap(err, msg)
+	}
+	return out, nil
+}
+
+func (x *xlDomainController) run(ctx context.Context, args ...string) error {
+	_, err := x.output(ctx, args...)
+	return err
+}
+
+func (x *xlDomainController) IsRunning(ctx context.Context, name string) (bool, error) {
+	out, err := x.output(ctx, "domid", name)
+	if err == nil {
+		return true, nil
+	}
+	// xl says the domain does not exist, and exits with a non zero code,
+	// if there is no domain with this name. Any other failure means we
+	// can not tell whether the domain is running.
+	if _, ok := errors.Cause(err).(*exec.ExitError); ok && ctx.Err() == nil &&
+		strings.Contains(out, "does not exist") {
+		return false, nil
+	}
+	return false, err
+}
+
+func (x *xlDomainController) Pause(ctx context.Context, name string) error {
+	return x.run(ctx, "pause", name)
+}
+
+func (x *xlDomainController) Unpause(ctx context.Context, name string) error {
+	return x.run(ctx, "unpause", name)
+}
+
+func (x *xlDomainController) Shutdown(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, x.shutdownTimeout)
+	defer cancel()
+
+	if err := x.run(ctx, "shutdown", "-w", name); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out waiting for domain %s to shut down", name)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestXLIsRunning(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		wantRunning bool
+		wantErr     bool
+	}{
+		{
+			name:        "running",
+			script:      "echo 12",
+			wantRunning: true,
+		},
+		{
+			name:        "domain does not exist",
+			script:      "echo \"Can't get domid of domain name 'vm', maybe this domain does not exist.\" >&2; exit 1",
+			wantRunning: false,
+		},
+		{
+			name:    "other failure",
+			script:  "echo 'cannot init xl context' >&2; exit 1",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			xlPath := filepath.Join(t.TempDir(), "xl")
+			if err := ioutil.WriteFile(xlPath, []byte("#!/bin/sh\n"+tt.script+"\n"), 0700); err != nil {
+				t.Fatal(err)
+			}
+
+			running, err := NewXLDomainController(xlPath, time.Second).IsRunning(context.Background(), "vm")
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error: %v, got %v", tt.wantErr, err)
+			}
+			if running != tt.wantRunning {
+				t.Fatalf("expected running: %v, got %v", tt.wantRunning, running)
+			}
+		})
+	}
+}
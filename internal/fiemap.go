@@ -18,9 +18,12 @@ package internal
 
 import (
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	fibmap "github.com/rancher/go-fibmap"
+
+	"coriolis-ovm-exporter/metrics"
 )
 
 const (
@@ -44,6 +47,9 @@ func walkFiemap(fd fibmap.FibmapFile) ([]fibmap.Extent, error) {
 			break
 		}
 		ret = append(ret, extents...)
+		if extents[len(extents)-1].Flags&fibmap.FIEMAP_EXTENT_LAST != 0 {
+			break
+		}
 	}
 	return ret, nil
 }
@@ -55,7 +61,20 @@ func GetExtents(filename string) ([]fibmap.Extent, error) {
 		return nil, errors.Wrap(err, "opening file")
 	}
 	defer fd.Close()
+	return walkFileExtents(fd)
+}
+
+// walkFileExtents returns the extents allocated to fd, and records
+// fiemap metrics.
+func walkFileExtents(fd *os.File) ([]fibmap.Extent, error) {
 	fmFile := fibmap.NewFibmapFile(fd)
 
-	return walkFiemap(fmFile)
+	start := time.Now()
+	extents, err := walkFiemap(fmFile)
+	if err != nil {
+		return nil, err
+	}
+	metrics.FiemapDuration.Observe(time.Since(start).Seconds())
+	metrics.FiemapExtents.Observe(float64(len(extents)))
+	return extents, nil
 }
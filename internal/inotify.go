@@ -0,0 +1,118 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// dirWatchMask are the inotify events that signal a change to
+	// a folder or to any file inside it.
+	dirWatchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+		syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+		syscall.IN_ATTRIB | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+)
+
+// dirWatcher uses inotify to detect changes inside a set of folders.
+type dirWatcher struct {
+	fd int
+
+	mux sync.Mutex
+	// watches maps watched folders to their watch descriptor.
+	watches map[string]int
+
+	changed int32
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing inotify")
+	}
+
+	w := &dirWatcher{
+		fd:      fd,
+		watches: map[string]int{},
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// Changed returns true if anything changed in the watched folders since
+// the last call.
+func (w *dirWatcher) Changed() bool {
+	return atomic.SwapInt32(&w.changed, 0) == 1
+}
+
+// SetDirs replaces the set of watched folders with dirs. Folders that can
+// not be watched are skipped.
+func (w *dirWatcher) SetDirs(dirs []string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	wanted := map[string]bool{}
+	for _, dir := range dirs {
+		wanted[dir] = true
+		if _, ok := w.watches[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, dirWatchMask)
+		if err != nil {
+			continue
+		}
+		w.watches[dir] = wd
+	}
+
+	for dir, wd := range w.watches {
+		if wanted[dir] {
+			continue
+		}
+		syscall.InotifyRmWatch(w.fd, uint32(wd))
+		delete(w.watches, dir)
+	}
+}
+
+func (w *dirWatcher) readEvents() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			// Changes are still detected by checking modification times.
+			log.Printf("failed to read inotify events: %q", err)
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			// IN_IGNORED is sent when we remove a watch ourselves.
+			if event.Mask&syscall.IN_IGNORED == 0 {
+				atomic.StoreInt32(&w.changed, 1)
+			}
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+		}
+	}
+}
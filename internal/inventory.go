@@ -0,0 +1,223 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package internal
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// inventoryCheckInterval is the minimum interval between two checks
+	// of the modification times of the files the inventory was read from.
+	// Repositories are shared between all nodes in a server pool, and
+	// inotify does not report changes made by other nodes, so we always
+	// need to check modification times. Local changes are picked up
+	// immediately through inotify.
+	inventoryCheckInterval = 2 * time.Second
+)
+
+// inventory is the default inventory used by ListAllVMs, GetVM and
+// VMConfig.Disks.
+var inventory = &Inventory{}
+
+// RefreshInventory reloads the repository and VM inventory from disk.
+func RefreshInventory() error {
+	return inventory.Refresh()
+}
+
+// Inventory caches the repositories configured on this node, their metadata
+// and the configs of all VMs stored on them. The cache is reloaded when the
+// modification time of any file it was read from changes.
+type Inventory struct {
+	mux sync.Mutex
+
+	loaded    bool
+	lastCheck time.Time
+
+	repos []Repo
+	// meta holds the metadata of each repo, by mount point.
+	meta map[string]map[string]RepoMetaItem
+	vms  []VMConfig
+
+	// stamps holds the modification time of every file and folder the
+	// inventory was read from. A zero value means the path did not exist.
+	stamps map[string]time.Time
+
+	watcher      *dirWatcher
+	watcherSetup bool
+}
+
+// Refresh unconditionally reloads the inventory. Reflink support of all
+// repositories is probed again, in the background.
+func (i *Inventory) Refresh() error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	resetReflinkProbes()
+
+	return i.load()
+}
+
+// Repos returns the cached list of repositories, and their metadata, keyed
+// by repository mount point.
+func (i *Inventory) Repos() ([]Repo, map[string]map[string]RepoMetaItem, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if err := i.ensureFresh(); err != nil {
+		return nil, nil, err
+	}
+
+	repos := make([]Repo, len(i.repos))
+	copy(repos, i.repos)
+	return repos, i.meta, nil
+}
+
+// VMs returns the cached list of VM configs from all repositories.
+func (i *Inventory) VMs() ([]VMConfig, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	if err := i.ensureFresh(); err != nil {
+		return nil, err
+	}
+
+	vms := make([]VMConfig, len(i.vms))
+	copy(vms, i.vms)
+	return vms, nil
+}
+
+func (i *Inventory) ensureFresh() error {
+	if i.loaded && i.isStale() == false {
+		return nil
+	}
+	return i.load()
+}
+
+func (i *Inventory) isStale() bool {
+	if i.watcher != nil && i.watcher.Changed() {
+		return true
+	}
+
+	now := time.Now()
+	if now.Sub(i.lastCheck) < inventoryCheckInterval {
+		return false
+	}
+	i.lastCheck = now
+
+	for path, mtime := range i.stamps {
+		if modTime(path) != mtime {
+			return true
+		}
+	}
+	return false
+}
+
+// modTime returns the modification time of path, or a zero value if
+// path can not be accessed.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (i *Inventory) load() error {
+	i.loaded = false
+
+	// Record modification times before reading anything. If a file
+	// changes while we read it, the next check will reload it.
+	stamps := map[string]time.Time{}
+	stamp := func(path string) {
+		stamps[path] = modTime(path)
+	}
+
+	stamp(filepath.Join(DatabaseDir, RepositoryDB))
+	repos, err := ParseRepos()
+	if err != nil {
+		return errors.Wrap(err, "fetching repos")
+	}
+
+	meta := map[string]map[string]RepoMetaItem{}
+	var vms []VMConfig
+	for _, repo := range repos {
+		stamp(filepath.Join(repo.MountPoint, ".ovsmeta"))
+		vmDir := filepath.Join(repo.MountPoint, VirtualMachinesDir)
+		stamp(vmDir)
+		cfgFiles, _ := filepath.Glob(filepath.Join(vmDir, "*", "vm.cfg"))
+		for _, cfgFile := range cfgFiles {
+			stamp(cfgFile)
+		}
+
+		// Not all repos have metadata. Disks on those repos are
+		// matched by path prefix.
+		if repoMeta, err := repo.Meta(); err == nil {
+			meta[repo.MountPoint] = repoMeta
+		}
+
+		repoVMs, err := ListVMs(repo)
+		if err != nil {
+			return errors.Wrap(err, "listing vms in repo")
+		}
+		vms = append(vms, repoVMs...)
+	}
+
+	i.repos = repos
+	i.meta = meta
+	i.vms = vms
+	i.stamps = stamps
+	i.lastCheck = time.Now()
+	i.loaded = true
+
+	i.updateWatches(repos)
+	probeReposReflink(repos)
+	return nil
+}
+
+// updateWatches sets up inotify watches on all folders holding files the
+// inventory is read from.
+func (i *Inventory) updateWatches(repos []Repo) {
+	if i.watcherSetup == false {
+		i.watcherSetup = true
+		watcher, err := newDirWatcher()
+		if err != nil {
+			log.Printf("inotify is not available, inventory changes will be detected by polling: %q", err)
+			return
+		}
+		i.watcher = watcher
+	}
+
+	if i.watcher == nil {
+		return
+	}
+
+	dirs := []string{DatabaseDir}
+	for _, repo := range repos {
+		vmDir := filepath.Join(repo.MountPoint, VirtualMachinesDir)
+		dirs = append(dirs, repo.MountPoint, vmDir)
+		vmSubDirs, _ := filepath.Glob(filepath.Join(vmDir, "*"))
+		dirs = append(dirs, vmSubDirs...)
+	}
+	i.watcher.SetDirs(dirs)
+}
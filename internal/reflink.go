@@ -30,9 +30,25 @@ type reflinkArgs struct {
 	Preserve uint64
 }
 
+// fileCloneRange mirrors struct file_clone_range from linux/fs.h
+type fileCloneRange struct {
+	SrcFd      int64
+	SrcOffset  uint64
+	SrcLength  uint64
+	DestOffset uint64
+}
+
 const (
 	// OCFS2IOCReflink is the OCFS2 ioctl for creating a cow file
 	OCFS2IOCReflink = 1075343108
+
+	// FICLONE is the generic ioctl for sharing all extents of a file
+	// with another file. Supported by XFS (with reflink=1) and btrfs.
+	FICLONE = 0x40049409
+
+	// FICLONERANGE is the generic ioctl for sharing a range of extents
+	// of a file with another file.
+	FICLONERANGE = 0x4020940d
 )
 
 // IOctlOCFS2Reflink creates a reflinked copy (copy-on-write) on an OCFS2
@@ -49,9 +65,88 @@ func IOctlOCFS2Reflink(src, dst string) error {
 	if err != nil {
 		return errors.Wrap(err, "opening file")
 	}
+	defer fd.Close()
 
 	if _, _, err := syscall.Syscall(syscall.SYS_IOCTL, fd.Fd(), OCFS2IOCReflink, uintptr(unsafe.Pointer(&params))); err != 0 {
 		return errors.Wrap(err, "running ioctl")
 	}
 	return nil
 }
+
+// openCloneDestination creates dst with the same mode and ownership as src.
+func openCloneDestination(src *os.File, dst string, flags int) (*os.File, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching file info")
+	}
+
+	dstFd, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|flags, info.Mode().Perm())
+	if err != nil {
+		return nil, errors.Wrap(err, "creating destination file")
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		if err := dstFd.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+			dstFd.Close()
+			return nil, errors.Wrap(err, "setting destination file owner")
+		}
+	}
+	return dstFd, nil
+}
+
+// IOctlFIClone creates a reflinked copy (copy-on-write) of src using the
+// generic FICLONE ioctl. The destination file must not exist.
+func IOctlFIClone(src, dst string) (err error) {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "opening file")
+	}
+	defer srcFd.Close()
+
+	dstFd, err := openCloneDestination(srcFd, dst, os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		dstFd.Close()
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dstFd.Fd(), FICLONE, srcFd.Fd()); errno != 0 {
+		return errors.Wrap(errno, "running ioctl")
+	}
+	return nil
+}
+
+// IOctlFICloneRange shares length bytes starting at srcOffset in src with
+// dst, at dstOffset, using the generic FICLONERANGE ioctl. A length of 0
+// clones everything from srcOffset to the end of src. The destination file
+// is created if it does not exist. Offsets and length must be aligned to
+// the filesystem block size.
+func IOctlFICloneRange(src, dst string, srcOffset, length, dstOffset uint64) error {
+	srcFd, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "opening file")
+	}
+	defer srcFd.Close()
+
+	dstFd, err := openCloneDestination(srcFd, dst, 0)
+	if err != nil {
+		return err
+	}
+	defer dstFd.Close()
+
+	params := fileCloneRange{
+		SrcFd:      int64(srcFd.Fd()),
+		SrcOffset:  srcOffset,
+		SrcLength:  length,
+		DestOffset: dstOffset,
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dstFd.Fd(), FICLONERANGE, uintptr(unsafe.Pointer(&params))); errno != 0 {
+		return errors.Wrap(errno, "running ioctl")
+	}
+	return nil
+}
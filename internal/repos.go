@@ -54,6 +54,19 @@ type Repo struct {
 	FSLocation  string `pickle:"fs_location"`
 }
 
+// IsMounted returns true if the repository file system is mounted
+// and accessible.
+func (r *Repo) IsMounted() bool {
+	if r.MountPoint == "" {
+		return false
+	}
+
+	if _, err := os.Stat(filepath.Join(r.MountPoint, ".ovsrepo")); err != nil {
+		return false
+	}
+	return true
+}
+
 // RepoMetaItem holds one item of repository metadata
 type RepoMetaItem struct {
 	ObjectType string `json:"OBJECT_TYPE"`
@@ -39,6 +39,27 @@ type DiskSnapshot struct {
 	Path       string
 	ParentPath string
 	Chunks     []params.Chunk
+	// FullCopy indicates that this disk snapshot is a full copy
+	// of the parent disk, rather than a reflink.
+	FullCopy bool
+	// AllocationMap is the kind of allocation map used to fetch Chunks.
+	AllocationMap string
+}
+
+// mapExtents fetches the allocation map of a reflinked disk snapshot. The
+// chunks of full copies are already known.
+func (d *DiskSnapshot) mapExtents(opts SnapshotOptions) error {
+	if d.FullCopy == false {
+		opts.progress(d.Name, params.DiskStageMapping)
+		allocMap, err := GetAllocationMap(d.Path)
+		if err != nil {
+			return errors.Wrap(err, "fetching allocation map")
+		}
+		d.Chunks = allocMap.Chunks
+		d.AllocationMap = allocMap.Kind
+	}
+	opts.progress(d.Name, params.DiskStageCompleted)
+	return nil
 }
 
 // DeleteSnapshot deletes files associated with this disk snapshot.
@@ -53,7 +74,7 @@ func (d DiskSnapshot) DeleteSnapshot() error {
 	}
 
 	diskSnap := filepath.Join(snapshotDir, d.Name)
-	if err := os.Remove(diskSnap); err != nil {
+	if err := os.Remove(diskSnap); err != nil && os.IsNotExist(err) == false {
 		return errors.Wrap(err, "removing snapshot")
 	}
 
@@ -64,9 +85,9 @@ func (d DiskSnapshot) DeleteSnapshot() error {
 
 	if len(contents) == 0 {
 		// There are no more snapshots in this folder.
-		// Cleanup empty snapshot dir.
-		// TODO: This might cause a race condition. Investigate
-		// if we need to add some locking for remove operations.
+		// Cleanup empty snapshot dir. The snapshot dir only holds
+		// disks of this snapshot, and callers hold the snapshot lock,
+		// so nothing else is created in it meanwhile.
 		os.RemoveAll(snapshotDir)
 	}
 	return nil
@@ -90,3 +111,42 @@ func (s Snapshot) Delete() error {
 
 	return nil
 }
+
+// ListSnapshotDirs returns the contents of the snapshot folder of a
+// repository, as a map of snapshot IDs to the paths of the files found
+// in the folder of each snapshot.
+func ListSnapshotDirs(repo Repo) (map[string][]string, error) {
+	ret := map[string][]string{}
+
+	baseDir := filepath.Join(repo.MountPoint, SnapshotDir)
+	if _, err := os.Stat(baseDir); err != nil {
+		if os.IsNotExist(err) {
+			return ret, nil
+		}
+		return nil, errors.Wrap(err, "accessing snapshot dir")
+	}
+
+	snapDirs, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing snapshot dir")
+	}
+
+	for _, snapDir := range snapDirs {
+		if snapDir.IsDir() == false {
+			continue
+		}
+
+		snapDirPath := filepath.Join(baseDir, snapDir.Name())
+		contents, err := ioutil.ReadDir(snapDirPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "listing snapshot dir")
+		}
+
+		files := make([]string, len(contents))
+		for idx, item := range contents {
+			files[idx] = filepath.Join(snapDirPath, item.Name())
+		}
+		ret[snapDir.Name()] = files
+	}
+	return ret, nil
+}
@@ -17,78 +17,43 @@
 package internal
 
 import (
-	"github.com/pkg/errors"
-
 	"coriolis-ovm-exporter/apiserver/params"
 )
 
-func getFileExtents(filePath string) ([]params.Chunk, error) {
-	extents, err := GetExtents(filePath)
-	if err != nil {
-		return nil, errors.Wrap(err, "fetching fiemap")
-	}
-
-	if len(extents) == 0 {
-		// This is a thinly provisioned disk, with nothing written
-		// inside it.
-		return []params.Chunk{}, nil
-	}
-
-	ret := make([]params.Chunk, len(extents))
-
-	for idx, ext := range extents {
-		ret[idx] = params.Chunk{
-			Length:   ext.Length,
-			Start:    ext.Logical,
-			Physical: ext.Physical,
-		}
-	}
-	return ret, nil
-}
-
-// SquashChunks squashes continuous chunks into one chunk.
+// SquashChunks squashes continuous chunks into one chunk. Chunks
+// with different extent flags are not squashed.
 func SquashChunks(chunks []params.Chunk) []params.Chunk {
 	if chunks == nil || len(chunks) == 0 {
 		return []params.Chunk{}
 	}
 
-	tmpLogical := chunks[0].Start
-	tmpPhysical := chunks[0].Physical
-	tmpLength := chunks[0].Length
+	tmp := chunks[0]
+	tmp.Checksum = ""
 
 	var squashed []params.Chunk
 
 	for i := 1; i < len(chunks); i++ {
-		if (tmpLogical + tmpLength) == chunks[i].Start {
-			tmpLength += chunks[i].Length
+		if (tmp.Start+tmp.Length) == chunks[i].Start && tmp.SameFlags(chunks[i]) {
+			tmp.Length += chunks[i].Length
 			continue
 		}
 
-		squashed = append(squashed, params.Chunk{
-			Start:    tmpLogical,
-			Length:   tmpLength,
-			Physical: tmpPhysical,
-		})
-		tmpLogical = chunks[i].Start
-		tmpPhysical = chunks[i].Physical
-		tmpLength = chunks[i].Length
+		squashed = append(squashed, tmp)
+		tmp = chunks[i]
+		tmp.Checksum = ""
 	}
 
-	squashed = append(squashed, params.Chunk{
-		Start:    tmpLogical,
-		Length:   tmpLength,
-		Physical: tmpPhysical,
-	})
+	squashed = append(squashed, tmp)
 
 	return squashed
 }
 
 func getSquashedFileExtents(filePath string) ([]params.Chunk, error) {
-	chunks, err := getFileExtents(filePath)
+	allocMap, err := GetAllocationMap(filePath)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return SquashChunks(chunks), nil
+	return SquashChunks(allocMap.Chunks), nil
 }
@@ -18,16 +18,20 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 
+	"coriolis-ovm-exporter/apiserver/params"
 	gErrors "coriolis-ovm-exporter/errors"
 )
 
@@ -35,8 +39,16 @@ const (
 	// VirtualMachinesDir is the directory where VM config files
 	// are stored.
 	VirtualMachinesDir = "VirtualMachines"
+
+	// unpauseAttempts is the number of times we try to unpause a
+	// domain after its disks were cloned.
+	unpauseAttempts = 5
 )
 
+// unpauseRetryInterval is the time we wait between attempts to unpause
+// a domain.
+var unpauseRetryInterval = 2 * time.Second
+
 // Disk represents one VM disk
 type Disk struct {
 	Name       string
@@ -47,24 +59,117 @@ type Disk struct {
 	ObjectType string
 }
 
+// SnapshotOptions holds options that control how a VM snapshot
+// is created.
+type SnapshotOptions struct {
+	// Consistency is the consistency mode of the snapshot. One of
+	// params.ConsistencyCrash (default), params.ConsistencyPause or
+	// params.ConsistencyShutdown.
+	Consistency string
+	// Domains is used to pause or shut down the VM, when required by
+	// the consistency mode.
+	Domains DomainController
+	// FullCopy allows disks that reside on repositories without
+	// reflink support to be snapshotted by creating a full, sparse
+	// copy of the disk.
+	FullCopy bool
+	// FullCopyRepos is a list of repository IDs on which disks that
+	// can not be reflinked are always snapshotted by creating a full
+	// copy, regardless of the value of FullCopy.
+	FullCopyRepos []string
+	// SnapshotID is the ID of the new snapshot. A new ID is generated
+	// if empty.
+	SnapshotID string
+	// Progress, if set, is called every time a disk advances to a new
+	// stage of the snapshot process.
+	Progress func(disk, stage string)
+}
+
+func (s SnapshotOptions) progress(disk, stage string) {
+	if s.Progress != nil {
+		s.Progress(disk, stage)
+	}
+}
+
+// allowsFullCopy returns true if the options allow a full copy
+// of a disk residing on repo.
+func (s SnapshotOptions) allowsFullCopy(repo Repo) bool {
+	if s.FullCopy {
+		return true
+	}
+
+	for _, repoID := range s.FullCopyRepos {
+		if repoID == repo.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// isVirtualDisk returns true if the disk is a virtual disk, as opposed
+// to an ISO or some other object type.
+func (d Disk) isVirtualDisk() bool {
+	return d.ObjectType == "" || d.ObjectType == "VIRTUAL_DISK"
+}
+
 // CanClone returns a boolean value indicating whether or not
-// this disk can be reflinked.
+// this disk can be reflinked. It uses the cached reflink support of
+// the repository, and never waits for it to be probed.
 func (d Disk) CanClone() bool {
-	if d.Repo.Filesystem != "ocfs2" {
+	if d.isVirtualDisk() == false {
 		return false
 	}
 
-	if d.ObjectType != "" && d.ObjectType != "VIRTUAL_DISK" {
+	return d.Repo.SupportsReflink()
+}
+
+// probeCanClone is like CanClone, but probes reflink support of the
+// repository if it is not known yet.
+func (d Disk) probeCanClone() bool {
+	if d.isVirtualDisk() == false {
 		return false
 	}
 
-	return true
+	return d.Repo.ProbeReflink()
+}
+
+// CanCopy returns a boolean value indicating whether or not
+// a full copy of this disk can be created inside its repository.
+func (d Disk) CanCopy() bool {
+	if d.Repo.MountPoint == "" {
+		return false
+	}
+
+	return d.isVirtualDisk()
 }
 
 // CreateSnapshot creates a reflink copy of a virtual disk and returns
-// a DiskSnapshot object.
-func (d Disk) CreateSnapshot(snapID string) (snap DiskSnapshot, err error) {
-	if d.CanClone() == false {
+// a DiskSnapshot object. If the disk can not be reflinked and opts allow
+// it, a full sparse copy of the disk is created instead.
+func (d Disk) CreateSnapshot(ctx context.Context, snapID string, opts SnapshotOptions) (DiskSnapshot, error) {
+	snap, err := d.cloneSnapshot(ctx, snapID, opts)
+	if err != nil {
+		return DiskSnapshot{}, err
+	}
+	if err := snap.mapExtents(opts); err != nil {
+		snap.DeleteSnapshot()
+		return DiskSnapshot{}, err
+	}
+	return snap, nil
+}
+
+// SnapshotPath returns the path of the snapshot of this disk, for the
+// snapshot snapID.
+func (d Disk) SnapshotPath(snapID string) string {
+	return filepath.Join(d.Repo.MountPoint, SnapshotDir, snapID, d.Name)
+}
+
+// cloneSnapshot creates a reflink copy, or a full sparse copy, of the disk.
+// The extents of full copies are found while copying. The extents of reflink
+// copies must be fetched using mapExtents.
+func (d Disk) cloneSnapshot(ctx context.Context, snapID string, opts SnapshotOptions) (snap DiskSnapshot, err error) {
+	canClone := d.probeCanClone()
+	if canClone == false && (opts.allowsFullCopy(d.Repo) == false || d.CanCopy() == false) {
 		return DiskSnapshot{}, gErrors.NewBadRequestError("repository of %s does not support reflink cloning", d.Name)
 	}
 
@@ -77,7 +182,7 @@ func (d Disk) CreateSnapshot(snapID string) (snap DiskSnapshot, err error) {
 			return DiskSnapshot{}, fmt.Errorf("failed to create %s", snapshotDir)
 		}
 	}
-	snapFile := filepath.Join(snapshotDir, d.Name)
+	snapFile := d.SnapshotPath(snapID)
 
 	defer func() {
 		if err != nil {
@@ -95,26 +200,42 @@ func (d Disk) CreateSnapshot(snapID string) (snap DiskSnapshot, err error) {
 		}
 	}()
 
-	if err := IOctlOCFS2Reflink(d.Path, snapFile); err != nil {
-		return DiskSnapshot{}, errors.Wrap(err, "creating reflink")
-	}
-
-	chunks, err := getFileExtents(snapFile)
-	if err != nil {
-		return DiskSnapshot{}, err
-	}
-
 	snap = DiskSnapshot{
 		Name:       d.Name,
 		Repo:       d.Repo.MountPoint,
 		SnapshotID: snapID,
-		Chunks:     chunks,
 		Path:       snapFile,
 		ParentPath: d.Path,
+		FullCopy:   !canClone,
+	}
+
+	opts.progress(d.Name, params.DiskStageCloning)
+	if canClone {
+		err = d.reflink(snapFile)
+	} else {
+		// The data ranges of a full copy are found using SEEK_DATA.
+		snap.AllocationMap = params.AllocationMapSeek
+		snap.Chunks, err = SparseCopy(ctx, d.Path, snapFile)
+	}
+	if err != nil {
+		return DiskSnapshot{}, err
 	}
 	return snap, nil
 }
 
+// reflink creates a reflink copy of the disk at snapFile.
+func (d Disk) reflink(snapFile string) error {
+	backend, err := GetCloneBackend(d.Repo.Filesystem)
+	if err != nil {
+		return errors.Wrap(err, "fetching clone backend")
+	}
+
+	if err := backend.Reflink(d.Path, snapFile); err != nil {
+		return errors.Wrap(err, "creating reflink")
+	}
+	return nil
+}
+
 // VMConfig is a stripped down VM config, containing only
 // the fields we care about.
 type VMConfig struct {
@@ -130,10 +251,15 @@ type VMConfig struct {
 }
 
 // CreateSnapshot creates a new snapshot and returns the ID of the snapshot.
-func (v VMConfig) CreateSnapshot(shutdownVM bool) (snapshot Snapshot, err error) {
-	snapID := uuid.NewString()
+// If ctx is cancelled before all disks are snapshotted, the disk snapshots
+// created so far are removed.
+func (v VMConfig) CreateSnapshot(ctx context.Context, opts SnapshotOptions) (snapshot Snapshot, err error) {
+	snapID := opts.SnapshotID
+	if snapID == "" {
+		snapID = uuid.NewString()
+	}
 
-	if v.CanClone() == false {
+	if v.CanSnapshot(opts) == false {
 		err = gErrors.NewBadRequestError("VM does not support reflink cloning")
 		return
 	}
@@ -153,14 +279,18 @@ func (v VMConfig) CreateSnapshot(shutdownVM bool) (snapshot Snapshot, err error)
 		}
 	}()
 
-	for _, disk := range disks {
-		var snap DiskSnapshot
-		snap, err = disk.CreateSnapshot(snapID)
-		if err != nil {
+	// Only cloning the disks needs to happen while the VM is paused.
+	// Extents are fetched once it was resumed.
+	snapDisks, err = v.cloneQuiesced(ctx, disks, snapID, opts)
+	if err != nil {
+		return
+	}
+
+	for idx := range snapDisks {
+		if err = snapDisks[idx].mapExtents(opts); err != nil {
 			err = errors.Wrap(err, "creating disk snapshot")
 			return
 		}
-		snapDisks = append(snapDisks, snap)
 	}
 
 	snapshot.Disks = snapDisks
@@ -170,6 +300,101 @@ func (v VMConfig) CreateSnapshot(shutdownVM bool) (snapshot Snapshot, err error)
 	return
 }
 
+// cloneDisks clones all disks. The disk snapshots created so far are
+// returned, even if an error occurs.
+func (v VMConfig) cloneDisks(ctx context.Context, disks []Disk, snapID string, opts SnapshotOptions) ([]DiskSnapshot, error) {
+	var ret []DiskSnapshot
+	for _, disk := range disks {
+		if err := ctx.Err(); err != nil {
+			return ret, errors.Wrap(err, "creating disk snapshot")
+		}
+
+		snap, err := disk.cloneSnapshot(ctx, snapID, opts)
+		if err != nil {
+			return ret, errors.Wrap(err, "creating disk snapshot")
+		}
+		ret = append(ret, snap)
+	}
+	return ret, nil
+}
+
+// cloneQuiesced clones all disks while the domain of the VM is quiesced, as
+// required by the consistency mode in opts. A paused domain is resumed, even
+// if cloning fails. The disk snapshots created so far are returned, even if
+// an error occurs.
+func (v VMConfig) cloneQuiesced(ctx context.Context, disks []Disk, snapID string, opts SnapshotOptions) ([]DiskSnapshot, error) {
+	resume, err := v.quiesce(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	snapDisks, err := v.cloneDisks(ctx, disks, snapID, opts)
+	if resumeErr := resume(); resumeErr != nil {
+		// A domain left paused needs attention, so this is logged
+		// even if cloning failed as well.
+		log.Printf("failed to resume domain %s: %q", v.Name, resumeErr)
+		if err == nil {
+			err = resumeErr
+		}
+	}
+	return snapDisks, err
+}
+
+// quiesce prepares the domain of the VM for a snapshot, as required by the
+// consistency mode in opts. With params.ConsistencyPause, the domain is paused
+// until the returned function is called. With params.ConsistencyShutdown, the
+// domain is shut down, and left stopped. Stopped VMs are left untouched.
+func (v VMConfig) quiesce(ctx context.Context, opts SnapshotOptions) (func() error, error) {
+	noop := func() error { return nil }
+
+	switch opts.Consistency {
+	case "", params.ConsistencyCrash:
+		return noop, nil
+	case params.ConsistencyPause, params.ConsistencyShutdown:
+	default:
+		return nil, gErrors.NewBadRequestError("invalid consistency mode %q", opts.Consistency)
+	}
+
+	if opts.Domains == nil {
+		return nil, fmt.Errorf("no domain controller available")
+	}
+
+	running, err := opts.Domains.IsRunning(ctx, v.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking domain state")
+	}
+	if running == false {
+		// The disks of a stopped VM are already consistent.
+		return noop, nil
+	}
+
+	if opts.Consistency == params.ConsistencyShutdown {
+		if err := opts.Domains.Shutdown(ctx, v.Name); err != nil {
+			return nil, errors.Wrap(err, "shutting down domain")
+		}
+		return noop, nil
+	}
+
+	if err := opts.Domains.Pause(ctx, v.Name); err != nil {
+		return nil, errors.Wrap(err, "pausing domain")
+	}
+	return func() error {
+		// The domain must be resumed, even if ctx was cancelled, so
+		// we retry a few times before giving up.
+		var err error
+		for attempt := 1; attempt <= unpauseAttempts; attempt++ {
+			if err = opts.Domains.Unpause(context.Background(), v.Name); err == nil {
+				return nil
+			}
+			log.Printf("failed to unpause domain %s (attempt %d of %d): %q", v.Name, attempt, unpauseAttempts, err)
+			if attempt < unpauseAttempts {
+				time.Sleep(unpauseRetryInterval)
+			}
+		}
+		return errors.Wrapf(err, "unpausing domain after %d attempts", unpauseAttempts)
+	}, nil
+}
+
 // CanClone returns true if all disks attached to this instance are
 // cloneable.
 func (v VMConfig) CanClone() bool {
@@ -187,12 +412,33 @@ func (v VMConfig) CanClone() bool {
 	return true
 }
 
+// CanSnapshot returns true if all disks attached to this instance
+// are cloneable, or can be fully copied as allowed by opts.
+func (v VMConfig) CanSnapshot(opts SnapshotOptions) bool {
+	disks, err := v.Disks()
+	if err != nil {
+		return false
+	}
+
+	for _, disk := range disks {
+		if disk.probeCanClone() {
+			continue
+		}
+		if opts.allowsFullCopy(disk.Repo) && disk.CanCopy() {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
 // Disks returns an array of Disk objects, representing the
 // disks attached to a VM.
 func (v VMConfig) Disks() ([]Disk, error) {
 	var ret []Disk
 
-	repos, err := ParseRepos()
+	repos, reposMeta, err := inventory.Repos()
 	if err != nil {
 		return ret, err
 	}
@@ -218,8 +464,7 @@ func (v VMConfig) Disks() ([]Disk, error) {
 		}
 
 		for _, repo := range repos {
-			meta, err := repo.Meta()
-			if err == nil {
+			if meta, ok := reposMeta[repo.MountPoint]; ok {
 				if diskMeta, ok := meta[dsk.Name]; ok {
 					dsk.ObjectType = diskMeta.ObjectType
 					dsk.Repo = repo
@@ -288,23 +533,13 @@ func ParseVMConfig(cfgFile string) (VMConfig, error) {
 }
 
 // ListAllVMs returns a list of VMConfig from all currently known
-// repositories.
+// repositories. The list is served from the inventory cache.
 func ListAllVMs() ([]VMConfig, error) {
-	repos, err := ParseRepos()
+	vms, err := inventory.VMs()
 	if err != nil {
-		return nil, errors.Wrap(err, "fetching repos")
+		return nil, errors.Wrap(err, "fetching VM inventory")
 	}
-
-	var ret []VMConfig
-
-	for _, repo := range repos {
-		vms, err := ListVMs(repo)
-		if err != nil {
-			return nil, errors.Wrap(err, "listing vms in repo")
-		}
-		ret = append(ret, vms...)
-	}
-	return ret, nil
+	return vms, nil
 }
 
 // ListVMs returns a list of VMConfig from a repository.
@@ -0,0 +1,232 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package internal
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	gErrors "coriolis-ovm-exporter/errors"
+)
+
+// fakeDomains is a DomainController that records the calls made to it.
+type fakeDomains struct {
+	running      bool
+	isRunningErr error
+	pauseErr     error
+	shutdownErr  error
+	// unpauseFailures is the number of times Unpause fails before it
+	// succeeds.
+	unpauseFailures int
+
+	calls []string
+}
+
+func (f *fakeDomains) IsRunning(ctx context.Context, name string) (bool, error) {
+	f.calls = append(f.calls, "is-running")
+	return f.running, f.isRunningErr
+}
+
+func (f *fakeDomains) Pause(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "pause")
+	return f.pauseErr
+}
+
+func (f *fakeDomains) Unpause(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "unpause")
+	if f.unpauseFailures > 0 {
+		f.unpauseFailures--
+		return fmt.Errorf("unpause failed")
+	}
+	return nil
+}
+
+func (f *fakeDomains) Shutdown(ctx context.Context, name string) error {
+	f.calls = append(f.calls, "shutdown")
+	return f.shutdownErr
+}
+
+func TestCloneQuiesced(t *testing.T) {
+	defer func(interval time.Duration) { unpauseRetryInterval = interval }(unpauseRetryInterval)
+	unpauseRetryInterval = 0
+
+	tests := []struct {
+		name        string
+		consistency string
+		domains     *fakeDomains
+		// cloneFails makes the disk fail to clone.
+		cloneFails bool
+		wantCalls  []string
+		wantErr    string
+	}{
+		{
+			name:        "crash consistency",
+			consistency: params.ConsistencyCrash,
+			domains:     &fakeDomains{running: true},
+			wantCalls:   []string{"clone"},
+		},
+		{
+			name:        "pause",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true},
+			wantCalls:   []string{"is-running", "pause", "clone", "unpause"},
+		},
+		{
+			name:        "unpause after clone failure",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true},
+			cloneFails:  true,
+			wantCalls:   []string{"is-running", "pause", "unpause"},
+			wantErr:     "does not support reflink cloning",
+		},
+		{
+			name:        "unpause is retried",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true, unpauseFailures: 2},
+			wantCalls:   []string{"is-running", "pause", "clone", "unpause", "unpause", "unpause"},
+		},
+		{
+			name:        "unpause failure",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true, unpauseFailures: unpauseAttempts},
+			wantCalls:   []string{"is-running", "pause", "clone", "unpause", "unpause", "unpause", "unpause", "unpause"},
+			wantErr:     "unpausing domain after 5 attempts: unpause failed",
+		},
+		{
+			name:        "unpause failure after clone failure",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true, unpauseFailures: unpauseAttempts},
+			cloneFails:  true,
+			wantCalls:   []string{"is-running", "pause", "unpause", "unpause", "unpause", "unpause", "unpause"},
+			wantErr:     "does not support reflink cloning",
+		},
+		{
+			name:        "pause failure",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: true, pauseErr: fmt.Errorf("pause failed")},
+			wantCalls:   []string{"is-running", "pause"},
+			wantErr:     "pausing domain: pause failed",
+		},
+		{
+			name:        "stopped VM with pause",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{running: false},
+			wantCalls:   []string{"is-running", "clone"},
+		},
+		{
+			name:        "stopped VM with shutdown",
+			consistency: params.ConsistencyShutdown,
+			domains:     &fakeDomains{running: false},
+			wantCalls:   []string{"is-running", "clone"},
+		},
+		{
+			name:        "unknown domain state",
+			consistency: params.ConsistencyPause,
+			domains:     &fakeDomains{isRunningErr: fmt.Errorf("xl failed")},
+			wantCalls:   []string{"is-running"},
+			wantErr:     "checking domain state: xl failed",
+		},
+		{
+			name:        "shutdown",
+			consistency: params.ConsistencyShutdown,
+			domains:     &fakeDomains{running: true},
+			wantCalls:   []string{"is-running", "shutdown", "clone"},
+		},
+		{
+			name:        "shutdown failure",
+			consistency: params.ConsistencyShutdown,
+			domains:     &fakeDomains{running: true, shutdownErr: fmt.Errorf("timed out")},
+			wantCalls:   []string{"is-running", "shutdown"},
+			wantErr:     "shutting down domain: timed out",
+		},
+		{
+			name:        "invalid mode",
+			consistency: "freeze",
+			domains:     &fakeDomains{running: true},
+			wantCalls:   nil,
+			wantErr:     `invalid consistency mode "freeze"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			disk := Disk{
+				Name: "disk.img",
+				Path: filepath.Join(dir, "disk.img"),
+				Repo: Repo{MountPoint: dir},
+			}
+			if err := ioutil.WriteFile(disk.Path, []byte("data"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cloneFails {
+				// Disks outside of a repository can not be copied.
+				disk.Repo = Repo{}
+			}
+
+			opts := SnapshotOptions{
+				Consistency: tt.consistency,
+				Domains:     tt.domains,
+				FullCopy:    true,
+				Progress: func(disk, stage string) {
+					if stage == params.DiskStageCloning {
+						tt.domains.calls = append(tt.domains.calls, "clone")
+					}
+				},
+			}
+
+			vm := VMConfig{Name: "vm"}
+			snaps, err := vm.cloneQuiesced(context.Background(), []Disk{disk}, "snap", opts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || strings.Contains(err.Error(), tt.wantErr) == false) {
+				t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+			}
+			if err == nil && len(snaps) != 1 {
+				t.Fatalf("expected one disk snapshot, got %d", len(snaps))
+			}
+			if reflect.DeepEqual(tt.domains.calls, tt.wantCalls) == false {
+				t.Fatalf("expected calls %v, got %v", tt.wantCalls, tt.domains.calls)
+			}
+		})
+	}
+}
+
+func TestCloneQuiescedInvalidMode(t *testing.T) {
+	vm := VMConfig{Name: "vm"}
+	_, err := vm.cloneQuiesced(context.Background(), nil, "snap", SnapshotOptions{Consistency: "freeze"})
+	if _, ok := errors.Cause(err).(*gErrors.BadRequestError); !ok {
+		t.Fatalf("expected a bad request error, got %v", err)
+	}
+}
+
+func TestCloneQuiescedNoDomainController(t *testing.T) {
+	vm := VMConfig{Name: "vm"}
+	_, err := vm.cloneQuiesced(context.Background(), nil, "snap", SnapshotOptions{Consistency: params.ConsistencyPause})
+	if err == nil {
+		t.Fatal("expected an error without a domain controller")
+	}
+}
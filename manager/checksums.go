@@ -0,0 +1,192 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	gErrors "coriolis-ovm-exporter/errors"
+)
+
+const (
+	// ChecksumSHA256 computes SHA-256 checksums.
+	ChecksumSHA256 = "sha256"
+	// ChecksumXXHash computes 64 bit xxHash checksums. It is a lot
+	// faster than SHA-256, but is not a cryptographic hash.
+	ChecksumXXHash = "xxhash"
+)
+
+// NewChecksumHash returns a new hash.Hash for the given checksum algorithm.
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, gErrors.NewBadRequestError("invalid checksum algorithm %q", algorithm)
+	}
+}
+
+func checksumKey(chunk params.Chunk) string {
+	return fmt.Sprintf("%d:%d", chunk.Start, chunk.Length)
+}
+
+// hashRange returns the hex encoded checksum of a range of fp, using buf to
+// read it. The algorithm must be valid.
+func hashRange(fp *os.File, chunk params.Chunk, algorithm string, buf []byte) (string, error) {
+	h, err := NewChecksumHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	section := io.NewSectionReader(fp, int64(chunk.Start), int64(chunk.Length))
+	if _, err := io.CopyBuffer(h, section, buf); err != nil {
+		return "", errors.Wrapf(err, "reading chunk at offset %d", chunk.Start)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// RangeChecksum returns the checksum of a single range of a snapshotted disk.
+// The cached checksum is used if the range is a chunk that was returned along
+// with its checksum before. Any other range is read and hashed, but its checksum
+// is not cached, so clients requesting arbitrary ranges do not grow the database.
+func (s *SnapshotManager) RangeChecksum(snapID string, disk params.DiskSnapshot, algorithm string, chunk params.Chunk) (string, error) {
+	if _, err := NewChecksumHash(algorithm); err != nil {
+		return "", err
+	}
+
+	sum, err := s.db.GetChunkChecksum(snapID, disk.Name, algorithm, chunk.Start, chunk.Length)
+	if err != nil {
+		return "", errors.Wrap(err, "fetching cached checksum")
+	}
+	if sum != "" {
+		return sum, nil
+	}
+
+	fp, err := os.Open(disk.Path)
+	if err != nil {
+		return "", errors.Wrap(err, "opening disk")
+	}
+	defer fp.Close()
+
+	return hashRange(fp, chunk, algorithm, make([]byte, 1024*1024))
+}
+
+// ChunkChecksums returns the checksums of the given chunks of a snapshotted
+// disk. Checksums are computed on demand and cached in the database, one record
+// per chunk, so only chunks that were never requested before are read. Only
+// chunks returned by the snapshot API should be passed in, as every one of them
+// is cached. Chunks that extend past the end of the disk only cover the data up
+// to the end of the disk, which is what a Range request for that chunk returns.
+func (s *SnapshotManager) ChunkChecksums(snapID string, disk params.DiskSnapshot, algorithm string, chunks []params.Chunk) ([]string, error) {
+	if _, err := NewChecksumHash(algorithm); err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(chunks))
+	// seen holds the checksums of the chunks handled so far, as the same
+	// chunk may be requested more than once.
+	seen := map[string]string{}
+	var computed []db.ChunkChecksum
+	var fp *os.File
+	defer func() {
+		if fp != nil {
+			fp.Close()
+		}
+	}()
+
+	buf := make([]byte, 1024*1024)
+	for idx, chunk := range chunks {
+		key := checksumKey(chunk)
+		if sum, ok := seen[key]; ok {
+			ret[idx] = sum
+			continue
+		}
+
+		sum, err := s.db.GetChunkChecksum(snapID, disk.Name, algorithm, chunk.Start, chunk.Length)
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching cached checksum")
+		}
+		if sum != "" {
+			ret[idx] = sum
+			seen[key] = sum
+			continue
+		}
+
+		if fp == nil {
+			fp, err = os.Open(disk.Path)
+			if err != nil {
+				return nil, errors.Wrap(err, "opening disk")
+			}
+		}
+
+		ret[idx], err = hashRange(fp, chunk, algorithm, buf)
+		if err != nil {
+			return nil, err
+		}
+		seen[key] = ret[idx]
+		computed = append(computed, db.ChunkChecksum{
+			SnapshotID: snapID,
+			Disk:       disk.Name,
+			Algorithm:  algorithm,
+			Start:      chunk.Start,
+			Length:     chunk.Length,
+			Checksum:   ret[idx],
+		})
+	}
+
+	if len(computed) == 0 {
+		return ret, nil
+	}
+	if err := s.db.SaveChunkChecksums(computed); err != nil {
+		return nil, errors.Wrap(err, "caching checksums")
+	}
+	return ret, nil
+}
+
+// WithChunkChecksums sets the checksum of every chunk of every disk in
+// snapshot, using the given algorithm.
+func (s *SnapshotManager) WithChunkChecksums(snapshot params.VMSnapshot, algorithm string) (params.VMSnapshot, error) {
+	disks := make([]params.DiskSnapshot, len(snapshot.Disks))
+	for idx, disk := range snapshot.Disks {
+		sums, err := s.ChunkChecksums(snapshot.ID, disk, algorithm, disk.Chunks)
+		if err != nil {
+			return params.VMSnapshot{}, errors.Wrapf(err, "computing checksums of %s", disk.Name)
+		}
+
+		chunks := make([]params.Chunk, len(disk.Chunks))
+		for chunkIdx, chunk := range disk.Chunks {
+			chunks[chunkIdx] = chunk
+			chunks[chunkIdx].Checksum = sums[chunkIdx]
+		}
+		disks[idx] = disk
+		disks[idx].Chunks = chunks
+		disks[idx].ChecksumAlgorithm = algorithm
+	}
+	snapshot.Disks = disks
+	return snapshot, nil
+}
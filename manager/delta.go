@@ -0,0 +1,59 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/formats/delta"
+)
+
+// GetDiskDelta returns the header of a delta holding the chunks of disk diskID
+// that changed between snapshots compareTo and snapID, along with the path to
+// the snapshotted disk. If compareTo is empty, the delta holds all allocated
+// chunks of the disk. diffMode is the same as for GetSnapshot. No data is read,
+// as checksums are computed when the delta is written.
+func (s *SnapshotManager) GetDiskDelta(vmID, snapID, diskID, compareTo, diffMode string) (delta.Header, string, error) {
+	snap, err := s.getSnapshot(vmID, snapID)
+	if err != nil {
+		return delta.Header{}, "", errors.Wrap(err, "fetching snapshot")
+	}
+
+	disk, err := s.GetSnapshotDisk(vmID, snapID, diskID, compareTo, diffMode)
+	if err != nil {
+		return delta.Header{}, "", err
+	}
+
+	info, err := os.Stat(disk.Path)
+	if err != nil {
+		return delta.Header{}, "", errors.Wrap(err, "fetching disk info")
+	}
+
+	// A delta with no base snapshot is applied onto an empty file,
+	// where unwritten chunks already read as zeros.
+	return delta.Header{
+		VMID:              vmID,
+		SnapshotID:        snapID,
+		BaseSnapshotID:    compareTo,
+		DiskName:          disk.Name,
+		DiskSize:          uint64(info.Size()),
+		SnapshotCreatedAt: snap.CreatedAt,
+		Chunks:            delta.Chunks(uint64(info.Size()), disk.Chunks, compareTo == ""),
+	}, disk.Path, nil
+}
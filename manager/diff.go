@@ -0,0 +1,205 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"sort"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+func sortedChunks(chunks []params.Chunk) []params.Chunk {
+	ret := make([]params.Chunk, len(chunks))
+	copy(ret, chunks)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Start < ret[j].Start
+	})
+	return ret
+}
+
+// sameMapping returns true if logical offsets covered by both a and b map
+// to the same physical offsets. Extents with no reliable physical offset
+// never map to the same blocks. An unwritten extent that was written to
+// keeps its physical offset, so the unwritten flags must also match.
+func sameMapping(a, b params.Chunk) bool {
+	if a.Delalloc || b.Delalloc || a.Inline || b.Inline {
+		return false
+	}
+	return a.Physical-a.Start == b.Physical-b.Start && a.Unwritten == b.Unwritten
+}
+
+// appendChanged appends the logical range [start, end) of chunk to ret.
+// The range is merged with the last chunk in ret if they are adjacent both
+// logically and physically, and have the same extent flags.
+func appendChanged(ret []params.Chunk, chunk params.Chunk, start, end uint64) []params.Chunk {
+	if end <= start {
+		return ret
+	}
+	changed := params.Chunk{
+		Start:     start,
+		Length:    end - start,
+		Physical:  chunk.Physical + (start - chunk.Start),
+		Unwritten: chunk.Unwritten,
+		Shared:    chunk.Shared,
+		Inline:    chunk.Inline,
+		Delalloc:  chunk.Delalloc,
+	}
+	if len(ret) > 0 {
+		last := &ret[len(ret)-1]
+		if last.Start+last.Length == start && last.Physical+last.Length == changed.Physical && last.SameFlags(changed) {
+			last.Length += changed.Length
+			return ret
+		}
+	}
+	return append(ret, changed)
+}
+
+// appendRemoved appends the logical range [start, end) to ret, as an unwritten
+// chunk with no physical offset. The range is merged with the last chunk in
+// ret if they are adjacent.
+func appendRemoved(ret []params.Chunk, start, end uint64) []params.Chunk {
+	if end <= start {
+		return ret
+	}
+	if len(ret) > 0 {
+		last := &ret[len(ret)-1]
+		if last.Start+last.Length == start {
+			last.Length += end - start
+			return ret
+		}
+	}
+	return append(ret, params.Chunk{
+		Start:     start,
+		Length:    end - start,
+		Unwritten: true,
+	})
+}
+
+// removedRanges returns the logical ranges of oldSorted that are not covered
+// by any extent in newSorted. Both lists must be sorted by logical offset.
+func removedRanges(newSorted, oldSorted []params.Chunk) []params.Chunk {
+	var ret []params.Chunk
+	var newIdx int
+	for _, old := range oldSorted {
+		start := old.Start
+		end := old.Start + old.Length
+
+		for newIdx < len(newSorted) && newSorted[newIdx].Start+newSorted[newIdx].Length <= start {
+			newIdx++
+		}
+
+		cursor := start
+		for idx := newIdx; idx < len(newSorted) && newSorted[idx].Start < end; idx++ {
+			chunk := newSorted[idx]
+			ret = appendRemoved(ret, cursor, chunk.Start)
+			if chunkEnd := chunk.Start + chunk.Length; chunkEnd > cursor {
+				cursor = chunkEnd
+			}
+		}
+		ret = appendRemoved(ret, cursor, end)
+	}
+	return ret
+}
+
+// diffChunks returns the logical ranges that do not map to the same physical
+// blocks in newChunks and oldChunks. Ranges of newChunks are returned with
+// the flags and physical offsets of the new extents. Ranges that were only
+// allocated in oldChunks are now holes, and are returned as unwritten chunks,
+// so that they read as zeros. Extents that were split or merged by the
+// filesystem, but still point to the same physical blocks, are not reported.
+// Both lists are expected to hold non overlapping extents, as returned by
+// FIEMAP. The returned ranges are sorted by logical offset.
+func diffChunks(newChunks, oldChunks []params.Chunk) []params.Chunk {
+	newSorted := sortedChunks(newChunks)
+	oldSorted := sortedChunks(oldChunks)
+
+	var changed []params.Chunk
+	var oldIdx int
+	for _, chunk := range newSorted {
+		start := chunk.Start
+		end := chunk.Start + chunk.Length
+
+		// Skip old extents that end before this one starts. The new
+		// extents are sorted, so they will not be needed again.
+		for oldIdx < len(oldSorted) && oldSorted[oldIdx].Start+oldSorted[oldIdx].Length <= start {
+			oldIdx++
+		}
+
+		cursor := start
+		for idx := oldIdx; idx < len(oldSorted) && oldSorted[idx].Start < end; idx++ {
+			old := oldSorted[idx]
+			if sameMapping(chunk, old) == false {
+				continue
+			}
+
+			overlapStart := old.Start
+			if overlapStart < cursor {
+				overlapStart = cursor
+			}
+			overlapEnd := old.Start + old.Length
+			if overlapEnd > end {
+				overlapEnd = end
+			}
+			if overlapEnd <= overlapStart {
+				continue
+			}
+
+			// Everything between the cursor and the start of the
+			// unchanged range has changed.
+			changed = appendChanged(changed, chunk, cursor, overlapStart)
+			cursor = overlapEnd
+		}
+		changed = appendChanged(changed, chunk, cursor, end)
+	}
+
+	// Changed and removed ranges never overlap, as removed ranges are
+	// not covered by any new extent.
+	removed := removedRanges(newSorted, oldSorted)
+	if len(removed) == 0 {
+		return changed
+	}
+	ret := make([]params.Chunk, 0, len(changed)+len(removed))
+	for len(changed) > 0 || len(removed) > 0 {
+		if len(removed) == 0 || (len(changed) > 0 && changed[0].Start < removed[0].Start) {
+			ret = append(ret, changed[0])
+			changed = changed[1:]
+			continue
+		}
+		ret = append(ret, removed[0])
+		removed = removed[1:]
+	}
+	return ret
+}
+
+// allocationMapKind returns the kind of allocation map used to fetch the
+// chunks of disk. Disk snapshots recorded without it were mapped using
+// FIEMAP, unless they are full copies.
+func allocationMapKind(disk params.DiskSnapshot) string {
+	if disk.AllocationMap != "" {
+		return disk.AllocationMap
+	}
+	if disk.FullCopy {
+		return params.AllocationMapSeek
+	}
+	return params.AllocationMapFiemap
+}
+
+// hasPhysicalOffsets returns true if the chunks of disk hold the physical
+// location of its extents.
+func hasPhysicalOffsets(disk params.DiskSnapshot) bool {
+	return disk.FullCopy == false && allocationMapKind(disk) == params.AllocationMapFiemap
+}
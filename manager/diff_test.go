@@ -0,0 +1,205 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"reflect"
+	"testing"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+func TestDiffChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		newChunks []params.Chunk
+		oldChunks []params.Chunk
+		want      []params.Chunk
+	}{
+		{
+			name:      "unchanged",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      nil,
+		},
+		{
+			name: "split",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 40, Physical: 1000},
+				{Start: 40, Length: 60, Physical: 1040},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      nil,
+		},
+		{
+			name:      "merged",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			oldChunks: []params.Chunk{
+				{Start: 0, Length: 40, Physical: 1000},
+				{Start: 40, Length: 60, Physical: 1040},
+			},
+			want: nil,
+		},
+		{
+			name:      "moved",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 5000}},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 0, Length: 100, Physical: 5000}},
+		},
+		{
+			name:      "shifted logical offset",
+			newChunks: []params.Chunk{{Start: 10, Length: 100, Physical: 1000}},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want: []params.Chunk{
+				{Start: 0, Length: 10, Unwritten: true},
+				{Start: 10, Length: 100, Physical: 1000},
+			},
+		},
+		{
+			name:      "grown",
+			newChunks: []params.Chunk{{Start: 0, Length: 150, Physical: 1000}},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 100, Length: 50, Physical: 1100}},
+		},
+		{
+			name: "partially overwritten",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 30, Physical: 1000},
+				{Start: 30, Length: 20, Physical: 5000},
+				{Start: 50, Length: 50, Physical: 1050},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 30, Length: 20, Physical: 5000}},
+		},
+		{
+			name:      "overwritten in the middle of a new extent",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			oldChunks: []params.Chunk{
+				{Start: 0, Length: 30, Physical: 1000},
+				{Start: 30, Length: 20, Physical: 5000},
+				{Start: 50, Length: 50, Physical: 1050},
+			},
+			want: []params.Chunk{{Start: 30, Length: 20, Physical: 1030}},
+		},
+		{
+			name: "new extents",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 100, Physical: 1000},
+				{Start: 200, Length: 100, Physical: 3000},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 200, Length: 100, Physical: 3000}},
+		},
+		{
+			name: "adjacent changes are merged",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 50, Physical: 5000},
+				{Start: 50, Length: 50, Physical: 5050},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 0, Length: 100, Physical: 5000}},
+		},
+		{
+			name: "adjacent changes with different flags are not merged",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 50, Physical: 5000},
+				{Start: 50, Length: 50, Physical: 5050, Unwritten: true},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want: []params.Chunk{
+				{Start: 0, Length: 50, Physical: 5000},
+				{Start: 50, Length: 50, Physical: 5050, Unwritten: true},
+			},
+		},
+		{
+			name: "unsorted input",
+			newChunks: []params.Chunk{
+				{Start: 50, Length: 50, Physical: 1050},
+				{Start: 0, Length: 50, Physical: 7000},
+			},
+			oldChunks: []params.Chunk{
+				{Start: 50, Length: 50, Physical: 1050},
+				{Start: 0, Length: 50, Physical: 1000},
+			},
+			want: []params.Chunk{{Start: 0, Length: 50, Physical: 7000}},
+		},
+		{
+			name:      "no old extents",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+		},
+		{
+			name:      "everything removed",
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 0, Length: 100, Unwritten: true}},
+		},
+		{
+			name:      "shrunk",
+			newChunks: []params.Chunk{{Start: 0, Length: 50, Physical: 1000}},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 50, Length: 50, Unwritten: true}},
+		},
+		{
+			name: "hole punched",
+			newChunks: []params.Chunk{
+				{Start: 0, Length: 30, Physical: 1000},
+				{Start: 70, Length: 30, Physical: 1070},
+			},
+			oldChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}},
+			want:      []params.Chunk{{Start: 30, Length: 40, Unwritten: true}},
+		},
+		{
+			name: "adjacent removed extents are merged",
+			oldChunks: []params.Chunk{
+				{Start: 0, Length: 50, Physical: 1000},
+				{Start: 50, Length: 50, Physical: 9000},
+			},
+			want: []params.Chunk{{Start: 0, Length: 100, Unwritten: true}},
+		},
+		{
+			name: "removed and new extents",
+			newChunks: []params.Chunk{
+				{Start: 200, Length: 100, Physical: 3000},
+				{Start: 0, Length: 50, Physical: 1000},
+			},
+			oldChunks: []params.Chunk{
+				{Start: 0, Length: 100, Physical: 1000},
+				{Start: 400, Length: 100, Physical: 4000},
+			},
+			want: []params.Chunk{
+				{Start: 50, Length: 50, Unwritten: true},
+				{Start: 200, Length: 100, Physical: 3000},
+				{Start: 400, Length: 100, Unwritten: true},
+			},
+		},
+		{
+			name:      "removed range replaced by a new extent",
+			newChunks: []params.Chunk{{Start: 0, Length: 100, Physical: 5000}},
+			oldChunks: []params.Chunk{{Start: 20, Length: 50, Physical: 1020}},
+			want:      []params.Chunk{{Start: 0, Length: 100, Physical: 5000}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := diffChunks(tc.newChunks, tc.oldChunks)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("diffChunks() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
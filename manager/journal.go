@@ -0,0 +1,194 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"log"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	"coriolis-ovm-exporter/internal"
+)
+
+// rollbackJournal removes the disk snapshots of a snapshot that could not
+// be created, and then its journal. If the disk snapshots can not be removed,
+// the journal is kept in the rolling back state, and removal is retried when
+// the exporter starts.
+func (s *SnapshotManager) rollbackJournal(journal db.SnapshotJournal) error {
+	journal.State = db.JournalRollingBack
+	journal, err := s.db.UpdateJournal(journal)
+	if err != nil {
+		return errors.Wrap(err, "updating snapshot journal")
+	}
+
+	if err := s.dbSnapToInternalSnap(journal.Snapshot).Delete(); err != nil {
+		return errors.Wrap(err, "removing disk snapshots")
+	}
+
+	if err := s.db.DeleteJournal(journal.ID); err != nil {
+		return errors.Wrap(err, "removing snapshot journal")
+	}
+	return nil
+}
+
+// completeJournal saves a snapshot whose disks were all created, and marks
+// any interrupted task that was creating it as completed.
+func (s *SnapshotManager) completeJournal(journal db.SnapshotJournal) error {
+	if _, err := s.db.CommitJournal(journal); err != nil {
+		return errors.Wrap(err, "saving snapshot")
+	}
+	if err := s.db.DeleteJournal(journal.ID); err != nil {
+		return errors.Wrap(err, "removing snapshot journal")
+	}
+
+	tasks, err := s.db.ListTasksByState(params.TaskStatePending, params.TaskStateRunning)
+	if err != nil {
+		return errors.Wrap(err, "listing tasks")
+	}
+	for _, task := range tasks {
+		if task.SnapshotID != journal.ID {
+			continue
+		}
+		task.State = params.TaskStateCompleted
+		for idx := range task.Disks {
+			task.Disks[idx].Stage = params.DiskStageCompleted
+		}
+		if _, err := s.db.UpdateTask(task); err != nil {
+			return errors.Wrapf(err, "updating task %s", task.ID)
+		}
+	}
+	return nil
+}
+
+// diskSnapshotsExist returns true if the files of all disks of snap exist.
+func diskSnapshotsExist(snap db.Snapshot) bool {
+	for _, disk := range snap.Disks {
+		if _, err := os.Stat(disk.Path); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// reposMounted returns true if the repositories of all disks of snap are
+// mounted. Disks outside of a repository are ignored.
+func reposMounted(snap db.Snapshot) bool {
+	for _, disk := range snap.Disks {
+		if disk.Repo == "" {
+			continue
+		}
+		repo := internal.Repo{MountPoint: disk.Repo}
+		if repo.IsMounted() == false {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverJournals completes or rolls back snapshots that were being created
+// when the exporter stopped. Snapshots whose disks were all created are saved.
+// Any other snapshot is rolled back. Journals of snapshots with disks on
+// repositories that are not mounted are left untouched, as we can not tell if
+// their disks exist, and are retried by retryDeferredJournals.
+func (s *SnapshotManager) recoverJournals() error {
+	journals, err := s.db.ListJournals()
+	if err != nil {
+		return errors.Wrap(err, "listing snapshot journals")
+	}
+
+	for _, journal := range journals {
+		if err := s.recoverJournal(journal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverJournal completes or rolls back a single interrupted snapshot, or
+// defers it if its repositories are not mounted.
+func (s *SnapshotManager) recoverJournal(journal db.SnapshotJournal) error {
+	if journal.State != db.JournalCommitted && reposMounted(journal.Snapshot) == false {
+		if s.deferredJournals[journal.ID] == false {
+			log.Printf("repositories of interrupted snapshot %s of VM %s are not mounted, retrying later",
+				journal.ID, journal.Snapshot.VMID)
+			s.deferredJournals[journal.ID] = true
+		}
+		return nil
+	}
+	delete(s.deferredJournals, journal.ID)
+
+	switch journal.State {
+	case db.JournalCommitted:
+		// The snapshot was saved along with the journal state.
+		if err := s.db.DeleteJournal(journal.ID); err != nil {
+			return errors.Wrapf(err, "removing journal of snapshot %s", journal.ID)
+		}
+		return nil
+	case db.JournalDisksCreated:
+		if diskSnapshotsExist(journal.Snapshot) {
+			log.Printf("completing interrupted snapshot %s of VM %s", journal.ID, journal.Snapshot.VMID)
+			if err := s.completeJournal(journal); err != nil {
+				return errors.Wrapf(err, "completing snapshot %s", journal.ID)
+			}
+			return nil
+		}
+	}
+
+	log.Printf("rolling back interrupted snapshot %s of VM %s", journal.ID, journal.Snapshot.VMID)
+	if err := s.rollbackJournal(journal); err != nil {
+		// Keep going. This is retried on the next start.
+		log.Printf("failed to roll back snapshot %s: %q", journal.ID, err)
+	}
+	return nil
+}
+
+// retryDeferredJournals recovers the interrupted snapshots that were left
+// untouched when the exporter started, because their repositories were not
+// mounted.
+func (s *SnapshotManager) retryDeferredJournals() {
+	if len(s.deferredJournals) == 0 {
+		return
+	}
+
+	s.opsMux.RLock()
+	defer s.opsMux.RUnlock()
+
+	journals, err := s.db.ListJournals()
+	if err != nil {
+		log.Printf("failed to list snapshot journals: %q", err)
+		return
+	}
+	found := map[string]bool{}
+	for _, journal := range journals {
+		if s.deferredJournals[journal.ID] == false {
+			continue
+		}
+		found[journal.ID] = true
+		if err := s.recoverJournal(journal); err != nil {
+			log.Printf("failed to recover snapshot %s: %q", journal.ID, err)
+		}
+	}
+	// Journals may have been removed by hand.
+	for id := range s.deferredJournals {
+		if found[id] == false {
+			delete(s.deferredJournals, id)
+		}
+	}
+}
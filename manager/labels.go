@@ -0,0 +1,168 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	gErrors "coriolis-ovm-exporter/errors"
+)
+
+const (
+	maxSnapshotNameLength        = 255
+	maxSnapshotDescriptionLength = 4096
+	maxLabelKeyLength            = 128
+	maxLabelValueLength          = 256
+)
+
+// Labels can be used in selectors, so keys can not hold any of the
+// characters used by the selector syntax.
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]*[A-Za-z0-9])?$`)
+
+func validateLabelKey(key string) error {
+	if len(key) > maxLabelKeyLength || !labelKeyRegex.MatchString(key) {
+		return gErrors.NewBadRequestError("invalid label key %q", key)
+	}
+	return nil
+}
+
+func validateLabelValue(key, value string) error {
+	if len(value) > maxLabelValueLength || utf8.ValidString(value) == false {
+		return gErrors.NewBadRequestError("invalid value %q for label %q", value, key)
+	}
+	return nil
+}
+
+// validateLabels validates the keys and values of labels. Keys must start
+// and end with an alphanumeric character, and may hold dots, dashes,
+// underscores and slashes. Values may be empty, or any UTF-8 string of up
+// to maxLabelValueLength bytes.
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := validateLabelKey(key); err != nil {
+			return err
+		}
+		if err := validateLabelValue(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Label selector operators.
+const (
+	selectorExists    = "exists"
+	selectorNotExists = "!exists"
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+)
+
+type labelRequirement struct {
+	key      string
+	operator string
+	value    string
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.key]
+	switch r.operator {
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	case selectorEquals:
+		return ok && value == r.value
+	case selectorNotEquals:
+		return !ok || value != r.value
+	}
+	return false
+}
+
+// labelSelector is a list of requirements that labels must all match.
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses a comma separated list of requirements. Each
+// requirement is one of "key", "!key", "key=value", "key==value" or
+// "key!=value". Keys and values are trimmed of surrounding whitespace, so
+// values with commas or surrounding whitespace can not be selected. An empty
+// selector matches everything.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var ret labelSelector
+	if strings.TrimSpace(selector) == "" {
+		return ret, nil
+	}
+
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		var req labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			kv := strings.SplitN(part, "!=", 2)
+			req = labelRequirement{key: kv[0], operator: selectorNotEquals, value: kv[1]}
+		case strings.Contains(part, "=="):
+			kv := strings.SplitN(part, "==", 2)
+			req = labelRequirement{key: kv[0], operator: selectorEquals, value: kv[1]}
+		case strings.Contains(part, "="):
+			kv := strings.SplitN(part, "=", 2)
+			req = labelRequirement{key: kv[0], operator: selectorEquals, value: kv[1]}
+		case strings.HasPrefix(part, "!"):
+			req = labelRequirement{key: part[1:], operator: selectorNotExists}
+		default:
+			req = labelRequirement{key: part, operator: selectorExists}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if err := validateLabelKey(req.key); err != nil {
+			return nil, gErrors.NewBadRequestError("invalid label selector %q", part)
+		}
+		if err := validateLabelValue(req.key, req.value); err != nil {
+			return nil, gErrors.NewBadRequestError("invalid label selector %q", part)
+		}
+		ret = append(ret, req)
+	}
+	return ret, nil
+}
+
+// matches returns true if labels match all requirements of the selector.
+func (l labelSelector) matches(labels map[string]string) bool {
+	for _, req := range l {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateSnapshotMetadata validates the name, description and labels of a
+// new snapshot.
+func validateSnapshotMetadata(name, description string, labels map[string]string) error {
+	if len(name) > maxSnapshotNameLength {
+		return gErrors.NewBadRequestError(
+			"name exceeds the maximum length of %d", maxSnapshotNameLength)
+	}
+	if len(description) > maxSnapshotDescriptionLength {
+		return gErrors.NewBadRequestError(
+			"description exceeds the maximum length of %d", maxSnapshotDescriptionLength)
+	}
+	if err := validateLabels(labels); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package manager
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		expected labelSelector
+		err      bool
+	}{
+		{
+			name:     "empty",
+			selector: "",
+			expected: nil,
+		},
+		{
+			name:     "whitespace only",
+			selector: "  ",
+			expected: nil,
+		},
+		{
+			name:     "exists",
+			selector: "job",
+			expected: labelSelector{{key: "job", operator: selectorExists}},
+		},
+		{
+			name:     "not exists",
+			selector: "!job",
+			expected: labelSelector{{key: "job", operator: selectorNotExists}},
+		},
+		{
+			name:     "equals",
+			selector: "job=m-1234",
+			expected: labelSelector{{key: "job", operator: selectorEquals, value: "m-1234"}},
+		},
+		{
+			name:     "double equals",
+			selector: "job==m-1234",
+			expected: labelSelector{{key: "job", operator: selectorEquals, value: "m-1234"}},
+		},
+		{
+			name:     "not equals",
+			selector: "phase!=cutover",
+			expected: labelSelector{{key: "phase", operator: selectorNotEquals, value: "cutover"}},
+		},
+		{
+			name:     "equals empty value",
+			selector: "phase=",
+			expected: labelSelector{{key: "phase", operator: selectorEquals, value: ""}},
+		},
+		{
+			name:     "value with spaces and punctuation",
+			selector: "owner=Jane Doe (ops); team #2",
+			expected: labelSelector{{key: "owner", operator: selectorEquals, value: "Jane Doe (ops); team #2"}},
+		},
+		{
+			name:     "unicode value",
+			selector: "site=Zürich",
+			expected: labelSelector{{key: "site", operator: selectorEquals, value: "Zürich"}},
+		},
+		{
+			name:     "multiple requirements with whitespace",
+			selector: " job = m-1234 , !done, phase!=cutover ",
+			expected: labelSelector{
+				{key: "job", operator: selectorEquals, value: "m-1234"},
+				{key: "done", operator: selectorNotExists},
+				{key: "phase", operator: selectorNotEquals, value: "cutover"},
+			},
+		},
+		{
+			name:     "missing key",
+			selector: "=m-1234",
+			err:      true,
+		},
+		{
+			name:     "missing key with negation",
+			selector: "!",
+			err:      true,
+		},
+		{
+			name:     "empty requirement",
+			selector: "job,,phase",
+			err:      true,
+		},
+		{
+			name:     "trailing comma",
+			selector: "job,",
+			err:      true,
+		},
+		{
+			name:     "invalid key",
+			selector: "jo b=m-1234",
+			err:      true,
+		},
+		{
+			name:     "value too long",
+			selector: "job=" + strings.Repeat("a", maxLabelValueLength+1),
+			err:      true,
+		},
+		{
+			name:     "invalid utf-8 value",
+			selector: "job=\xff",
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := parseLabelSelector(tt.selector)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got selector %v", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if reflect.DeepEqual(selector, tt.expected) == false {
+				t.Fatalf("expected %v, got %v", tt.expected, selector)
+			}
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		err    bool
+	}{
+		{
+			name:   "empty value",
+			labels: map[string]string{"job": ""},
+		},
+		{
+			name:   "value with spaces and punctuation",
+			labels: map[string]string{"owner": "Jane Doe, ops <jdoe@example.com>"},
+		},
+		{
+			name:   "unicode value",
+			labels: map[string]string{"site": "Zürich"},
+		},
+		{
+			name:   "value at length limit",
+			labels: map[string]string{"job": strings.Repeat("a", maxLabelValueLength)},
+		},
+		{
+			name:   "value too long",
+			labels: map[string]string{"job": strings.Repeat("a", maxLabelValueLength+1)},
+			err:    true,
+		},
+		{
+			name:   "invalid utf-8 value",
+			labels: map[string]string{"job": "\xff"},
+			err:    true,
+		},
+		{
+			name:   "invalid key",
+			labels: map[string]string{"job=": "m-1234"},
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateLabels(tt.labels)
+			if tt.err && err == nil {
+				t.Fatalf("expected error")
+			}
+			if tt.err == false && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/asdine/storm"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	gErrors "coriolis-ovm-exporter/errors"
+)
+
+func dbLeaseToParamsLease(lease db.Lease) params.Lease {
+	return params.Lease{
+		ID:         lease.ID,
+		SnapshotID: lease.SnapshotID,
+		VMID:       lease.VMID,
+		ExpiresAt:  lease.ExpiresAt,
+		CreatedAt:  lease.CreatedAt,
+		UpdatedAt:  lease.UpdatedAt,
+	}
+}
+
+// leaseExpiry validates the requested lease duration, and returns the time
+// at which the lease expires.
+func (s *SnapshotManager) leaseExpiry(req params.LeaseRequest) (time.Time, error) {
+	if req.Duration == "" {
+		return time.Time{}, gErrors.NewBadRequestError("missing lease duration")
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 {
+		return time.Time{}, gErrors.NewBadRequestError("invalid lease duration %q", req.Duration)
+	}
+	if maxDuration := s.cfg.Snapshots.MaxLeaseDuration.Duration; duration > maxDuration {
+		return time.Time{}, gErrors.NewBadRequestError(
+			"lease duration %s exceeds the maximum of %s", duration, maxDuration)
+	}
+	return time.Now().UTC().Add(duration), nil
+}
+
+// activeLease returns the lease of a snapshot that expires last, if the
+// snapshot has any active leases.
+func (s *SnapshotManager) activeLease(snapID string) (db.Lease, bool, error) {
+	leases, err := s.db.ListSnapshotLeases(snapID)
+	if err != nil {
+		return db.Lease{}, false, errors.Wrap(err, "fetching leases")
+	}
+
+	now := time.Now().UTC()
+	var latest db.Lease
+	var found bool
+	for _, lease := range leases {
+		if lease.Active(now) == false {
+			continue
+		}
+		if !found || lease.ExpiresAt.After(latest.ExpiresAt) {
+			latest = lease
+			found = true
+		}
+	}
+	return latest, found, nil
+}
+
+// checkNotLeased returns a conflict error if the snapshot has any active
+// leases.
+func (s *SnapshotManager) checkNotLeased(snapID string) error {
+	lease, found, err := s.activeLease(snapID)
+	if err != nil {
+		return err
+	}
+	if found {
+		return gErrors.NewConflictError(
+			"snapshot %s is leased until %s", snapID, lease.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// getLease fetches an active lease of snapshot snapID.
+func (s *SnapshotManager) getLease(vmID, snapID, leaseID string) (db.Lease, error) {
+	lease, err := s.db.GetLease(leaseID)
+	if err != nil {
+		if errors.Cause(err) == storm.ErrNotFound {
+			return db.Lease{}, gErrors.NewNotFoundError(
+				fmt.Sprintf("could not find lease %s", leaseID))
+		}
+		return db.Lease{}, errors.Wrap(err, "fetching lease")
+	}
+	if lease.VMID != vmID || lease.SnapshotID != snapID {
+		return db.Lease{}, gErrors.NewConflictError("lease does not belong to this snapshot")
+	}
+	if lease.Active(time.Now().UTC()) == false {
+		// Expired leases are removed by the retention loop.
+		return db.Lease{}, gErrors.NewNotFoundError(
+			fmt.Sprintf("lease %s has expired", leaseID))
+	}
+	return lease, nil
+}
+
+// CreateLease acquires a new lease on a snapshot. The snapshot can not be
+// deleted until the lease expires or is released, unless the delete is
+// forced.
+func (s *SnapshotManager) CreateLease(vmID, snapID string, req params.LeaseRequest) (params.Lease, error) {
+	expiresAt, err := s.leaseExpiry(req)
+	if err != nil {
+		return params.Lease{}, err
+	}
+
+	// Deletes check for leases while holding the snapshot lock.
+	unlock, err := s.lockWithTimeout(
+		fmt.Sprintf("snapshot %s", snapID), false, snapshotLockKey(snapID))
+	if err != nil {
+		return params.Lease{}, err
+	}
+	defer unlock()
+
+	if _, err := s.getSnapshot(vmID, snapID); err != nil {
+		return params.Lease{}, errors.Wrap(err, "fetching snapshot")
+	}
+
+	lease, err := s.db.CreateLease(uuid.NewString(), vmID, snapID, expiresAt)
+	if err != nil {
+		return params.Lease{}, errors.Wrap(err, "creating lease")
+	}
+	return dbLeaseToParamsLease(lease), nil
+}
+
+// RenewLease extends an active lease, so that it expires after the requested
+// duration, starting now.
+func (s *SnapshotManager) RenewLease(vmID, snapID, leaseID string, req params.LeaseRequest) (params.Lease, error) {
+	expiresAt, err := s.leaseExpiry(req)
+	if err != nil {
+		return params.Lease{}, err
+	}
+
+	// Hold the snapshot lock, so a concurrent delete can not remove the
+	// snapshot between the lease check and the update.
+	unlock, err := s.lockWithTimeout(
+		fmt.Sprintf("snapshot %s", snapID), false, snapshotLockKey(snapID))
+	if err != nil {
+		return params.Lease{}, err
+	}
+	defer unlock()
+
+	if _, err := s.getSnapshot(vmID, snapID); err != nil {
+		return params.Lease{}, errors.Wrap(err, "fetching snapshot")
+	}
+
+	lease, err := s.getLease(vmID, snapID, leaseID)
+	if err != nil {
+		return params.Lease{}, err
+	}
+
+	lease.ExpiresAt = expiresAt
+	lease, err = s.db.UpdateLease(lease)
+	if err != nil {
+		return params.Lease{}, errors.Wrap(err, "updating lease")
+	}
+	return dbLeaseToParamsLease(lease), nil
+}
+
+// ReleaseLease removes a lease before it expires.
+func (s *SnapshotManager) ReleaseLease(vmID, snapID, leaseID string) error {
+	unlock, err := s.lockWithTimeout(
+		fmt.Sprintf("snapshot %s", snapID), false, snapshotLockKey(snapID))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.getSnapshot(vmID, snapID); err != nil {
+		return errors.Wrap(err, "fetching snapshot")
+	}
+
+	lease, err := s.db.GetLease(leaseID)
+	if err != nil {
+		if errors.Cause(err) == storm.ErrNotFound {
+			return nil
+		}
+		return errors.Wrap(err, "fetching lease")
+	}
+	if lease.VMID != vmID || lease.SnapshotID != snapID {
+		return gErrors.NewConflictError("lease does not belong to this snapshot")
+	}
+
+	if err := s.db.DeleteLease(leaseID); err != nil {
+		return errors.Wrap(err, "deleting lease")
+	}
+	return nil
+}
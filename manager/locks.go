@@ -0,0 +1,193 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	gErrors "coriolis-ovm-exporter/errors"
+)
+
+// rwLock is a read/write lock that can be acquired with a context.
+type rwLock struct {
+	readers int
+	writer  bool
+	// writersWaiting is the number of writers waiting for the lock. New
+	// readers wait while it is non zero, so writers are not starved.
+	writersWaiting int
+	// refs is the number of holders and waiters. The lock is dropped
+	// once it reaches zero.
+	refs int
+	// changed is closed every time the lock is released.
+	changed chan struct{}
+}
+
+// lockManager hands out read/write locks identified by a key. Locks are
+// created on demand and dropped once nobody holds or waits for them.
+type lockManager struct {
+	mux   sync.Mutex
+	locks map[string]*rwLock
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks: map[string]*rwLock{},
+	}
+}
+
+func vmLockKey(vmID string) string {
+	return "vm/" + vmID
+}
+
+func snapshotLockKey(snapID string) string {
+	return "snapshot/" + snapID
+}
+
+// Lock acquires the lock identified by key. If exclusive is false, the lock
+// is shared with other readers. It waits until the lock is acquired or ctx
+// is done, in which case the error of ctx is returned. The returned function
+// releases the lock.
+func (l *lockManager) Lock(ctx context.Context, key string, exclusive bool) (func(), error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	lk, ok := l.locks[key]
+	if !ok {
+		lk = &rwLock{changed: make(chan struct{})}
+		l.locks[key] = lk
+	}
+	lk.refs++
+	if exclusive {
+		lk.writersWaiting++
+	}
+
+	for {
+		if exclusive && lk.writer == false && lk.readers == 0 {
+			lk.writersWaiting--
+			lk.writer = true
+			break
+		}
+		if !exclusive && lk.writer == false && lk.writersWaiting == 0 {
+			lk.readers++
+			break
+		}
+
+		changed := lk.changed
+		l.mux.Unlock()
+		select {
+		case <-changed:
+			l.mux.Lock()
+		case <-ctx.Done():
+			l.mux.Lock()
+			if exclusive {
+				lk.writersWaiting--
+			}
+			// Readers may be waiting for us to give up.
+			l.release(key, lk)
+			return nil, ctx.Err()
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mux.Lock()
+			defer l.mux.Unlock()
+			if exclusive {
+				lk.writer = false
+			} else {
+				lk.readers--
+			}
+			l.release(key, lk)
+		})
+	}, nil
+}
+
+// release wakes up all waiters of lk, and drops lk if it is no longer
+// used. l.mux must be held.
+func (l *lockManager) release(key string, lk *rwLock) {
+	close(lk.changed)
+	lk.changed = make(chan struct{})
+	lk.refs--
+	if lk.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// LockMany acquires all locks identified by keys, in a consistent order.
+// Duplicate keys are only locked once. If any lock can not be acquired,
+// the ones acquired so far are released.
+func (l *lockManager) LockMany(ctx context.Context, keys []string, exclusive bool) (func(), error) {
+	sorted := make([]string, 0, len(keys))
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var unlocks []func()
+	unlockAll := func() {
+		for idx := len(unlocks) - 1; idx >= 0; idx-- {
+			unlocks[idx]()
+		}
+	}
+	for _, key := range sorted {
+		unlock, err := l.Lock(ctx, key, exclusive)
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	return unlockAll, nil
+}
+
+// lockWithTimeout acquires the locks identified by keys, waiting at most
+// for the configured lock timeout. A conflict error mentioning what is
+// returned if the timeout expires.
+func (s *SnapshotManager) lockWithTimeout(what string, exclusive bool, keys ...string) (func(), error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.Snapshots.LockTimeout.Duration)
+	defer cancel()
+
+	unlock, err := s.locks.LockMany(ctx, keys, exclusive)
+	if err != nil {
+		if s.ctx.Err() != nil {
+			return nil, gErrors.NewUnavailableError("the exporter is shutting down")
+		}
+		return nil, gErrors.NewConflictError("%s is in use by another operation", what)
+	}
+	return unlock, nil
+}
+
+// RLockSnapshots acquires a shared lock on the snapshots identified by
+// snapIDs, which prevents them from being deleted while their disks are
+// read. Empty IDs are ignored. The returned function releases the locks.
+func (s *SnapshotManager) RLockSnapshots(snapIDs ...string) (func(), error) {
+	var keys []string
+	for _, snapID := range snapIDs {
+		if snapID != "" {
+			keys = append(keys, snapshotLockKey(snapID))
+		}
+	}
+	return s.lockWithTimeout("snapshot", false, keys...)
+}
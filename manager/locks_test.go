@@ -0,0 +1,265 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package manager
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// lockTimeout is how long tests wait for a lock that is expected to be
+// unavailable.
+const lockTimeout = 50 * time.Millisecond
+
+func tryLock(l *lockManager, key string, exclusive bool) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	return l.Lock(ctx, key, exclusive)
+}
+
+// lockAsync acquires a lock in the background. The returned channel receives
+// the unlock function once the lock is acquired.
+func lockAsync(ctx context.Context, l *lockManager, key string, exclusive bool) chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		unlock, err := l.Lock(ctx, key, exclusive)
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- unlock
+	}()
+	return ch
+}
+
+// waitForWriters waits until count writers are waiting for key.
+func waitForWriters(t *testing.T, l *lockManager, key string, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		l.mux.Lock()
+		lk, ok := l.locks[key]
+		waiting := ok && lk.writersWaiting == count
+		l.mux.Unlock()
+		if waiting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d writers on %s", count, key)
+}
+
+func expectAcquired(t *testing.T, ch chan func()) func() {
+	t.Helper()
+	select {
+	case unlock, ok := <-ch:
+		if !ok {
+			t.Fatalf("lock was not acquired")
+		}
+		return unlock
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for lock")
+	}
+	return nil
+}
+
+func expectBlocked(t *testing.T, ch chan func()) {
+	t.Helper()
+	select {
+	case unlock, ok := <-ch:
+		if ok {
+			unlock()
+		}
+		t.Fatalf("lock was acquired, expected it to block")
+	case <-time.After(lockTimeout):
+	}
+}
+
+func expectNoLocks(t *testing.T, l *lockManager) {
+	t.Helper()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(l.locks) != 0 {
+		t.Fatalf("expected all locks to be dropped, got %d", len(l.locks))
+	}
+}
+
+func TestLockExclusive(t *testing.T) {
+	l := newLockManager()
+	unlock, err := tryLock(l, "a", true)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	if _, err := tryLock(l, "a", true); err != context.DeadlineExceeded {
+		t.Fatalf("expected exclusive lock to time out, got %v", err)
+	}
+	if _, err := tryLock(l, "a", false); err != context.DeadlineExceeded {
+		t.Fatalf("expected shared lock to time out, got %v", err)
+	}
+	// Other keys are independent.
+	unlockB, err := tryLock(l, "b", true)
+	if err != nil {
+		t.Fatalf("failed to lock other key: %v", err)
+	}
+	unlockB()
+
+	unlock()
+	// Releasing twice is a no-op.
+	unlock()
+
+	unlock, err = tryLock(l, "a", true)
+	if err != nil {
+		t.Fatalf("failed to lock after release: %v", err)
+	}
+	unlock()
+	expectNoLocks(t, l)
+}
+
+func TestLockShared(t *testing.T) {
+	l := newLockManager()
+	unlock1, err := tryLock(l, "a", false)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	unlock2, err := tryLock(l, "a", false)
+	if err != nil {
+		t.Fatalf("failed to acquire second shared lock: %v", err)
+	}
+
+	writer := lockAsync(context.Background(), l, "a", true)
+	waitForWriters(t, l, "a", 1)
+	unlock1()
+	expectBlocked(t, writer)
+	unlock2()
+	unlock := expectAcquired(t, writer)
+	unlock()
+	expectNoLocks(t, l)
+}
+
+func TestLockWriterPreferred(t *testing.T) {
+	l := newLockManager()
+	unlockReader, err := tryLock(l, "a", false)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	writer := lockAsync(context.Background(), l, "a", true)
+	waitForWriters(t, l, "a", 1)
+
+	// New readers queue behind the waiting writer, so it is not
+	// starved.
+	reader := lockAsync(context.Background(), l, "a", false)
+	expectBlocked(t, reader)
+
+	unlockReader()
+	unlockWriter := expectAcquired(t, writer)
+	expectBlocked(t, reader)
+
+	unlockWriter()
+	unlock := expectAcquired(t, reader)
+	unlock()
+	expectNoLocks(t, l)
+}
+
+func TestLockNestedSharedWithWaitingWriter(t *testing.T) {
+	l := newLockManager()
+	unlockOuter, err := tryLock(l, "a", false)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	writer := lockAsync(context.Background(), l, "a", true)
+	waitForWriters(t, l, "a", 1)
+
+	// A nested shared lock waits for the writer, which waits for the
+	// outer shared lock. It must give up once its context is done,
+	// without breaking the lock state.
+	if _, err := tryLock(l, "a", false); err != context.DeadlineExceeded {
+		t.Fatalf("expected nested shared lock to time out, got %v", err)
+	}
+	expectBlocked(t, writer)
+
+	unlockOuter()
+	unlock := expectAcquired(t, writer)
+	unlock()
+	expectNoLocks(t, l)
+}
+
+func TestLockCancelledWriterReleasesReaders(t *testing.T) {
+	l := newLockManager()
+	unlockReader, err := tryLock(l, "a", false)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := lockAsync(ctx, l, "a", true)
+	waitForWriters(t, l, "a", 1)
+
+	reader := lockAsync(context.Background(), l, "a", false)
+	expectBlocked(t, reader)
+
+	// Readers queued behind the writer proceed once it gives up.
+	cancel()
+	unlock := expectAcquired(t, reader)
+	if _, ok := <-writer; ok {
+		t.Fatalf("expected cancelled writer to fail")
+	}
+
+	unlock()
+	unlockReader()
+	expectNoLocks(t, l)
+}
+
+func TestLockMany(t *testing.T) {
+	l := newLockManager()
+	unlock, err := l.LockMany(context.Background(), []string{"b", "a", "b"}, true)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, err := tryLock(l, key, false); err != context.DeadlineExceeded {
+			t.Fatalf("expected %s to be locked, got %v", key, err)
+		}
+	}
+	unlock()
+	expectNoLocks(t, l)
+}
+
+func TestLockManyReleasesOnFailure(t *testing.T) {
+	l := newLockManager()
+	unlockB, err := tryLock(l, "b", true)
+	if err != nil {
+		t.Fatalf("failed to lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	if _, err := l.LockMany(ctx, []string{"a", "b"}, true); err != context.DeadlineExceeded {
+		t.Fatalf("expected LockMany to time out, got %v", err)
+	}
+
+	// The lock on "a" must have been released.
+	unlockA, err := tryLock(l, "a", true)
+	if err != nil {
+		t.Fatalf("expected a to be released: %v", err)
+	}
+	unlockA()
+	unlockB()
+	expectNoLocks(t, l)
+}
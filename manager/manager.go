@@ -17,31 +17,186 @@
 package manager
 
 import (
+	"context"
 	"coriolis-ovm-exporter/apiserver/params"
 	"coriolis-ovm-exporter/config"
 	"coriolis-ovm-exporter/db"
 	gErrors "coriolis-ovm-exporter/errors"
 	"coriolis-ovm-exporter/internal"
+	"coriolis-ovm-exporter/metrics"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/asdine/storm"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// rollbackTimeout is the time we wait for cancelled operations to roll back,
+// when shutting down.
+const rollbackTimeout = 30 * time.Second
+
 // NewManager returns a new instance of SnapshotManager
 func NewManager(cfg *config.Config) (*SnapshotManager, error) {
 	db, err := db.NewDatabase(cfg.DBFile)
 	if err != nil {
 		return nil, errors.Wrap(err, "opening database")
 	}
-	return &SnapshotManager{
-		db: db,
-	}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	mgr := &SnapshotManager{
+		cfg:    cfg,
+		db:     db,
+		quit:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		domains: internal.NewXLDomainController(
+			cfg.Snapshots.XLPath, cfg.Snapshots.ShutdownTimeout.Duration),
+		locks:            newLockManager(),
+		deferredJournals: map[string]bool{},
+	}
+
+	if err := mgr.recoverJournals(); err != nil {
+		return nil, errors.Wrap(err, "recovering interrupted snapshots")
+	}
+
+	if err := mgr.failInterruptedTasks(); err != nil {
+		return nil, errors.Wrap(err, "failing interrupted tasks")
+	}
+
+	switch cfg.Snapshots.StartupReconcile {
+	case config.ReconcileReport, config.ReconcileRemove:
+		mgr.startupReconcile(cfg.Snapshots.StartupReconcile == config.ReconcileReport)
+	}
+
+	if err := prometheus.Register(repoCollector{mgr: mgr}); err != nil {
+		return nil, errors.Wrap(err, "registering metrics collector")
+	}
+
+	go mgr.retentionLoop()
+	return mgr, nil
 }
 
 // SnapshotManager manages all snapshotting operations.
 type SnapshotManager struct {
-	db *db.Database
+	cfg *config.Config
+	db  *db.Database
+
+	// opsMux is held for reading by operations that create or remove
+	// snapshots, and for writing while reconciling snapshots. It is always
+	// taken after the locks below, and no lock is taken while holding it.
+	opsMux sync.RWMutex
+
+	// locks serializes operations on the same VM or snapshot. Creating a
+	// snapshot holds the VM lock, deleting a snapshot holds the snapshot
+	// lock, and reading snapshot disks holds a shared snapshot lock. Locks
+	// are taken in this order: VM, snapshot, opsMux.
+	locks *lockManager
+
+	// quit is closed to stop background workers.
+	quit chan struct{}
+
+	// ctx is cancelled to abort running operations, if they do not
+	// finish in time when shutting down.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stateMux guards draining and stopped.
+	stateMux sync.Mutex
+	// draining is set when the manager is shutting down. No new
+	// operations are accepted once it is set.
+	draining bool
+	// stopped is set once Shutdown was called.
+	stopped bool
+	// ops tracks running operations.
+	ops sync.WaitGroup
+
+	// domains pauses or shuts down VMs, as required by the consistency
+	// mode of new snapshots.
+	domains internal.DomainController
+
+	// deferredJournals holds the IDs of interrupted snapshots that could
+	// not be recovered at startup, because their repositories were not
+	// mounted. It is only used when starting, and by the retention loop.
+	deferredJournals map[string]bool
+}
+
+// beginOperation registers a new operation, which must be ended by calling
+// endOperation. An error is returned if the manager is shutting down.
+func (s *SnapshotManager) beginOperation() error {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if s.draining {
+		return gErrors.NewUnavailableError("the exporter is shutting down")
+	}
+	s.ops.Add(1)
+	return nil
+}
+
+func (s *SnapshotManager) endOperation() {
+	s.ops.Done()
+}
+
+// StopAccepting stops accepting new operations, and stops background workers,
+// so they do not start new deletes. Running operations are not affected. It
+// should be called before draining requests, as requests may start operations.
+func (s *SnapshotManager) StopAccepting() {
+	s.stateMux.Lock()
+	defer s.stateMux.Unlock()
+
+	if s.draining {
+		return
+	}
+	s.draining = true
+	close(s.quit)
+}
+
+// Shutdown stops accepting new operations and waits for running operations to
+// finish. If ctx expires first, running operations are cancelled and rolled back.
+// The database is closed once all operations have stopped, or once they failed
+// to roll back within rollbackTimeout. Requests that read from the database
+// without starting an operation must be drained before calling Shutdown.
+func (s *SnapshotManager) Shutdown(ctx context.Context) error {
+	s.StopAccepting()
+
+	s.stateMux.Lock()
+	if s.stopped {
+		s.stateMux.Unlock()
+		return nil
+	}
+	s.stopped = true
+	s.stateMux.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.ops.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("snapshot operations did not finish in time, rolling back")
+		s.cancel()
+		// Reflinks and some xl commands can not be interrupted. Operations
+		// still running when we exit are recovered from their journal on
+		// the next start.
+		select {
+		case <-done:
+		case <-time.After(rollbackTimeout):
+			err = fmt.Errorf("snapshot operations did not stop within %s", rollbackTimeout)
+		}
+	}
+	s.cancel()
+
+	if closeErr := s.db.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (s *SnapshotManager) fetchVMSnapshotIDs(vmid string) ([]string, error) {
@@ -125,12 +280,14 @@ func (s *SnapshotManager) snapshotToParamsSnapshot(snapshot internal.Snapshot) p
 
 	for idx, disk := range snapshot.Disks {
 		disks[idx] = params.DiskSnapshot{
-			Path:       disk.Path,
-			ParentPath: disk.ParentPath,
-			SnapshotID: disk.SnapshotID,
-			Chunks:     disk.Chunks,
-			Name:       disk.Name,
-			Repo:       disk.Repo,
+			Path:          disk.Path,
+			ParentPath:    disk.ParentPath,
+			SnapshotID:    disk.SnapshotID,
+			Chunks:        disk.Chunks,
+			Name:          disk.Name,
+			Repo:          disk.Repo,
+			FullCopy:      disk.FullCopy,
+			AllocationMap: disk.AllocationMap,
 		}
 	}
 	ret := params.VMSnapshot{
@@ -143,45 +300,170 @@ func (s *SnapshotManager) snapshotToParamsSnapshot(snapshot internal.Snapshot) p
 }
 
 // CreateSnapshot creates a new snapshot of all VM disks.
-func (s *SnapshotManager) CreateSnapshot(vmid string) (snap params.VMSnapshot, err error) {
+func (s *SnapshotManager) CreateSnapshot(vmid string, req params.CreateSnapshotRequest) (snap params.VMSnapshot, err error) {
+	if err := s.beginOperation(); err != nil {
+		return params.VMSnapshot{}, err
+	}
+	defer s.endOperation()
+
+	record, err := s.newSnapshotRecord(req)
+	if err != nil {
+		return params.VMSnapshot{}, err
+	}
+
 	vm, err := internal.GetVM(vmid)
 	if err != nil {
 		return params.VMSnapshot{}, errors.Wrap(err, "fetching VM info")
 	}
 
-	snapshot, err := vm.CreateSnapshot(false)
+	return s.createSnapshot(vm, s.snapshotOptions(req), record)
+}
+
+// newSnapshotRecord validates the snapshot request and returns the database
+// record that will be saved once the snapshot is created.
+func (s *SnapshotManager) newSnapshotRecord(req params.CreateSnapshotRequest) (db.Snapshot, error) {
+	var record db.Snapshot
+
+	if req.TTL != "" && req.ExpiresAt != nil {
+		return db.Snapshot{}, gErrors.NewBadRequestError("ttl and expires_at are mutually exclusive")
+	}
+
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return db.Snapshot{}, gErrors.NewBadRequestError("invalid ttl %q", req.TTL)
+		}
+		record.ExpiresAt = time.Now().UTC().Add(ttl)
+	}
+
+	if req.ExpiresAt != nil {
+		if req.ExpiresAt.After(time.Now()) == false {
+			return db.Snapshot{}, gErrors.NewBadRequestError("expires_at must be in the future")
+		}
+		record.ExpiresAt = req.ExpiresAt.UTC()
+	}
+
+	switch req.Consistency {
+	case "":
+		record.Consistency = params.ConsistencyCrash
+	case params.ConsistencyCrash, params.ConsistencyPause, params.ConsistencyShutdown:
+		record.Consistency = req.Consistency
+	default:
+		return db.Snapshot{}, gErrors.NewBadRequestError("invalid consistency %q", req.Consistency)
+	}
+
+	if err := validateSnapshotMetadata(req.Name, req.Description, req.Labels); err != nil {
+		return db.Snapshot{}, err
+	}
+	record.Name = req.Name
+	record.Description = req.Description
+	record.Labels = req.Labels
+	return record, nil
+}
+
+func (s *SnapshotManager) snapshotOptions(req params.CreateSnapshotRequest) internal.SnapshotOptions {
+	return internal.SnapshotOptions{
+		FullCopy:      req.FullCopy,
+		FullCopyRepos: s.cfg.Snapshots.FullCopyRepos,
+		Consistency:   req.Consistency,
+		Domains:       s.domains,
+	}
+}
+
+// createSnapshot creates a snapshot of all disks of vm. A journal is kept
+// while the snapshot is created, so it can be completed or rolled back if
+// the exporter stops before it is saved.
+func (s *SnapshotManager) createSnapshot(vm internal.VMConfig, opts internal.SnapshotOptions, record db.Snapshot) (snap params.VMSnapshot, err error) {
+	if opts.SnapshotID == "" {
+		opts.SnapshotID = uuid.NewString()
+	}
+
+	// Snapshots of the same VM are created one at a time. Creates are
+	// queued until the VM is free, or the exporter shuts down.
+	unlockVM, err := s.locks.Lock(s.ctx, vmLockKey(vm.Name), true)
 	if err != nil {
-		return params.VMSnapshot{}, errors.Wrap(err, "creating VM snapshot")
+		return params.VMSnapshot{}, gErrors.NewUnavailableError("the exporter is shutting down")
+	}
+	defer unlockVM()
+
+	unlockSnap, err := s.locks.Lock(s.ctx, snapshotLockKey(opts.SnapshotID), true)
+	if err != nil {
+		return params.VMSnapshot{}, gErrors.NewUnavailableError("the exporter is shutting down")
+	}
+	defer unlockSnap()
+
+	s.opsMux.RLock()
+	defer s.opsMux.RUnlock()
+
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			metrics.SnapshotCreateFailures.Inc()
+			return
+		}
+		metrics.SnapshotCreateDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	disks, err := vm.Disks()
+	if err != nil {
+		return params.VMSnapshot{}, errors.Wrap(err, "fetching VM disks")
+	}
+
+	// Record where disk snapshots will be created, before creating them.
+	record.ID = opts.SnapshotID
+	record.VMID = vm.Name
+	record.Disks = make([]params.DiskSnapshot, len(disks))
+	for idx, disk := range disks {
+		record.Disks[idx] = params.DiskSnapshot{
+			Name:       disk.Name,
+			Repo:       disk.Repo.MountPoint,
+			SnapshotID: opts.SnapshotID,
+			Path:       disk.SnapshotPath(opts.SnapshotID),
+			ParentPath: disk.Path,
+		}
+	}
+	journal, err := s.db.CreateJournal(record)
+	if err != nil {
+		return params.VMSnapshot{}, errors.Wrap(err, "creating snapshot journal")
 	}
 
 	defer func() {
 		if err != nil {
-			err2 := snapshot.Delete()
-			if err2 != nil {
+			if err2 := s.rollbackJournal(journal); err2 != nil {
 				log.Printf("failed to cleanup snapshot: %q", err2)
 			}
 		}
 	}()
 
-	snapshotParams := s.snapshotToParamsSnapshot(snapshot)
-	_, err = s.db.CreateSnapshot(snapshot.SnapshotID, vmid, snapshotParams.Disks)
+	snapshot, err := vm.CreateSnapshot(s.ctx, opts)
 	if err != nil {
-		return params.VMSnapshot{}, err
+		return params.VMSnapshot{}, errors.Wrap(err, "creating VM snapshot")
+	}
+
+	journal.State = db.JournalDisksCreated
+	journal.Snapshot.Disks = s.snapshotToParamsSnapshot(snapshot).Disks
+	journal.Snapshot.CreatedAt = time.Now().UTC()
+	journal, err = s.db.UpdateJournal(journal)
+	if err != nil {
+		return params.VMSnapshot{}, errors.Wrap(err, "updating snapshot journal")
 	}
-	return snapshotParams, nil
+
+	created, err := s.db.CommitJournal(journal)
+	if err != nil {
+		return params.VMSnapshot{}, errors.Wrap(err, "saving snapshot")
+	}
+	if err := s.db.DeleteJournal(journal.ID); err != nil {
+		// Committed journals are removed when the exporter starts.
+		log.Printf("failed to remove journal of snapshot %s: %q", journal.ID, err)
+	}
+	return s.dbSnapToParamsSnapshots(created, false), nil
 }
 
 func (s *SnapshotManager) squashChunks(disks []params.DiskSnapshot) []params.DiskSnapshot {
 	ret := make([]params.DiskSnapshot, len(disks))
 	for idx, disk := range disks {
-		ret[idx] = params.DiskSnapshot{
-			ParentPath: disk.ParentPath,
-			Path:       disk.Path,
-			SnapshotID: disk.SnapshotID,
-			Chunks:     internal.SquashChunks(disk.Chunks),
-			Name:       disk.Name,
-			Repo:       disk.Repo,
-		}
+		ret[idx] = disk
+		ret[idx].Chunks = internal.SquashChunks(disk.Chunks)
 	}
 	return ret
 }
@@ -191,14 +473,32 @@ func (s *SnapshotManager) dbSnapToParamsSnapshots(snap db.Snapshot, squashChunks
 	if squashChunks == true {
 		disks = s.squashChunks(snap.Disks)
 	} else {
-		disks = snap.Disks
+		disks = make([]params.DiskSnapshot, len(snap.Disks))
+		copy(disks, snap.Disks)
+	}
+	for idx := range disks {
+		disks[idx].AllocationMap = allocationMapKind(disks[idx])
+	}
+	labels := make(map[string]string, len(snap.Labels))
+	for key, value := range snap.Labels {
+		labels[key] = value
 	}
-	return params.VMSnapshot{
-		ID:   snap.ID,
-		VMID: snap.VMID,
+	ret := params.VMSnapshot{
+		ID:          snap.ID,
+		VMID:        snap.VMID,
+		Name:        snap.Name,
+		Description: snap.Description,
+		Labels:      labels,
+		CreatedAt:   snap.CreatedAt,
+		Consistency: snap.Consistency,
 
 		Disks: disks,
 	}
+	if !snap.ExpiresAt.IsZero() {
+		expiresAt := snap.ExpiresAt
+		ret.ExpiresAt = &expiresAt
+	}
+	return ret
 }
 
 func (s *SnapshotManager) getSnapshot(vmID, snapID string) (db.Snapshot, error) {
@@ -212,27 +512,7 @@ func (s *SnapshotManager) getSnapshot(vmID, snapID string) (db.Snapshot, error)
 	return snap, nil
 }
 
-func (s *SnapshotManager) compareChunks(first, second []params.Chunk) []params.Chunk {
-	var ret []params.Chunk
-	for _, val := range first {
-		var found bool = false
-		for _, prevVal := range second {
-			if val.Physical == prevVal.Physical {
-				if val.Start == prevVal.Start && val.Length == prevVal.Length {
-					found = true
-					break
-				}
-			}
-		}
-		// This is a new extent. Add it to the list.
-		if !found {
-			ret = append(ret, val)
-		}
-	}
-	return ret
-}
-
-func (s *SnapshotManager) getDiffSnapshot(snap, compareTo db.Snapshot) (db.Snapshot, error) {
+func (s *SnapshotManager) getDiffSnapshot(snap, compareTo db.Snapshot, diffMode string) (db.Snapshot, error) {
 	if !compareTo.CreatedAt.Before(snap.CreatedAt) {
 		return db.Snapshot{}, gErrors.NewBadRequestError(
 			"compareTo snapshot must be older than this snapshot")
@@ -246,32 +526,50 @@ func (s *SnapshotManager) getDiffSnapshot(snap, compareTo db.Snapshot) (db.Snaps
 	newDisks := make([]params.DiskSnapshot, len(snap.Disks))
 
 	for idx, disk := range snap.Disks {
-		var chunks []params.Chunk = disk.Chunks
+		newDisks[idx] = disk
 		for _, compareDisk := range compareTo.Disks {
 			if compareDisk.Name == disk.Name {
-				chunks = s.compareChunks(disk.Chunks, compareDisk.Chunks)
+				// Physical offsets are unrelated between a full copy
+				// and any other snapshot, and are unknown if the disk was
+				// not mapped using FIEMAP. Compare disk contents instead.
+				if diffMode == params.DiffModeContent || !hasPhysicalOffsets(disk) || !hasPhysicalOffsets(compareDisk) {
+					diff, err := internal.DiffFileContents(
+						disk.Path, compareDisk.Path, disk.Chunks, compareDisk.Chunks,
+						s.cfg.Snapshots.ContentDiffWorkers)
+					if err != nil {
+						return db.Snapshot{}, errors.Wrapf(err, "comparing contents of %s", disk.Name)
+					}
+					newDisks[idx].Chunks = diff.Chunks
+					newDisks[idx].DiffMode = params.DiffModeContent
+					newDisks[idx].DiffBytesRead = diff.BytesRead
+				} else {
+					newDisks[idx].Chunks = diffChunks(disk.Chunks, compareDisk.Chunks)
+					newDisks[idx].DiffMode = params.DiffModeExtents
+				}
 				break
 			}
 		}
-		newDisks[idx] = params.DiskSnapshot{
-			ParentPath: disk.ParentPath,
-			Path:       disk.Path,
-			SnapshotID: disk.SnapshotID,
-			Chunks:     chunks,
-			Name:       disk.Name,
-			Repo:       disk.Repo,
-		}
 	}
 	// TODO: should we copy the values?
 	snap.Disks = newDisks
 	return snap, nil
 }
 
-// GetSnapshot fetches information about a snapshot.
-func (s *SnapshotManager) GetSnapshot(vmID, snapID, compareTo string, squashChunks bool) (params.VMSnapshot, error) {
+// GetSnapshot fetches information about a snapshot. If compareTo is set, only
+// the chunks that changed since that snapshot are returned. diffMode selects how
+// changed chunks are found. Valid values are params.DiffModeExtents (default) and
+// params.DiffModeContent. Snapshots that are full copies are always compared by
+// content.
+func (s *SnapshotManager) GetSnapshot(vmID, snapID, compareTo, diffMode string, squashChunks bool) (params.VMSnapshot, error) {
 	var snap db.Snapshot
 	var err error
 
+	switch diffMode {
+	case "", params.DiffModeExtents, params.DiffModeContent:
+	default:
+		return params.VMSnapshot{}, gErrors.NewBadRequestError("invalid diffMode %q", diffMode)
+	}
+
 	requestedSnap, err := s.getSnapshot(vmID, snapID)
 	if err != nil {
 		return params.VMSnapshot{}, errors.Wrap(err, "fetching snapshot")
@@ -283,7 +581,7 @@ func (s *SnapshotManager) GetSnapshot(vmID, snapID, compareTo string, squashChun
 		if err != nil {
 			return params.VMSnapshot{}, err
 		}
-		snap, err = s.getDiffSnapshot(requestedSnap, compareToSnap)
+		snap, err = s.getDiffSnapshot(requestedSnap, compareToSnap, diffMode)
 		if err != nil {
 			return params.VMSnapshot{}, err
 		}
@@ -293,20 +591,47 @@ func (s *SnapshotManager) GetSnapshot(vmID, snapID, compareTo string, squashChun
 	return s.dbSnapToParamsSnapshots(snap, squashChunks), nil
 }
 
-// ListSnapshots lists all snapshots for a VM
-func (s *SnapshotManager) ListSnapshots(vmID string) ([]params.VMSnapshot, error) {
-	vm, err := s.GetVirtualMachine(vmID)
+// GetSnapshotDisk returns the disk diskID of a snapshot. compareTo and
+// diffMode are the same as for GetSnapshot.
+func (s *SnapshotManager) GetSnapshotDisk(vmID, snapID, diskID, compareTo, diffMode string) (params.DiskSnapshot, error) {
+	snapshot, err := s.GetSnapshot(vmID, snapID, compareTo, diffMode, true)
+	if err != nil {
+		return params.DiskSnapshot{}, errors.Wrap(err, "fetching snapshot")
+	}
+
+	for _, val := range snapshot.Disks {
+		if val.Name == diskID {
+			return val, nil
+		}
+	}
+	return params.DiskSnapshot{}, gErrors.NewNotFoundError(
+		fmt.Sprintf("could not find disk %s in snapshot %s", diskID, snapID))
+}
+
+// ListSnapshots lists all snapshots for a VM. If labelSelector is set, only
+// snapshots whose labels match it are returned. See parseLabelSelector for the
+// selector syntax.
+func (s *SnapshotManager) ListSnapshots(vmID, labelSelector string) ([]params.VMSnapshot, error) {
+	selector, err := parseLabelSelector(labelSelector)
 	if err != nil {
 		return nil, err
 	}
 
-	ret := make([]params.VMSnapshot, len(vm.Snapshots))
-	for idx, snap := range vm.Snapshots {
-		retSnap, err := s.GetSnapshot(vmID, snap, "", true)
-		if err != nil {
-			return nil, err
+	if _, err := internal.GetVM(vmID); err != nil {
+		return nil, errors.Wrap(err, "fetching VM info")
+	}
+
+	snapshots, err := s.db.ListSnapshots(vmID)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching snapshots")
+	}
+
+	ret := []params.VMSnapshot{}
+	for _, snap := range snapshots {
+		if !selector.matches(snap.Labels) {
+			continue
 		}
-		ret[idx] = retSnap
+		ret = append(ret, s.dbSnapToParamsSnapshots(snap, true))
 	}
 	return ret, nil
 }
@@ -316,12 +641,14 @@ func (s *SnapshotManager) dbSnapToInternalSnap(snap db.Snapshot) internal.Snapsh
 
 	for idx, disk := range snap.Disks {
 		disks[idx] = internal.DiskSnapshot{
-			Name:       disk.Name,
-			Path:       disk.Path,
-			SnapshotID: disk.SnapshotID,
-			ParentPath: disk.ParentPath,
-			Repo:       disk.Repo,
-			Chunks:     disk.Chunks,
+			Name:          disk.Name,
+			Path:          disk.Path,
+			SnapshotID:    disk.SnapshotID,
+			ParentPath:    disk.ParentPath,
+			Repo:          disk.Repo,
+			Chunks:        disk.Chunks,
+			FullCopy:      disk.FullCopy,
+			AllocationMap: disk.AllocationMap,
 		}
 	}
 	ret := internal.Snapshot{
@@ -332,8 +659,35 @@ func (s *SnapshotManager) dbSnapToInternalSnap(snap db.Snapshot) internal.Snapsh
 	return ret
 }
 
-// DeleteSnapshot deletes a single snapshot.
-func (s *SnapshotManager) DeleteSnapshot(vmID, snapID string) error {
+// DeleteSnapshot deletes a single snapshot. It waits for the snapshot to be
+// released by any operation reading it, and returns a conflict error if that
+// takes longer than the configured lock timeout. Snapshots with active leases
+// are only deleted if force is true.
+func (s *SnapshotManager) DeleteSnapshot(vmID, snapID string, force bool) (err error) {
+	if err := s.beginOperation(); err != nil {
+		return err
+	}
+	defer s.endOperation()
+
+	unlock, err := s.lockWithTimeout(
+		fmt.Sprintf("snapshot %s", snapID), true, snapshotLockKey(snapID))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.opsMux.RLock()
+	defer s.opsMux.RUnlock()
+
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			metrics.SnapshotDeleteFailures.Inc()
+			return
+		}
+		metrics.SnapshotDeleteDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	snap, err := s.getSnapshot(vmID, snapID)
 	if err != nil {
 		errCause := errors.Cause(err)
@@ -343,6 +697,12 @@ func (s *SnapshotManager) DeleteSnapshot(vmID, snapID string) error {
 		return nil
 	}
 
+	if !force {
+		if err := s.checkNotLeased(snap.ID); err != nil {
+			return err
+		}
+	}
+
 	internalSnap := s.dbSnapToInternalSnap(snap)
 	if err := internalSnap.Delete(); err != nil {
 		return err
@@ -356,14 +716,41 @@ func (s *SnapshotManager) DeleteSnapshot(vmID, snapID string) error {
 	return nil
 }
 
-// PurgeSnapshots deletes all snapshots for a VM.
-func (s *SnapshotManager) PurgeSnapshots(vmID string) error {
-	vm, err := s.GetVirtualMachine(vmID)
+// RefreshInventory reloads the list of repositories and VMs from disk.
+func (s *SnapshotManager) RefreshInventory() error {
+	if err := internal.RefreshInventory(); err != nil {
+		return errors.Wrap(err, "refreshing inventory")
+	}
+	return nil
+}
+
+// PurgeSnapshots deletes all snapshots for a VM. No new snapshots of the VM
+// are created while purging. Unless force is true, nothing is deleted if any
+// of the snapshots have active leases.
+func (s *SnapshotManager) PurgeSnapshots(vmID string, force bool) error {
+	if _, err := internal.GetVM(vmID); err != nil {
+		return errors.Wrap(err, "fetching VM info")
+	}
+
+	unlock, err := s.lockWithTimeout(fmt.Sprintf("VM %s", vmID), true, vmLockKey(vmID))
 	if err != nil {
 		return err
 	}
-	for _, snap := range vm.Snapshots {
-		if err := s.DeleteSnapshot(vmID, snap); err != nil {
+	defer unlock()
+
+	snapshots, err := s.fetchVMSnapshotIDs(vmID)
+	if err != nil {
+		return err
+	}
+	if !force {
+		for _, snap := range snapshots {
+			if err := s.checkNotLeased(snap); err != nil {
+				return err
+			}
+		}
+	}
+	for _, snap := range snapshots {
+		if err := s.DeleteSnapshot(vmID, snap, force); err != nil {
 			return err
 		}
 	}
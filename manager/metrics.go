@@ -0,0 +1,62 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"coriolis-ovm-exporter/metrics"
+)
+
+// repoCollector reports the number of snapshots and the size of their
+// extents for each repository, as recorded in the database.
+type repoCollector struct {
+	mgr *SnapshotManager
+}
+
+func (r repoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.RepoSnapshotsDesc
+	ch <- metrics.RepoSnapshotBytesDesc
+}
+
+func (r repoCollector) Collect(ch chan<- prometheus.Metric) {
+	snaps, err := r.mgr.db.ListAllSnapshots()
+	if err != nil {
+		log.Printf("failed to list snapshots for metrics: %q", err)
+		return
+	}
+
+	counts := map[string]int{}
+	sizes := map[string]uint64{}
+	for _, snap := range snaps {
+		for _, disk := range snap.Disks {
+			counts[disk.Repo]++
+			for _, chunk := range disk.Chunks {
+				sizes[disk.Repo] += chunk.Length
+			}
+		}
+	}
+
+	for repo, count := range counts {
+		ch <- prometheus.MustNewConstMetric(
+			metrics.RepoSnapshotsDesc, prometheus.GaugeValue, float64(count), repo)
+		ch <- prometheus.MustNewConstMetric(
+			metrics.RepoSnapshotBytesDesc, prometheus.GaugeValue, float64(sizes[repo]), repo)
+	}
+}
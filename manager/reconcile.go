@@ -0,0 +1,257 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	"coriolis-ovm-exporter/internal"
+)
+
+func (s *SnapshotManager) startupReconcile(dryRun bool) {
+	report, err := s.ReconcileSnapshots(dryRun)
+	if err != nil {
+		log.Printf("failed to reconcile snapshots: %q", err)
+		return
+	}
+
+	for _, orphan := range report.OrphanedPaths {
+		log.Printf("found untracked snapshot file %s (removed: %v)", orphan.Path, orphan.Removed)
+	}
+	for _, orphan := range report.OrphanedSnapshots {
+		log.Printf("found snapshot %s of VM %s with missing files %v (removed: %v)",
+			orphan.SnapshotID, orphan.VMID, orphan.MissingFiles, orphan.Removed)
+	}
+	for _, msg := range report.Errors {
+		log.Printf("reconcile error: %s", msg)
+	}
+}
+
+// findOrphanedPaths returns all files and folders inside the snapshot folder of
+// repo, that do not belong to any of the snapshots in tracked. Snapshots with
+// deferred journals are skipped, as their recovery has not decided yet which
+// of their files are kept.
+func (s *SnapshotManager) findOrphanedPaths(repo internal.Repo, tracked map[string]db.Snapshot) ([]params.OrphanedPath, error) {
+	snapDirs, err := internal.ListSnapshotDirs(repo)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing snapshot dirs")
+	}
+
+	var ret []params.OrphanedPath
+	for snapID, files := range snapDirs {
+		if s.deferredJournals[snapID] {
+			continue
+		}
+		snap, ok := tracked[snapID]
+		if !ok {
+			ret = append(ret, params.OrphanedPath{
+				SnapshotID: snapID,
+				Path:       filepath.Join(repo.MountPoint, internal.SnapshotDir, snapID),
+			})
+			continue
+		}
+
+		for _, file := range files {
+			var found bool
+			for _, disk := range snap.Disks {
+				if disk.Path == file {
+					found = true
+					break
+				}
+			}
+			if !found {
+				ret = append(ret, params.OrphanedPath{
+					SnapshotID: snapID,
+					Path:       file,
+				})
+			}
+		}
+	}
+	return ret, nil
+}
+
+// findMissingFiles returns the paths of the disk snapshot files of snap that
+// no longer exist. Disks on repositories that are not mounted are skipped.
+func (s *SnapshotManager) findMissingFiles(snap db.Snapshot, mounted map[string]bool) []string {
+	var missing []string
+	for _, disk := range snap.Disks {
+		if !mounted[disk.Repo] {
+			continue
+		}
+		if _, err := os.Stat(disk.Path); err != nil && os.IsNotExist(err) {
+			missing = append(missing, disk.Path)
+		}
+	}
+	return missing
+}
+
+// removeOrphanedSnapshot removes a snapshot whose disk files are missing. It
+// waits for operations reading the snapshot to release it, and gives up if
+// that takes longer than the lock timeout. Locks are taken in the same order
+// as DeleteSnapshot does, and the snapshot is checked again once they are
+// held, as it may have been deleted in the meantime. It returns false if
+// there was nothing left to remove.
+func (s *SnapshotManager) removeOrphanedSnapshot(snapID string, mounted map[string]bool) (bool, error) {
+	unlock, err := s.lockWithTimeout(
+		fmt.Sprintf("snapshot %s", snapID), true, snapshotLockKey(snapID))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	s.opsMux.RLock()
+	defer s.opsMux.RUnlock()
+
+	snap, err := s.db.GetSnapshot(snapID)
+	if err != nil {
+		if errors.Cause(err) == storm.ErrNotFound {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "fetching snapshot")
+	}
+	if len(s.findMissingFiles(snap, mounted)) == 0 {
+		return false, nil
+	}
+
+	// The snapshot is unusable. Remove whatever is left of it.
+	if err := s.dbSnapToInternalSnap(snap).Delete(); err != nil {
+		return false, err
+	}
+	if err := s.db.DeleteSnapshot(snap.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReconcileSnapshots compares the snapshots recorded in the database with the
+// snapshot folders present on all repositories. Files and folders that do not
+// belong to any snapshot, and snapshots whose disk files are missing, are
+// reported. If dryRun is false, they are also removed.
+func (s *SnapshotManager) ReconcileSnapshots(dryRun bool) (params.ReconcileReport, error) {
+	if err := s.beginOperation(); err != nil {
+		return params.ReconcileReport{}, err
+	}
+	defer s.endOperation()
+
+	report, mounted, err := s.reconcilePaths(dryRun)
+	if err != nil {
+		return params.ReconcileReport{}, err
+	}
+
+	// Orphaned snapshots are removed without holding opsMux for writing,
+	// as their locks must be taken before opsMux.
+	if !dryRun {
+		for idx, orphan := range report.OrphanedSnapshots {
+			removed, err := s.removeOrphanedSnapshot(orphan.SnapshotID, mounted)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("removing snapshot %s: %s", orphan.SnapshotID, err))
+				continue
+			}
+			report.OrphanedSnapshots[idx].Removed = removed
+		}
+	}
+	return report, nil
+}
+
+// reconcilePaths finds untracked snapshot files and removes them if dryRun is
+// false, and finds snapshots with missing disk files. It returns the report,
+// along with the mount points of the repositories that were checked.
+func (s *SnapshotManager) reconcilePaths(dryRun bool) (params.ReconcileReport, map[string]bool, error) {
+	// Wait for any in-flight operation to finish, so we don't mistake a snapshot
+	// being created for an orphan.
+	s.opsMux.Lock()
+	defer s.opsMux.Unlock()
+
+	repos, err := internal.ParseRepos()
+	if err != nil {
+		return params.ReconcileReport{}, nil, errors.Wrap(err, "fetching repos")
+	}
+
+	snaps, err := s.db.ListAllSnapshots()
+	if err != nil {
+		return params.ReconcileReport{}, nil, errors.Wrap(err, "fetching snapshots")
+	}
+
+	tracked := map[string]db.Snapshot{}
+	for _, snap := range snaps {
+		tracked[snap.ID] = snap
+	}
+
+	// Files of interrupted snapshots are handled by journal recovery.
+	journals, err := s.db.ListJournals()
+	if err != nil {
+		return params.ReconcileReport{}, nil, errors.Wrap(err, "fetching snapshot journals")
+	}
+	for _, journal := range journals {
+		if _, ok := tracked[journal.ID]; !ok {
+			tracked[journal.ID] = journal.Snapshot
+		}
+	}
+
+	report := params.ReconcileReport{
+		DryRun:            dryRun,
+		OrphanedPaths:     []params.OrphanedPath{},
+		OrphanedSnapshots: []params.OrphanedSnapshot{},
+		Errors:            []string{},
+	}
+
+	mounted := map[string]bool{}
+	for _, repo := range repos {
+		if repo.IsMounted() == false {
+			continue
+		}
+		mounted[repo.MountPoint] = true
+
+		orphans, err := s.findOrphanedPaths(repo, tracked)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("repo %s: %s", repo.MountPoint, err))
+			continue
+		}
+
+		for _, orphan := range orphans {
+			if !dryRun {
+				if err := os.RemoveAll(orphan.Path); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("removing %s: %s", orphan.Path, err))
+				} else {
+					orphan.Removed = true
+				}
+			}
+			report.OrphanedPaths = append(report.OrphanedPaths, orphan)
+		}
+	}
+
+	for _, snap := range snaps {
+		missing := s.findMissingFiles(snap, mounted)
+		if len(missing) == 0 {
+			continue
+		}
+		report.OrphanedSnapshots = append(report.OrphanedSnapshots, params.OrphanedSnapshot{
+			SnapshotID:   snap.ID,
+			VMID:         snap.VMID,
+			MissingFiles: missing,
+		})
+	}
+	return report, mounted, nil
+}
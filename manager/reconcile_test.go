@@ -0,0 +1,86 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	"coriolis-ovm-exporter/internal"
+)
+
+func TestFindOrphanedPaths(t *testing.T) {
+	mountPoint, err := ioutil.TempDir("", "reconcile")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(mountPoint)
+
+	baseDir := filepath.Join(mountPoint, internal.SnapshotDir)
+	snapFile := func(snapID, name string) string {
+		return filepath.Join(baseDir, snapID, name)
+	}
+	for _, path := range []string{
+		snapFile("tracked", "disk.img"),
+		snapFile("tracked", "stray.img"),
+		snapFile("journaled", "disk.img"),
+		snapFile("deferred", "disk.img"),
+		snapFile("untracked", "disk.img"),
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+			t.Fatalf("failed to create file: %v", err)
+		}
+	}
+
+	s := &SnapshotManager{
+		deferredJournals: map[string]bool{"deferred": true},
+	}
+	tracked := map[string]db.Snapshot{
+		"tracked": {
+			ID:    "tracked",
+			Disks: []params.DiskSnapshot{{Path: snapFile("tracked", "disk.img")}},
+		},
+		// Journal snapshots are tracked along with saved snapshots.
+		"journaled": {
+			ID:    "journaled",
+			Disks: []params.DiskSnapshot{{Path: snapFile("journaled", "disk.img")}},
+		},
+	}
+
+	got, err := s.findOrphanedPaths(internal.Repo{MountPoint: mountPoint}, tracked)
+	if err != nil {
+		t.Fatalf("findOrphanedPaths() failed: %v", err)
+	}
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].Path < got[j].Path
+	})
+	want := []params.OrphanedPath{
+		{SnapshotID: "tracked", Path: snapFile("tracked", "stray.img")},
+		{SnapshotID: "untracked", Path: filepath.Join(baseDir, "untracked")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("findOrphanedPaths() = %+v, want %+v", got, want)
+	}
+}
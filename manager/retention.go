@@ -0,0 +1,117 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"coriolis-ovm-exporter/config"
+	"coriolis-ovm-exporter/db"
+)
+
+func (s *SnapshotManager) retentionLoop() {
+	interval := s.cfg.Snapshots.RetentionInterval.Duration
+	if interval <= 0 {
+		interval = config.DefaultRetentionInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.retryDeferredJournals()
+			s.enforceRetention()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// expiredSnapshots returns the snapshots that should be removed according to
+// their expiration time and the configured retention policies, mapped to the
+// reason they should be removed.
+func (s *SnapshotManager) expiredSnapshots(snaps []db.Snapshot, now time.Time) map[string]string {
+	maxAge := s.cfg.Snapshots.MaxAge.Duration
+	maxPerVM := s.cfg.Snapshots.MaxSnapshotsPerVM
+
+	expired := map[string]string{}
+	byVM := map[string][]db.Snapshot{}
+	for _, snap := range snaps {
+		switch {
+		case !snap.ExpiresAt.IsZero() && now.After(snap.ExpiresAt):
+			expired[snap.ID] = fmt.Sprintf("expired at %s", snap.ExpiresAt)
+		case maxAge > 0 && now.Sub(snap.CreatedAt) > maxAge:
+			expired[snap.ID] = fmt.Sprintf("older than %s", maxAge)
+		default:
+			byVM[snap.VMID] = append(byVM[snap.VMID], snap)
+		}
+	}
+
+	if maxPerVM > 0 {
+		for _, vmSnaps := range byVM {
+			if len(vmSnaps) <= maxPerVM {
+				continue
+			}
+			sort.Slice(vmSnaps, func(i, j int) bool {
+				return vmSnaps[i].CreatedAt.Before(vmSnaps[j].CreatedAt)
+			})
+			for _, snap := range vmSnaps[:len(vmSnaps)-maxPerVM] {
+				expired[snap.ID] = fmt.Sprintf("exceeds the limit of %d snapshots per VM", maxPerVM)
+			}
+		}
+	}
+	return expired
+}
+
+// enforceRetention deletes all snapshots that have expired, or that violate
+// any of the configured retention policies. Snapshots with active leases are
+// kept until their leases expire. Expired leases are removed.
+func (s *SnapshotManager) enforceRetention() {
+	if err := s.db.DeleteExpiredLeases(time.Now().UTC()); err != nil {
+		log.Printf("failed to remove expired leases: %q", err)
+	}
+
+	snaps, err := s.db.ListAllSnapshots()
+	if err != nil {
+		log.Printf("failed to list snapshots for retention: %q", err)
+		return
+	}
+
+	expired := s.expiredSnapshots(snaps, time.Now().UTC())
+	for _, snap := range snaps {
+		reason, ok := expired[snap.ID]
+		if !ok {
+			continue
+		}
+
+		if _, leased, err := s.activeLease(snap.ID); err != nil || leased {
+			// Retried on the next run.
+			continue
+		}
+
+		if err := s.DeleteSnapshot(snap.VMID, snap.ID, false); err != nil {
+			log.Printf("failed to remove snapshot %s of VM %s (%s): %q", snap.ID, snap.VMID, reason, err)
+			continue
+		}
+		log.Printf("removed snapshot %s of VM %s: %s", snap.ID, snap.VMID, reason)
+	}
+}
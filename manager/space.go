@@ -0,0 +1,300 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"log"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	gErrors "coriolis-ovm-exporter/errors"
+	"coriolis-ovm-exporter/internal"
+)
+
+// physRange is the range [start, end) of physical bytes on a repository.
+type physRange struct {
+	start uint64
+	end   uint64
+}
+
+// mergeRanges sorts ranges and merges the ones that overlap or touch.
+func mergeRanges(ranges []physRange) []physRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	var ret []physRange
+	for _, r := range ranges {
+		if len(ret) > 0 && r.start <= ret[len(ret)-1].end {
+			if r.end > ret[len(ret)-1].end {
+				ret[len(ret)-1].end = r.end
+			}
+			continue
+		}
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+// physicalRanges returns the merged physical ranges referenced by chunks, and
+// the number of bytes held by chunks with no reliable physical offset.
+func physicalRanges(chunks []params.Chunk) ([]physRange, uint64) {
+	var unmapped uint64
+	ranges := make([]physRange, 0, len(chunks))
+	for _, chunk := range chunks {
+		if chunk.Length == 0 {
+			continue
+		}
+		if chunk.Delalloc || chunk.Inline {
+			unmapped += chunk.Length
+			continue
+		}
+		ranges = append(ranges, physRange{
+			start: chunk.Physical,
+			end:   chunk.Physical + chunk.Length,
+		})
+	}
+	return mergeRanges(ranges), unmapped
+}
+
+// rangesSize returns the number of bytes covered by ranges.
+func rangesSize(ranges []physRange) uint64 {
+	var ret uint64
+	for _, r := range ranges {
+		ret += r.end - r.start
+	}
+	return ret
+}
+
+// subtractRanges returns the parts of a that are not covered by b. Both
+// lists must be merged.
+func subtractRanges(a, b []physRange) []physRange {
+	var ret []physRange
+	var idx int
+	for _, r := range a {
+		for idx < len(b) && b[idx].end <= r.start {
+			idx++
+		}
+		cursor := r.start
+		for i := idx; i < len(b) && b[i].start < r.end; i++ {
+			if b[i].start > cursor {
+				ret = append(ret, physRange{start: cursor, end: b[i].start})
+			}
+			if b[i].end > cursor {
+				cursor = b[i].end
+			}
+		}
+		if cursor < r.end {
+			ret = append(ret, physRange{start: cursor, end: r.end})
+		}
+	}
+	return ret
+}
+
+// addUsage adds the values of b to a.
+func addUsage(a *params.SpaceUsage, b params.SpaceUsage) {
+	a.AllocatedBytes += b.AllocatedBytes
+	a.ExclusiveBytes += b.ExclusiveBytes
+	a.SharedBytes += b.SharedBytes
+	a.Exact = a.Exact && b.Exact
+}
+
+// diskSnapshotRef points to a disk of a snapshot.
+type diskSnapshotRef struct {
+	snapIdx int
+	diskIdx int
+	disk    params.DiskSnapshot
+}
+
+// parentRanges returns the physical ranges currently used by the disk at
+// path. The returned boolean is false if they could not be determined.
+func parentRanges(path string) ([]physRange, bool) {
+	allocMap, err := internal.GetAllocationMap(path)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			// The disk was removed. Snapshots no longer share
+			// anything with it.
+			return nil, true
+		}
+		log.Printf("failed to fetch allocation map of %s: %q", path, err)
+		return nil, false
+	}
+	if allocMap.HasPhysicalOffsets() == false {
+		return nil, false
+	}
+	ranges, _ := physicalRanges(allocMap.Chunks)
+	return ranges, true
+}
+
+// accountDisks computes the space used by disks, which are all snapshots of
+// the disk at parentPath. The usage of each disk is set in report, and the
+// usage of the whole group is returned. Bytes used by a disk snapshot are
+// exclusive if no other snapshot of the same disk, nor the disk itself, use
+// them. For the whole group, bytes are exclusive if the disk does not use
+// them, and would be freed if all snapshots of the disk were deleted.
+func accountDisks(parentPath string, disks []diskSnapshotRef, report []params.SnapshotSpaceUsage) params.SpaceUsage {
+	parent, exact := parentRanges(parentPath)
+
+	mapped := make([][]physRange, len(disks))
+	var all []physRange
+	for idx, ref := range disks {
+		if ref.disk.FullCopy || hasPhysicalOffsets(ref.disk) == false {
+			continue
+		}
+		mapped[idx], _ = physicalRanges(ref.disk.Chunks)
+		all = append(all, mapped[idx]...)
+	}
+
+	group := params.SpaceUsage{Exact: exact}
+	union := mergeRanges(all)
+	exclusive := rangesSize(subtractRanges(union, parent))
+	group.AllocatedBytes = rangesSize(union)
+	group.ExclusiveBytes = exclusive
+	group.SharedBytes = group.AllocatedBytes - exclusive
+
+	for idx, ref := range disks {
+		usage := params.SpaceUsage{Exact: true}
+		switch {
+		case ref.disk.FullCopy:
+			// Full copies share nothing with the disk or with
+			// other snapshots.
+			for _, chunk := range ref.disk.Chunks {
+				usage.AllocatedBytes += chunk.Length
+			}
+			usage.ExclusiveBytes = usage.AllocatedBytes
+			addUsage(&group, usage)
+		case hasPhysicalOffsets(ref.disk) == false:
+			// Without physical offsets, we can not tell what is
+			// shared. Assume all of it is.
+			for _, chunk := range ref.disk.Chunks {
+				usage.AllocatedBytes += chunk.Length
+			}
+			usage.SharedBytes = usage.AllocatedBytes
+			usage.Exact = false
+			addUsage(&group, usage)
+		default:
+			others := append([]physRange{}, parent...)
+			for otherIdx := range disks {
+				if otherIdx != idx {
+					others = append(others, mapped[otherIdx]...)
+				}
+			}
+			_, unmapped := physicalRanges(ref.disk.Chunks)
+			usage.ExclusiveBytes = rangesSize(subtractRanges(mapped[idx], mergeRanges(others))) + unmapped
+			usage.AllocatedBytes = rangesSize(mapped[idx]) + unmapped
+			usage.SharedBytes = usage.AllocatedBytes - usage.ExclusiveBytes
+			usage.Exact = exact
+			// Chunks with no physical offset are not part of the union.
+			group.AllocatedBytes += unmapped
+			group.ExclusiveBytes += unmapped
+		}
+
+		snapUsage := &report[ref.snapIdx]
+		snapUsage.Disks[ref.diskIdx].SpaceUsage = usage
+		addUsage(&snapUsage.SpaceUsage, usage)
+	}
+	return group
+}
+
+// spaceReport computes the space used by snaps. Snapshots of the same disk
+// are compared with each other, and with the current extents of the disk.
+func (s *SnapshotManager) spaceReport(snaps []db.Snapshot) params.SpaceReport {
+	report := params.SpaceReport{
+		Repositories: []params.RepoSpaceUsage{},
+		Snapshots:    make([]params.SnapshotSpaceUsage, len(snaps)),
+	}
+
+	groups := map[string][]diskSnapshotRef{}
+	repos := map[string]string{}
+	for snapIdx, snap := range snaps {
+		report.Snapshots[snapIdx] = params.SnapshotSpaceUsage{
+			SnapshotID: snap.ID,
+			VMID:       snap.VMID,
+			Disks:      make([]params.DiskSpaceUsage, len(snap.Disks)),
+			SpaceUsage: params.SpaceUsage{Exact: true},
+		}
+		for diskIdx, disk := range snap.Disks {
+			report.Snapshots[snapIdx].Disks[diskIdx] = params.DiskSpaceUsage{
+				Name: disk.Name,
+				Repo: disk.Repo,
+			}
+			groups[disk.ParentPath] = append(groups[disk.ParentPath], diskSnapshotRef{
+				snapIdx: snapIdx,
+				diskIdx: diskIdx,
+				disk:    disk,
+			})
+			repos[disk.ParentPath] = disk.Repo
+		}
+	}
+
+	repoUsage := map[string]*params.SpaceUsage{}
+	for parentPath, disks := range groups {
+		usage := accountDisks(parentPath, disks, report.Snapshots)
+		repo := repos[parentPath]
+		if _, ok := repoUsage[repo]; !ok {
+			repoUsage[repo] = &params.SpaceUsage{Exact: true}
+		}
+		addUsage(repoUsage[repo], usage)
+	}
+
+	for repo, usage := range repoUsage {
+		report.Repositories = append(report.Repositories, params.RepoSpaceUsage{
+			Repo:       repo,
+			SpaceUsage: *usage,
+		})
+	}
+	sort.Slice(report.Repositories, func(i, j int) bool {
+		return report.Repositories[i].Repo < report.Repositories[j].Repo
+	})
+	return report
+}
+
+// SpaceReport returns the space used by all snapshots, per disk, per snapshot
+// and per repository.
+func (s *SnapshotManager) SpaceReport() (params.SpaceReport, error) {
+	snaps, err := s.db.ListAllSnapshots()
+	if err != nil {
+		return params.SpaceReport{}, errors.Wrap(err, "fetching snapshots")
+	}
+	return s.spaceReport(snaps), nil
+}
+
+// GetSnapshotSpaceUsage returns the space used by a snapshot, and each of its
+// disks. The snapshot is compared with all other snapshots of the same disks.
+func (s *SnapshotManager) GetSnapshotSpaceUsage(vmID, snapID string) (params.SnapshotSpaceUsage, error) {
+	if _, err := s.getSnapshot(vmID, snapID); err != nil {
+		return params.SnapshotSpaceUsage{}, err
+	}
+
+	// Snapshots of the same disks are expected to belong to the same VM.
+	snaps, err := s.db.ListSnapshots(vmID)
+	if err != nil {
+		return params.SnapshotSpaceUsage{}, errors.Wrap(err, "fetching snapshots")
+	}
+
+	report := s.spaceReport(snaps)
+	for _, usage := range report.Snapshots {
+		if usage.SnapshotID == snapID {
+			return usage, nil
+		}
+	}
+	return params.SnapshotSpaceUsage{}, gErrors.ErrNotFound
+}
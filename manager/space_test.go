@@ -0,0 +1,245 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package manager
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"coriolis-ovm-exporter/apiserver/params"
+)
+
+func TestMergeRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		ranges []physRange
+		want   []physRange
+	}{
+		{
+			name: "empty",
+			want: nil,
+		},
+		{
+			name:   "disjoint",
+			ranges: []physRange{{0, 10}, {20, 30}},
+			want:   []physRange{{0, 10}, {20, 30}},
+		},
+		{
+			name:   "touching",
+			ranges: []physRange{{0, 10}, {10, 20}},
+			want:   []physRange{{0, 20}},
+		},
+		{
+			name:   "overlapping",
+			ranges: []physRange{{0, 15}, {10, 20}},
+			want:   []physRange{{0, 20}},
+		},
+		{
+			name:   "contained",
+			ranges: []physRange{{0, 30}, {10, 20}},
+			want:   []physRange{{0, 30}},
+		},
+		{
+			name:   "unsorted",
+			ranges: []physRange{{40, 50}, {10, 20}, {0, 12}, {50, 55}},
+			want:   []physRange{{0, 20}, {40, 55}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeRanges(tt.ranges)
+			if reflect.DeepEqual(got, tt.want) == false {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSubtractRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []physRange
+		b    []physRange
+		want []physRange
+	}{
+		{
+			name: "nothing to subtract",
+			a:    []physRange{{0, 10}, {20, 30}},
+			want: []physRange{{0, 10}, {20, 30}},
+		},
+		{
+			name: "disjoint",
+			a:    []physRange{{0, 10}},
+			b:    []physRange{{20, 30}},
+			want: []physRange{{0, 10}},
+		},
+		{
+			name: "touching",
+			a:    []physRange{{10, 20}},
+			b:    []physRange{{0, 10}, {20, 30}},
+			want: []physRange{{10, 20}},
+		},
+		{
+			name: "overlapping both ends",
+			a:    []physRange{{10, 30}},
+			b:    []physRange{{0, 15}, {25, 40}},
+			want: []physRange{{15, 25}},
+		},
+		{
+			name: "contained",
+			a:    []physRange{{0, 30}},
+			b:    []physRange{{10, 20}},
+			want: []physRange{{0, 10}, {20, 30}},
+		},
+		{
+			name: "fully covered",
+			a:    []physRange{{10, 20}},
+			b:    []physRange{{0, 30}},
+			want: nil,
+		},
+		{
+			name: "spanning several ranges",
+			a:    []physRange{{0, 10}, {20, 30}, {40, 50}},
+			b:    []physRange{{5, 45}},
+			want: []physRange{{0, 5}, {45, 50}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := subtractRanges(tt.a, tt.b)
+			if reflect.DeepEqual(got, tt.want) == false {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAccountDisks(t *testing.T) {
+	tests := []struct {
+		name      string
+		disks     []params.DiskSnapshot
+		wantDisks []params.SpaceUsage
+		wantGroup params.SpaceUsage
+	}{
+		{
+			name: "shared between snapshots",
+			disks: []params.DiskSnapshot{
+				{Chunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}}},
+				{Chunks: []params.Chunk{
+					{Start: 0, Length: 100, Physical: 1000},
+					{Start: 100, Length: 50, Physical: 2000},
+				}},
+			},
+			wantDisks: []params.SpaceUsage{
+				{AllocatedBytes: 100, ExclusiveBytes: 0, SharedBytes: 100, Exact: true},
+				{AllocatedBytes: 150, ExclusiveBytes: 50, SharedBytes: 100, Exact: true},
+			},
+			wantGroup: params.SpaceUsage{AllocatedBytes: 150, ExclusiveBytes: 150, Exact: true},
+		},
+		{
+			name: "overlapping and touching extents",
+			disks: []params.DiskSnapshot{
+				{Chunks: []params.Chunk{
+					{Start: 0, Length: 100, Physical: 1000},
+					{Start: 100, Length: 100, Physical: 1100},
+				}},
+				{Chunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1050}}},
+			},
+			wantDisks: []params.SpaceUsage{
+				{AllocatedBytes: 200, ExclusiveBytes: 100, SharedBytes: 100, Exact: true},
+				{AllocatedBytes: 100, ExclusiveBytes: 0, SharedBytes: 100, Exact: true},
+			},
+			wantGroup: params.SpaceUsage{AllocatedBytes: 200, ExclusiveBytes: 200, Exact: true},
+		},
+		{
+			name: "unmapped extents are exclusive",
+			disks: []params.DiskSnapshot{
+				{Chunks: []params.Chunk{
+					{Start: 0, Length: 100, Physical: 1000},
+					{Start: 100, Length: 30, Delalloc: true},
+				}},
+			},
+			wantDisks: []params.SpaceUsage{
+				{AllocatedBytes: 130, ExclusiveBytes: 130, Exact: true},
+			},
+			wantGroup: params.SpaceUsage{AllocatedBytes: 130, ExclusiveBytes: 130, Exact: true},
+		},
+		{
+			name: "full copy",
+			disks: []params.DiskSnapshot{
+				{Chunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}}},
+				{
+					FullCopy: true,
+					Chunks:   []params.Chunk{{Start: 0, Length: 300, Physical: 1000}},
+				},
+			},
+			wantDisks: []params.SpaceUsage{
+				{AllocatedBytes: 100, ExclusiveBytes: 100, Exact: true},
+				{AllocatedBytes: 300, ExclusiveBytes: 300, Exact: true},
+			},
+			wantGroup: params.SpaceUsage{AllocatedBytes: 400, ExclusiveBytes: 400, Exact: true},
+		},
+		{
+			name: "seek map",
+			disks: []params.DiskSnapshot{
+				{Chunks: []params.Chunk{{Start: 0, Length: 100, Physical: 1000}}},
+				{
+					AllocationMap: params.AllocationMapSeek,
+					Chunks:        []params.Chunk{{Start: 0, Length: 200}},
+				},
+			},
+			wantDisks: []params.SpaceUsage{
+				{AllocatedBytes: 100, ExclusiveBytes: 100, Exact: true},
+				{AllocatedBytes: 200, SharedBytes: 200, Exact: false},
+			},
+			wantGroup: params.SpaceUsage{AllocatedBytes: 300, ExclusiveBytes: 100, SharedBytes: 200, Exact: false},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The disk no longer exists, so snapshots share nothing
+			// with it.
+			parentPath := filepath.Join(t.TempDir(), "missing.img")
+
+			refs := make([]diskSnapshotRef, len(tt.disks))
+			report := make([]params.SnapshotSpaceUsage, len(tt.disks))
+			for idx, disk := range tt.disks {
+				refs[idx] = diskSnapshotRef{snapIdx: idx, diskIdx: 0, disk: disk}
+				report[idx] = params.SnapshotSpaceUsage{
+					Disks:      make([]params.DiskSpaceUsage, 1),
+					SpaceUsage: params.SpaceUsage{Exact: true},
+				}
+			}
+
+			group := accountDisks(parentPath, refs, report)
+			if group != tt.wantGroup {
+				t.Fatalf("expected group usage %+v, got %+v", tt.wantGroup, group)
+			}
+			for idx, want := range tt.wantDisks {
+				if got := report[idx].Disks[0].SpaceUsage; got != want {
+					t.Fatalf("expected usage %+v for disk %d, got %+v", want, idx, got)
+				}
+				if got := report[idx].SpaceUsage; got != want {
+					t.Fatalf("expected usage %+v for snapshot %d, got %+v", want, idx, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package manager
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/asdine/storm"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+
+	"coriolis-ovm-exporter/apiserver/params"
+	"coriolis-ovm-exporter/db"
+	gErrors "coriolis-ovm-exporter/errors"
+	"coriolis-ovm-exporter/internal"
+)
+
+// failInterruptedTasks marks all tasks that were pending or running
+// when the exporter stopped, as failed.
+func (s *SnapshotManager) failInterruptedTasks() error {
+	tasks, err := s.db.ListTasksByState(params.TaskStatePending, params.TaskStateRunning)
+	if err != nil {
+		return errors.Wrap(err, "listing tasks")
+	}
+
+	for _, task := range tasks {
+		log.Printf("marking interrupted task %s as failed", task.ID)
+		task.State = params.TaskStateFailed
+		task.Error = "task was interrupted by a restart of the exporter"
+		if _, err := s.db.UpdateTask(task); err != nil {
+			return errors.Wrapf(err, "updating task %s", task.ID)
+		}
+	}
+	return nil
+}
+
+func (s *SnapshotManager) dbTaskToParamsTask(task db.Task) params.Task {
+	return params.Task{
+		ID:         task.ID,
+		VMID:       task.VMID,
+		State:      task.State,
+		Error:      task.Error,
+		Disks:      task.Disks,
+		SnapshotID: task.SnapshotID,
+		CreatedAt:  task.CreatedAt,
+		UpdatedAt:  task.UpdatedAt,
+	}
+}
+
+// saveTask persists the task, logging any error. Failing to record
+// progress should not fail the snapshot itself.
+func (s *SnapshotManager) saveTask(task db.Task) db.Task {
+	updated, err := s.db.UpdateTask(task)
+	if err != nil {
+		log.Printf("failed to update task %s: %q", task.ID, err)
+		return task
+	}
+	return updated
+}
+
+func (s *SnapshotManager) runSnapshotTask(task db.Task, vm internal.VMConfig, opts internal.SnapshotOptions, record db.Snapshot) {
+	defer s.endOperation()
+
+	task.State = params.TaskStateRunning
+	task = s.saveTask(task)
+
+	opts.Progress = func(disk, stage string) {
+		for idx := range task.Disks {
+			if task.Disks[idx].Name == disk {
+				task.Disks[idx].Stage = stage
+			}
+		}
+		task = s.saveTask(task)
+	}
+
+	if _, err := s.createSnapshot(vm, opts, record); err != nil {
+		log.Printf("task %s failed to create snapshot: %q", task.ID, err)
+		task.State = params.TaskStateFailed
+		task.Error = errors.Cause(err).Error()
+	} else {
+		task.State = params.TaskStateCompleted
+	}
+	s.saveTask(task)
+}
+
+// CreateSnapshotTask starts creating a snapshot of all VM disks in the
+// background, and returns a task that can be used to follow its progress.
+func (s *SnapshotManager) CreateSnapshotTask(vmid string, req params.CreateSnapshotRequest) (task params.Task, err error) {
+	if err := s.beginOperation(); err != nil {
+		return params.Task{}, err
+	}
+	defer func() {
+		// The operation ends when the background task finishes.
+		if err != nil {
+			s.endOperation()
+		}
+	}()
+
+	record, err := s.newSnapshotRecord(req)
+	if err != nil {
+		return params.Task{}, err
+	}
+
+	vm, err := internal.GetVM(vmid)
+	if err != nil {
+		return params.Task{}, errors.Wrap(err, "fetching VM info")
+	}
+
+	opts := s.snapshotOptions(req)
+	if vm.CanSnapshot(opts) == false {
+		return params.Task{}, gErrors.NewBadRequestError("VM does not support reflink cloning")
+	}
+
+	disks, err := vm.Disks()
+	if err != nil {
+		return params.Task{}, errors.Wrap(err, "fetching VM disks")
+	}
+
+	progress := make([]params.DiskProgress, len(disks))
+	for idx, disk := range disks {
+		progress[idx] = params.DiskProgress{
+			Name:  disk.Name,
+			Stage: params.DiskStagePending,
+		}
+	}
+
+	opts.SnapshotID = uuid.NewString()
+	dbTask, err := s.db.CreateTask(uuid.NewString(), vm.Name, opts.SnapshotID, progress)
+	if err != nil {
+		return params.Task{}, errors.Wrap(err, "creating task")
+	}
+
+	go s.runSnapshotTask(dbTask, vm, opts, record)
+
+	return s.dbTaskToParamsTask(dbTask), nil
+}
+
+// GetTask fetches information about a task. If the task has completed,
+// the resulting snapshot is included.
+func (s *SnapshotManager) GetTask(taskID string) (params.Task, error) {
+	task, err := s.db.GetTask(taskID)
+	if err != nil {
+		if errors.Cause(err) == storm.ErrNotFound {
+			return params.Task{}, gErrors.NewNotFoundError(
+				fmt.Sprintf("could not find task %s", taskID))
+		}
+		return params.Task{}, errors.Wrap(err, "fetching task")
+	}
+
+	ret := s.dbTaskToParamsTask(task)
+	if task.State == params.TaskStateCompleted {
+		snap, err := s.GetSnapshot(task.VMID, task.SnapshotID, "", "", true)
+		if err != nil {
+			if errors.Cause(err) != storm.ErrNotFound {
+				return params.Task{}, errors.Wrap(err, "fetching snapshot")
+			}
+			// The snapshot was deleted since the task completed.
+		} else {
+			ret.Snapshot = &snap
+		}
+	}
+	return ret, nil
+}
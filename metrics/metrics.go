@@ -0,0 +1,170 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "coriolis_ovm_exporter"
+
+var (
+	// SnapshotCreateDuration tracks the time it takes to create
+	// a snapshot of all disks of a VM.
+	SnapshotCreateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "snapshot",
+		Name:      "create_duration_seconds",
+		Help:      "Time it takes to create a VM snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 14),
+	})
+	// SnapshotCreateFailures counts failed snapshot creations.
+	SnapshotCreateFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "snapshot",
+		Name:      "create_failures_total",
+		Help:      "Number of failed VM snapshot creations.",
+	})
+	// SnapshotDeleteDuration tracks the time it takes to delete
+	// a snapshot.
+	SnapshotDeleteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "snapshot",
+		Name:      "delete_duration_seconds",
+		Help:      "Time it takes to delete a VM snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+	// SnapshotDeleteFailures counts failed snapshot deletions.
+	SnapshotDeleteFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "snapshot",
+		Name:      "delete_failures_total",
+		Help:      "Number of failed VM snapshot deletions.",
+	})
+
+	// FiemapDuration tracks the time it takes to fetch all extents
+	// of a file.
+	FiemapDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "fiemap",
+		Name:      "walk_duration_seconds",
+		Help:      "Time it takes to fetch the extent map of a disk snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+	// FiemapExtents tracks the number of extents of walked files.
+	FiemapExtents = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "fiemap",
+		Name:      "extents",
+		Help:      "Number of extents found in the extent map of a disk snapshot.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	})
+
+	// DownloadBytes counts the bytes of disk data served to clients,
+	// for each VM. Use VMDownloadBytes to fetch the counter of a VM.
+	DownloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "download",
+		Name:      "bytes_total",
+		Help:      "Bytes of disk snapshot data served to clients.",
+	}, []string{"vm_id"})
+	// ActiveDownloads tracks the number of disk downloads in progress.
+	ActiveDownloads = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "download",
+		Name:      "active",
+		Help:      "Number of disk snapshot downloads in progress.",
+	})
+
+	// Logins counts login attempts against the OVM endpoint, by result.
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "logins_total",
+		Help:      "Login attempts validated against the OVM endpoint.",
+	}, []string{"result"})
+
+	// RepoSnapshotsDesc describes the number of snapshots on each
+	// repository.
+	RepoSnapshotsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "repo", "snapshots"),
+		"Number of disk snapshots stored on a repository.",
+		[]string{"repo"}, nil)
+	// RepoSnapshotBytesDesc describes the total number of bytes mapped
+	// by the extents of all snapshots on each repository.
+	RepoSnapshotBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "repo", "snapshot_allocated_bytes"),
+		"Total size of the extents of all disk snapshots stored on a repository.",
+		[]string{"repo"}, nil)
+)
+
+const (
+	// LoginSuccess is the result label value for successful logins.
+	LoginSuccess = "success"
+	// LoginFailure is the result label value for failed logins.
+	LoginFailure = "failure"
+
+	// OtherVMs is the vm_id label value used for VMs that exceed the
+	// limit set by SetMaxVMLabels.
+	OtherVMs = "other"
+)
+
+var (
+	vmLabelsMux sync.Mutex
+	// vmLabels holds the VM IDs that have their own vm_id label value.
+	vmLabels    = map[string]bool{}
+	maxVMLabels int
+)
+
+// SetMaxVMLabels limits the number of distinct vm_id label values. Once
+// the limit is reached, bytes served for any other VM are counted under
+// the OtherVMs label value. A limit lower than one means no limit.
+func SetMaxVMLabels(max int) {
+	vmLabelsMux.Lock()
+	defer vmLabelsMux.Unlock()
+	maxVMLabels = max
+}
+
+// VMDownloadBytes returns the DownloadBytes counter of a VM.
+func VMDownloadBytes(vmID string) prometheus.Counter {
+	vmLabelsMux.Lock()
+	defer vmLabelsMux.Unlock()
+
+	if vmLabels[vmID] == false {
+		if maxVMLabels > 0 && len(vmLabels) >= maxVMLabels {
+			return DownloadBytes.WithLabelValues(OtherVMs)
+		}
+		vmLabels[vmID] = true
+	}
+	return DownloadBytes.WithLabelValues(vmID)
+}
+
+func init() {
+	prometheus.MustRegister(
+		SnapshotCreateDuration,
+		SnapshotCreateFailures,
+		SnapshotDeleteDuration,
+		SnapshotDeleteFailures,
+		FiemapDuration,
+		FiemapExtents,
+		DownloadBytes,
+		ActiveDownloads,
+		Logins,
+	)
+}
@@ -0,0 +1,41 @@
+// Coriolis OVM exporter
+// Copyright (C) 2021 Cloudbase Solutions SRL
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package metrics
+
+import (
+	"testing"
+)
+
+func TestVMDownloadBytes(t *testing.T) {
+	SetMaxVMLabels(2)
+	defer SetMaxVMLabels(0)
+
+	other := DownloadBytes.WithLabelValues(OtherVMs)
+	for _, vmID := range []string{"vm1", "vm2", "vm1"} {
+		if VMDownloadBytes(vmID) != DownloadBytes.WithLabelValues(vmID) {
+			t.Fatalf("expected %s to have its own label value", vmID)
+		}
+	}
+	if VMDownloadBytes("vm3") != other {
+		t.Fatalf("expected vm3 to be counted under %q", OtherVMs)
+	}
+
+	// Without a limit, every VM gets its own label value.
+	SetMaxVMLabels(0)
+	if VMDownloadBytes("vm3") != DownloadBytes.WithLabelValues("vm3") {
+		t.Fatalf("expected vm3 to have its own label value")
+	}
+}